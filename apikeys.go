@@ -0,0 +1,316 @@
+// Copyright 2020 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package openapi
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/certmagic"
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/invopop/yaml"
+	"go.uber.org/zap"
+)
+
+const defaultAPIKeysReloadInterval = 10 * time.Second
+
+// APIKeys configures checking the keys for apiKey security schemes against a key store. Keys
+// are configured statically, in a JSON or YAML file, or stored as hashes in the Caddy storage.
+type APIKeys struct {
+	// The keys that are accepted.
+	// Default is empty
+	Keys []APIKey `json:"keys,omitempty"`
+	// Path to a JSON or YAML file with a list of keys that are accepted. The
+	// file is loaded again when it changes.
+	// Default is empty
+	File string `json:"file,omitempty"`
+	// Interval at which the file is checked for changes.
+	// Default is 10s
+	ReloadInterval caddy.Duration `json:"reload_interval,omitempty"`
+	// Prefix of the keys in the Caddy storage that API keys are looked up at. Keys
+	// are stored as JSON at <prefix>/<hex encoded SHA-256 hash of the key>, with the
+	// client and scopes properties.
+	// Default is empty, resulting in the storage not being used
+	StoragePrefix string `json:"storage_prefix,omitempty"`
+}
+
+// APIKey is a key for an apiKey security scheme and the client it belongs to
+type APIKey struct {
+	// The key.
+	Key string `json:"key,omitempty"`
+	// The hex encoded SHA-256 hash of the key, as an alternative to the key itself.
+	Hash string `json:"hash,omitempty"`
+	// The identity of the client that the key belongs to.
+	Client string `json:"client"`
+	// The scopes that the key is allowed.
+	Scopes []string `json:"scopes,omitempty"`
+}
+
+// validate checks the APIKeys configuration
+func (a *APIKeys) validate() error {
+	sources := 0
+	for _, configured := range []bool{len(a.Keys) > 0, a.File != "", a.StoragePrefix != ""} {
+		if configured {
+			sources++
+		}
+	}
+	if sources != 1 {
+		return fmt.Errorf("api keys require exactly one of keys, file or storage_prefix")
+	}
+	if a.ReloadInterval < 0 {
+		return fmt.Errorf("api keys reload interval can't be negative; got %s", time.Duration(a.ReloadInterval))
+	}
+	_, err := indexAPIKeys(a.Keys)
+	return err
+}
+
+// apiKeyStore looks up the client that an API key belongs to. It returns nil for unknown keys.
+type apiKeyStore interface {
+	lookup(ctx context.Context, key string) (*APIKey, error)
+}
+
+// newAPIKeyStore returns the apiKeyStore for the configuration
+func newAPIKeyStore(config *APIKeys, storage certmagic.Storage, logger *zap.Logger) (apiKeyStore, error) {
+	switch {
+	case config.File != "":
+		return newFileAPIKeys(config.File, time.Duration(config.ReloadInterval), logger)
+	case config.StoragePrefix != "":
+		if storage == nil {
+			return nil, fmt.Errorf("api keys require a storage")
+		}
+		return &storageAPIKeys{storage: storage, prefix: config.StoragePrefix}, nil
+	default:
+		keys, err := indexAPIKeys(config.Keys)
+		if err != nil {
+			return nil, err
+		}
+		return staticAPIKeys(keys), nil
+	}
+}
+
+// hashAPIKey returns the hex encoded SHA-256 hash of an API key
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// indexAPIKeys returns the keys by their hash
+func indexAPIKeys(keys []APIKey) (map[string]*APIKey, error) {
+	index := map[string]*APIKey{}
+	for i := range keys {
+		key := keys[i]
+		if (key.Key == "") == (key.Hash == "") {
+			return nil, fmt.Errorf("api key %d requires either a key or a hash", i)
+		}
+		if key.Client == "" {
+			return nil, fmt.Errorf("api key %d requires a client", i)
+		}
+		hash := strings.ToLower(key.Hash)
+		if key.Key != "" {
+			hash = hashAPIKey(key.Key)
+		}
+		if decoded, err := hex.DecodeString(hash); err != nil || len(decoded) != sha256.Size {
+			return nil, fmt.Errorf("api key %d has a hash that's not a hex encoded SHA-256 hash", i)
+		}
+		if _, ok := index[hash]; ok {
+			return nil, fmt.Errorf("api key %d is not unique", i)
+		}
+		key.Key = ""
+		index[hash] = &key
+	}
+	return index, nil
+}
+
+// staticAPIKeys are API keys by their hash
+type staticAPIKeys map[string]*APIKey
+
+func (s staticAPIKeys) lookup(_ context.Context, key string) (*APIKey, error) {
+	return s[hashAPIKey(key)], nil
+}
+
+// fileAPIKeys are API keys loaded from a file, which is loaded again when it changes. When
+// loading the file fails, the keys that were loaded before are used.
+type fileAPIKeys struct {
+	path           string
+	reloadInterval time.Duration
+	logger         *zap.Logger
+	now            func() time.Time
+
+	mu        sync.Mutex
+	keys      staticAPIKeys
+	modTime   time.Time
+	size      int64
+	checkedAt time.Time
+}
+
+// newFileAPIKeys returns fileAPIKeys with the keys loaded from the file
+func newFileAPIKeys(path string, reloadInterval time.Duration, logger *zap.Logger) (*fileAPIKeys, error) {
+	if reloadInterval == 0 {
+		reloadInterval = defaultAPIKeysReloadInterval
+	}
+	f := &fileAPIKeys{
+		path:           path,
+		reloadInterval: reloadInterval,
+		logger:         logger,
+		now:            time.Now,
+	}
+	if err := f.reload(); err != nil {
+		return nil, err
+	}
+	f.checkedAt = f.now()
+	return f, nil
+}
+
+func (f *fileAPIKeys) lookup(ctx context.Context, key string) (*APIKey, error) {
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if now := f.now(); now.Sub(f.checkedAt) >= f.reloadInterval {
+		f.checkedAt = now
+		if err := f.reload(); err != nil {
+			f.logger.Warn(fmt.Sprintf("loading api keys failed; using the keys loaded before: %s", err))
+		}
+	}
+
+	return f.keys.lookup(ctx, key)
+}
+
+// reload loads the keys from the file when it changed since it was loaded
+func (f *fileAPIKeys) reload() error {
+
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return fmt.Errorf("loading api keys: %w", err)
+	}
+	if f.keys != nil && info.ModTime().Equal(f.modTime) && info.Size() == f.size {
+		return nil
+	}
+
+	keys := []APIKey{}
+	if err := loadKeyFile(f.path, &keys); err != nil {
+		return fmt.Errorf("loading api keys: %w", err)
+	}
+	index, err := indexAPIKeys(keys)
+	if err != nil {
+		return fmt.Errorf("api keys file %s: %w", f.path, err)
+	}
+
+	f.keys = index
+	f.modTime = info.ModTime()
+	f.size = info.Size()
+
+	return nil
+}
+
+// loadKeyFile loads a JSON or YAML file with keys into v
+func loadKeyFile(path string, v interface{}) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	// JSON is valid YAML, so both formats are parsed as YAML
+	if err := yaml.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("parsing %s: %w", path, err)
+	}
+	return nil
+}
+
+// storageAPIKeys are API keys stored in the Caddy storage by their hash
+type storageAPIKeys struct {
+	storage certmagic.Storage
+	prefix  string
+}
+
+func (s *storageAPIKeys) lookup(ctx context.Context, key string) (*APIKey, error) {
+
+	data, err := s.storage.Load(ctx, path.Join(s.prefix, hashAPIKey(key)))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("loading api key from storage: %w", err)
+	}
+
+	client := &APIKey{}
+	if err := json.Unmarshal(data, client); err != nil {
+		return nil, fmt.Errorf("parsing api key from storage: %w", err)
+	}
+	if client.Client == "" {
+		return nil, fmt.Errorf("api key in storage has no client")
+	}
+
+	return client, nil
+}
+
+// apiKey returns the key for the apiKey security scheme from the request
+func apiKey(r *http.Request, scheme *openapi3.SecurityScheme) (string, error) {
+	name := scheme.Name
+	switch scheme.In {
+	case "query":
+		key := r.URL.Query().Get(name)
+		if key == "" {
+			return "", fmt.Errorf("failed to retrieve API key from query parameter %s", name)
+		}
+		return key, nil
+	case "header":
+		canonicalName := http.CanonicalHeaderKey(name)
+		key := r.Header.Get(canonicalName)
+		if key == "" {
+			return "", fmt.Errorf("failed to retrieve API key from header %s (canonicalized to: %s)", name, canonicalName)
+		}
+		return key, nil
+	case "cookie":
+		// TODO: do we also need to check CSRF tokens?
+		cookie, err := r.Cookie(name)
+		if err != nil {
+			return "", fmt.Errorf("failed to retrieve cookie (%s): %s", name, err.Error())
+		}
+		return cookie.Value, nil
+	default:
+		return "", fmt.Errorf("invalid property %s for carrying an apiKey", scheme.In)
+	}
+}
+
+// authorizeAPIKey looks up the client that the key belongs to and checks that it was allowed the required scopes
+func authorizeAPIKey(ctx context.Context, store apiKeyStore, key string, required []string) (*APIKey, error) {
+
+	client, err := store.lookup(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if client == nil {
+		return nil, &credentialsError{err: errors.New("unknown api key")}
+	}
+
+	if err := checkScopes(required, client.Scopes); err != nil {
+		// Not returned as a scopeError, because the insufficient_scope error is specific to bearer tokens
+		return nil, fmt.Errorf("api key of client %q: %v", client.Client, err)
+	}
+
+	return client, nil
+}
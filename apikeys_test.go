@@ -0,0 +1,191 @@
+// Copyright 2020 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package openapi
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/certmagic"
+	"github.com/getkin/kin-openapi/openapi3"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestAPIKeysValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		apiKeys APIKeys
+		wantErr bool
+	}{
+		{name: "keys", apiKeys: APIKeys{Keys: []APIKey{{Key: "secret", Client: "billing"}, {Hash: hashAPIKey("other"), Client: "reporting"}}}},
+		{name: "file", apiKeys: APIKeys{File: "/etc/caddy/api_keys.yaml", ReloadInterval: caddy.Duration(time.Minute)}},
+		{name: "storage", apiKeys: APIKeys{StoragePrefix: "api_keys"}},
+		{name: "no source", apiKeys: APIKeys{}, wantErr: true},
+		{name: "multiple sources", apiKeys: APIKeys{File: "/etc/caddy/api_keys.yaml", StoragePrefix: "api_keys"}, wantErr: true},
+		{name: "negative reload interval", apiKeys: APIKeys{File: "/etc/caddy/api_keys.yaml", ReloadInterval: -1}, wantErr: true},
+		{name: "key and hash", apiKeys: APIKeys{Keys: []APIKey{{Key: "secret", Hash: hashAPIKey("secret"), Client: "billing"}}}, wantErr: true},
+		{name: "no client", apiKeys: APIKeys{Keys: []APIKey{{Key: "secret"}}}, wantErr: true},
+		{name: "invalid hash", apiKeys: APIKeys{Keys: []APIKey{{Hash: "secret", Client: "billing"}}}, wantErr: true},
+		{name: "duplicate key", apiKeys: APIKeys{Keys: []APIKey{{Key: "secret", Client: "billing"}, {Hash: hashAPIKey("secret"), Client: "reporting"}}}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		if err := tt.apiKeys.validate(); (err != nil) != tt.wantErr {
+			t.Errorf("unexpected error in test %s: %v", tt.name, err)
+		}
+	}
+}
+
+func TestAPIKeysServeHTTP(t *testing.T) {
+
+	v, err := createValidator(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v.APIKeys = &APIKeys{
+		Keys: []APIKey{
+			{Key: "billing-key", Client: "billing", Scopes: []string{"pets:read"}},
+			{Hash: hashAPIKey("reporting-key"), Client: "reporting"},
+		},
+	}
+	n, err := replaceValidator(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.specification.Components.SecuritySchemes = openapi3.SecuritySchemes{
+		"ApiKey": &openapi3.SecuritySchemeRef{Value: &openapi3.SecurityScheme{Type: "apiKey", In: "header", Name: "X-API-Key"}},
+	}
+	n.specification.Security = openapi3.SecurityRequirements{{"ApiKey": []string{"pets:read"}}}
+
+	tests := []struct {
+		name       string
+		key        string
+		wantStatus int
+		wantClient string
+	}{
+		{name: "known key", key: "billing-key", wantStatus: http.StatusOK, wantClient: "billing"},
+		{name: "key without scope", key: "reporting-key", wantStatus: http.StatusForbidden},
+		{name: "unknown key", key: "unknown-key", wantStatus: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		req, err := prepareRequest("GET", "http://localhost:9443/api/pets/1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-API-Key", tt.key)
+
+		recorder := httptest.NewRecorder()
+		n.ServeHTTP(recorder, req, &mockAPI{})
+
+		if status := recorder.Code; status != tt.wantStatus {
+			t.Errorf("handler returned wrong status code in test %s: got %v want %v", tt.name, status, tt.wantStatus)
+		}
+		if challenge := recorder.Header().Get("Www-Authenticate"); challenge != "" {
+			t.Errorf("unexpected WWW-Authenticate header in test %s: %q", tt.name, challenge)
+		}
+
+		replacer := req.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+		if client, _ := replacer.GetString(ReplacerHTTPAuthUserID); client != tt.wantClient {
+			t.Errorf("unexpected client placeholder in test %s: got %q want %q", tt.name, client, tt.wantClient)
+		}
+	}
+}
+
+func TestFileAPIKeysReload(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "api_keys.yaml")
+	write := func(content string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	lookup := func(keys *fileAPIKeys, key string, wantClient string) {
+		t.Helper()
+		client, err := keys.lookup(context.Background(), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := ""
+		if client != nil {
+			got = client.Client
+		}
+		if got != wantClient {
+			t.Errorf("unexpected client for %s: got %q want %q", key, got, wantClient)
+		}
+	}
+
+	write("- key: billing-key\n  client: billing\n  scopes: [pets:read]\n")
+
+	keys, err := newFileAPIKeys(path, time.Minute, zaptest.NewLogger(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	keys.now = func() time.Time { return now }
+
+	lookup(keys, "billing-key", "billing")
+	lookup(keys, "reporting-key", "")
+
+	// The file is only checked for changes after the reload interval
+	write(`[{"key": "reporting-key", "client": "reporting"}]`)
+	lookup(keys, "reporting-key", "")
+
+	now = now.Add(time.Minute)
+	lookup(keys, "reporting-key", "reporting")
+	lookup(keys, "billing-key", "")
+
+	// The keys loaded before are used when the file is invalid
+	write("- client: reporting\n")
+	now = now.Add(time.Minute)
+	lookup(keys, "reporting-key", "reporting")
+}
+
+func TestStorageAPIKeys(t *testing.T) {
+
+	storage := &certmagic.FileStorage{Path: t.TempDir()}
+	ctx := context.Background()
+	if err := storage.Store(ctx, "api_keys/"+hashAPIKey("billing-key"), []byte(`{"client": "billing", "scopes": ["pets:read"]}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := newAPIKeyStore(&APIKeys{StoragePrefix: "api_keys"}, storage, zaptest.NewLogger(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := store.lookup(ctx, "billing-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client == nil || client.Client != "billing" || len(client.Scopes) != 1 {
+		t.Errorf("unexpected client for known key: %#v", client)
+	}
+
+	client, err = store.lookup(ctx, "unknown-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client != nil {
+		t.Errorf("unexpected client for unknown key: %#v", client)
+	}
+}
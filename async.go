@@ -0,0 +1,303 @@
+// Copyright 2020 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package openapi
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/getkin/kin-openapi/openapi3filter"
+)
+
+const (
+	asyncDropNewest = "drop_newest"
+	asyncDropOldest = "drop_oldest"
+
+	defaultAsyncQueueSize   = 1024
+	defaultAsyncWorkers     = 4
+	defaultAsyncMaxBodySize = 1 << 20
+)
+
+// AsyncResponses configures asynchronous validation of responses. Responses are
+// streamed to the client immediately, while a copy is validated in the background
+// by a pool of workers. Because the response has already been sent when it is
+// validated, this only applies to responses validated in report mode.
+type AsyncResponses struct {
+	// Operations to validate asynchronously, identified by their operationId or by
+	// method and path, e.g. "GET /pets/{petId}".
+	// Default is empty, resulting in all operations being validated asynchronously
+	Operations []string `json:"operations,omitempty"`
+	// Maximum number of responses waiting to be validated.
+	// Default is 1024
+	QueueSize int `json:"queue_size,omitempty"`
+	// Number of workers validating responses.
+	// Default is 4
+	Workers int `json:"workers,omitempty"`
+	// What to drop when the queue is full: drop_newest or drop_oldest.
+	// Default is drop_newest
+	DropPolicy string `json:"drop_policy,omitempty"`
+	// Maximum size in bytes of a response body copy. Larger responses are dropped.
+	// Default is 1MiB
+	MaxBodySize int64 `json:"max_body_size,omitempty"`
+}
+
+// validate checks the AsyncResponses configuration
+func (a *AsyncResponses) validate() error {
+	if a.QueueSize < 0 || a.Workers < 0 || a.MaxBodySize < 0 {
+		return fmt.Errorf("async response queue size, workers and maximum body size can't be negative")
+	}
+	switch a.DropPolicy {
+	case "", asyncDropNewest, asyncDropOldest:
+	default:
+		return fmt.Errorf("invalid async response drop policy %q", a.DropPolicy)
+	}
+	return nil
+}
+
+// asyncJob is a response waiting to be validated
+type asyncJob struct {
+	input     *openapi3filter.RequestValidationInput
+	status    int
+	header    http.Header
+	body      *bytes.Buffer
+	operation string
+	rate      float64
+}
+
+// asyncValidator validates queued responses using a pool of workers
+type asyncValidator struct {
+	operations  map[string]bool
+	workers     int
+	dropOldest  bool
+	maxBodySize int64
+
+	mu     sync.RWMutex
+	closed bool
+	queue  chan *asyncJob
+	wg     sync.WaitGroup
+
+	// validate is called by the workers for every queued job
+	validate func(job *asyncJob)
+	// drop is called for every job that is dropped, with the reason for dropping it
+	drop func(job *asyncJob, reason string)
+}
+
+// newAsyncValidator creates an asyncValidator, using defaults for missing configuration
+func newAsyncValidator(config *AsyncResponses) *asyncValidator {
+	a := &asyncValidator{
+		operations:  map[string]bool{},
+		workers:     config.Workers,
+		dropOldest:  config.DropPolicy == asyncDropOldest,
+		maxBodySize: config.MaxBodySize,
+		validate:    func(*asyncJob) {},
+		drop:        func(*asyncJob, string) {},
+	}
+	for _, operation := range config.Operations {
+		a.operations[operation] = true
+	}
+	queueSize := config.QueueSize
+	if queueSize == 0 {
+		queueSize = defaultAsyncQueueSize
+	}
+	a.queue = make(chan *asyncJob, queueSize)
+	if a.workers == 0 {
+		a.workers = defaultAsyncWorkers
+	}
+	if a.maxBodySize == 0 {
+		a.maxBodySize = defaultAsyncMaxBodySize
+	}
+	return a
+}
+
+// handles returns whether responses for the operation of the route are validated asynchronously
+func (a *asyncValidator) handles(input *openapi3filter.RequestValidationInput) bool {
+	if len(a.operations) == 0 {
+		return true
+	}
+	route := input.Route
+	return a.operations[route.Operation.OperationID] || a.operations[operationKey(route)]
+}
+
+// start starts the workers
+func (a *asyncValidator) start() {
+	for i := 0; i < a.workers; i++ {
+		a.wg.Add(1)
+		go func() {
+			defer a.wg.Done()
+			for job := range a.queue {
+				a.validate(job)
+			}
+		}()
+	}
+}
+
+// stop stops accepting new jobs and waits for the queued jobs to be validated
+func (a *asyncValidator) stop() {
+	a.mu.Lock()
+	if !a.closed {
+		a.closed = true
+		close(a.queue)
+	}
+	a.mu.Unlock()
+	a.wg.Wait()
+}
+
+// enqueue adds a job to the queue, dropping a job according to the drop policy when it's full
+func (a *asyncValidator) enqueue(job *asyncJob) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	if a.closed {
+		a.drop(job, "stopped")
+		return
+	}
+
+	select {
+	case a.queue <- job:
+		return
+	default:
+	}
+
+	if !a.dropOldest {
+		a.drop(job, "queue_full")
+		return
+	}
+
+	// Make room for the new job by dropping the oldest one. Other requests may
+	// be doing the same at the same time, so this is retried a couple of times.
+	for i := 0; i < 3; i++ {
+		select {
+		case old := <-a.queue:
+			a.drop(old, "queue_full")
+		default:
+		}
+		select {
+		case a.queue <- job:
+			return
+		default:
+		}
+	}
+
+	a.drop(job, "queue_full")
+}
+
+// serveAsync streams the response to the client, while a copy of it is queued for validation
+func (v *Validator) serveAsync(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler, input *openapi3filter.RequestValidationInput, operation string, rate float64) error {
+
+	buffer := v.bufferPool.Get()
+	tee := &teeResponseWriter{
+		ResponseWriterWrapper: &caddyhttp.ResponseWriterWrapper{ResponseWriter: w},
+		buf:                   buffer,
+		limit:                 v.async.maxBodySize,
+	}
+
+	err := next.ServeHTTP(tee, r)
+	if err != nil {
+		v.bufferPool.Put(buffer)
+		return err
+	}
+
+	job := &asyncJob{
+		input:     input,
+		status:    tee.Status(),
+		header:    w.Header().Clone(),
+		body:      buffer,
+		operation: operation,
+		rate:      rate,
+	}
+
+	if tee.truncated {
+		v.async.drop(job, "too_large")
+		return nil
+	}
+
+	v.async.enqueue(job)
+
+	return nil
+}
+
+// validateAsync validates a queued response, logging and recording violations
+func (v *Validator) validateAsync(job *asyncJob) {
+
+	// The request has been handled already, so its context can't be used anymore
+	oerr := v.validateResponse(context.Background(), job.status, job.header, job.body, int64(job.body.Len()), job.input)
+	v.bufferPool.Put(job.body)
+
+	v.observeResponse(job.operation, job.rate, sampleValidated, oerr != nil)
+	if oerr != nil {
+		v.logError(oerr)
+	}
+}
+
+// dropAsync records a response that was dropped instead of being validated
+func (v *Validator) dropAsync(job *asyncJob, reason string) {
+	v.bufferPool.Put(job.body)
+	v.observeResponse(job.operation, job.rate, sampleDropped, false)
+	validatorMetrics.asyncDropped.WithLabelValues(v.Filepath, reason).Inc()
+}
+
+// teeResponseWriter writes a response to the underlying ResponseWriter, while
+// keeping a copy of the body. When the body grows larger than the limit, the
+// copy is discarded and the response is marked as truncated.
+type teeResponseWriter struct {
+	*caddyhttp.ResponseWriterWrapper
+	status    int
+	buf       *bytes.Buffer
+	limit     int64
+	truncated bool
+}
+
+// WriteHeader records the status and writes it to the underlying ResponseWriter
+func (tw *teeResponseWriter) WriteHeader(status int) {
+	if tw.status == 0 && (status < 100 || status > 199) {
+		tw.status = status
+	}
+	tw.ResponseWriterWrapper.WriteHeader(status)
+}
+
+// Write writes the data to the underlying ResponseWriter and copies it
+func (tw *teeResponseWriter) Write(data []byte) (int, error) {
+	if tw.status == 0 {
+		tw.status = http.StatusOK
+	}
+	n, err := tw.ResponseWriterWrapper.Write(data)
+	if !tw.truncated {
+		if int64(tw.buf.Len()+n) > tw.limit {
+			tw.truncated = true
+			tw.buf.Reset()
+		} else {
+			tw.buf.Write(data[:n])
+		}
+	}
+	return n, err
+}
+
+// ReadFrom makes sure that data read from r is copied too
+func (tw *teeResponseWriter) ReadFrom(r io.Reader) (int64, error) {
+	return io.Copy(struct{ io.Writer }{tw}, r)
+}
+
+// Status returns the status code that was written
+func (tw *teeResponseWriter) Status() int {
+	if tw.status == 0 {
+		return http.StatusOK
+	}
+	return tw.status
+}
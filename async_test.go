@@ -0,0 +1,156 @@
+// Copyright 2020 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package openapi
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestAsyncDropPolicies(t *testing.T) {
+	tests := []struct {
+		name        string
+		policy      string
+		wantDropped int
+		wantQueued  int
+	}{
+		{name: "drop newest", policy: "drop_newest", wantDropped: 3, wantQueued: 2},
+		{name: "drop oldest", policy: "drop_oldest", wantDropped: 1, wantQueued: 3},
+	}
+
+	for _, tt := range tests {
+		// The workers aren't started, so that jobs stay in the queue
+		a := newAsyncValidator(&AsyncResponses{QueueSize: 2, DropPolicy: tt.policy})
+		dropped := []int{}
+		a.drop = func(job *asyncJob, reason string) {
+			if reason != "queue_full" {
+				t.Errorf("unexpected drop reason in test %s: %s", tt.name, reason)
+			}
+			dropped = append(dropped, job.status)
+		}
+
+		for i := 1; i <= 3; i++ {
+			a.enqueue(&asyncJob{status: i})
+		}
+
+		if len(dropped) != 1 || dropped[0] != tt.wantDropped {
+			t.Errorf("unexpected dropped jobs in test %s: got %v want [%d]", tt.name, dropped, tt.wantDropped)
+		}
+
+		a.stop()
+		last := 0
+		for job := range a.queue {
+			last = job.status
+		}
+		if last != tt.wantQueued {
+			t.Errorf("unexpected last queued job in test %s: got %d want %d", tt.name, last, tt.wantQueued)
+		}
+	}
+}
+
+func TestAsyncServeHTTP(t *testing.T) {
+	v, err := createValidator(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v.Enforcement = &Enforcement{Response: EnforceModeReport}
+	v.AsyncResponses = &AsyncResponses{Workers: 1}
+	n, err := replaceValidator(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	results := make(chan *oapiError, 1)
+	n.async = newAsyncValidator(n.AsyncResponses)
+	n.async.validate = func(job *asyncJob) {
+		results <- n.validateResponse(context.Background(), job.status, job.header, job.body, int64(job.body.Len()), job.input)
+	}
+	n.async.start()
+	defer n.Cleanup()
+
+	req, err := prepareRequest("GET", "http://localhost:9443/api/pets/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := httptest.NewRecorder()
+
+	err = n.ServeHTTP(recorder, req, &mockWrongAPI{})
+	if err != nil {
+		t.Error(err)
+	}
+
+	if status := recorder.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusOK)
+	}
+
+	if got := outcomeOf(req, phaseResponse); got != "deferred" {
+		t.Errorf("unexpected response outcome: got %s want deferred", got)
+	}
+
+	if oerr := <-results; oerr == nil {
+		t.Error("expected the invalid response to be reported asynchronously")
+	}
+}
+
+func TestTeeResponseWriter(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	buffer := &bytes.Buffer{}
+
+	tee := &teeResponseWriter{
+		ResponseWriterWrapper: &caddyhttp.ResponseWriterWrapper{ResponseWriter: recorder},
+		buf:                   buffer,
+		limit:                 8,
+	}
+
+	tee.WriteHeader(http.StatusCreated)
+	tee.Write([]byte("1234"))
+	if tee.truncated || buffer.String() != "1234" {
+		t.Errorf("unexpected copy of the body: %q (truncated: %t)", buffer.String(), tee.truncated)
+	}
+
+	tee.Write([]byte("56789"))
+	if !tee.truncated || buffer.Len() != 0 {
+		t.Errorf("expected the copy of the body to be truncated: %q", buffer.String())
+	}
+
+	if recorder.Body.String() != "123456789" || recorder.Code != http.StatusCreated || tee.Status() != http.StatusCreated {
+		t.Errorf("unexpected response written: %d %q", recorder.Code, recorder.Body.String())
+	}
+}
+
+func TestAsyncDroppedResponsesAreCounted(t *testing.T) {
+	v, err := createValidator(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	responses := validatorMetrics.responses.WithLabelValues(v.Filepath, "dropped-operation", sampleDropped)
+	before := testutil.ToFloat64(responses)
+
+	v.dropAsync(&asyncJob{body: v.bufferPool.Get(), operation: "dropped-operation", rate: 0.5}, "queue_full")
+
+	if got := testutil.ToFloat64(responses) - before; got != 1 {
+		t.Errorf("unexpected number of dropped responses: got %v want 1", got)
+	}
+}
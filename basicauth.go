@@ -0,0 +1,212 @@
+// Copyright 2020 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package openapi
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ReplacerHTTPAuthUserID is the Caddy Replacer key for the ID of the authenticated user. It's
+// the same key that is set by the Caddy authentication handler.
+const ReplacerHTTPAuthUserID = "http.auth.user.id"
+
+const defaultBasicAuthRealm = "restricted"
+
+// BasicAuth configures checking the credentials for http security schemes with the basic
+// scheme. Passwords are bcrypt hashes, like those used by the Caddy basic_auth directive.
+type BasicAuth struct {
+	// The accounts that credentials are checked against.
+	// Default is empty
+	Accounts []BasicAuthAccount `json:"accounts,omitempty"`
+	// Path to an htpasswd file with accounts that credentials are checked against,
+	// in addition to the accounts above. Only bcrypt hashes are supported.
+	// Default is empty
+	HtpasswdFile string `json:"htpasswd_file,omitempty"`
+	// The realm that's sent in the WWW-Authenticate header when credentials are rejected.
+	// Default is restricted
+	Realm string `json:"realm,omitempty"`
+}
+
+// BasicAuthAccount is an account for HTTP basic authentication
+type BasicAuthAccount struct {
+	// The username of the account.
+	Username string `json:"username"`
+	// The bcrypt hash of the password of the account. Base64-encoded hashes are supported too.
+	Password string `json:"password"`
+}
+
+// validate checks the BasicAuth configuration
+func (b *BasicAuth) validate() error {
+	if len(b.Accounts) == 0 && b.HtpasswdFile == "" {
+		return fmt.Errorf("basic auth requires accounts or an htpasswd_file")
+	}
+	for i, account := range b.Accounts {
+		if account.Username == "" || account.Password == "" {
+			return fmt.Errorf("basic auth account %d requires a username and password", i)
+		}
+	}
+	return nil
+}
+
+// credentialsError is an error for credentials that are not accepted. The challenge is sent in
+// the WWW-Authenticate header of the response, when set.
+type credentialsError struct {
+	challenge string
+	err       error
+}
+
+func (e *credentialsError) Error() string {
+	return fmt.Sprintf("invalid credentials: %s", e.err)
+}
+
+func (e *credentialsError) Unwrap() error {
+	return e.err
+}
+
+// basicAuthenticator checks HTTP basic authentication credentials
+type basicAuthenticator struct {
+	realm     string
+	passwords map[string][]byte
+	// fakePassword is compared for unknown users, so that they take about as long to reject as known users
+	fakePassword []byte
+}
+
+// newBasicAuthenticator returns a basicAuthenticator with the accounts in the configuration
+func newBasicAuthenticator(config *BasicAuth) (*basicAuthenticator, error) {
+
+	realm := config.Realm
+	if realm == "" {
+		realm = defaultBasicAuthRealm
+	}
+
+	b := &basicAuthenticator{
+		realm:     realm,
+		passwords: map[string][]byte{},
+	}
+
+	repl := caddy.NewReplacer()
+	for _, account := range config.Accounts {
+		if err := b.add(repl.ReplaceAll(account.Username, ""), repl.ReplaceAll(account.Password, "")); err != nil {
+			return nil, err
+		}
+	}
+
+	if config.HtpasswdFile != "" {
+		if err := b.loadHtpasswd(config.HtpasswdFile); err != nil {
+			return nil, err
+		}
+	}
+
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		return nil, err
+	}
+	fake, err := bcrypt.GenerateFromPassword(random, bcrypt.DefaultCost)
+	if err != nil {
+		return nil, err
+	}
+	b.fakePassword = fake
+
+	return b, nil
+}
+
+// add adds an account with a bcrypt hash, which may be base64-encoded
+func (b *basicAuthenticator) add(username string, hash string) error {
+
+	if _, ok := b.passwords[username]; ok {
+		return fmt.Errorf("basic auth username is not unique: %s", username)
+	}
+
+	password := []byte(hash)
+	if !strings.HasPrefix(hash, "$") {
+		decoded, err := base64.StdEncoding.DecodeString(hash)
+		if err != nil {
+			return fmt.Errorf("base64-decoding password of basic auth user %s: %w", username, err)
+		}
+		password = decoded
+	}
+
+	if _, err := bcrypt.Cost(password); err != nil {
+		return fmt.Errorf("password of basic auth user %s is not a bcrypt hash: %w", username, err)
+	}
+
+	b.passwords[username] = password
+
+	return nil
+}
+
+// loadHtpasswd adds the accounts in an htpasswd file
+func (b *basicAuthenticator) loadHtpasswd(path string) error {
+
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("opening htpasswd file: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		username, hash, ok := strings.Cut(text, ":")
+		if !ok || username == "" || !strings.HasPrefix(hash, "$2") {
+			return fmt.Errorf("htpasswd file %s: line %d should be a username and a bcrypt hash", path, line)
+		}
+		if err := b.add(username, hash); err != nil {
+			return fmt.Errorf("htpasswd file %s: line %d: %w", path, line, err)
+		}
+	}
+
+	return scanner.Err()
+}
+
+// authenticate checks the basic authentication credentials of the request and returns the username
+func (b *basicAuthenticator) authenticate(r *http.Request) (string, error) {
+
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return "", b.reject(errors.New("no HTTP basic authentication credentials provided"))
+	}
+
+	hash, exists := b.passwords[username]
+	if !exists {
+		hash = b.fakePassword
+	}
+
+	if err := bcrypt.CompareHashAndPassword(hash, []byte(password)); err != nil || !exists {
+		return "", b.reject(fmt.Errorf("wrong username or password for user %q", username))
+	}
+
+	return username, nil
+}
+
+// reject returns a credentialsError with the Basic challenge for the realm
+func (b *basicAuthenticator) reject(err error) error {
+	return &credentialsError{challenge: fmt.Sprintf(`Basic realm="%s"`, b.realm), err: err}
+}
@@ -0,0 +1,154 @@
+// Copyright 2020 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package openapi
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/getkin/kin-openapi/openapi3"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// hashPassword returns a bcrypt hash of the password, using the minimum cost to keep tests fast
+func hashPassword(t *testing.T, password string) string {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(hash)
+}
+
+// writeHtpasswd writes an htpasswd file with the lines and returns its path
+func writeHtpasswd(t *testing.T, lines string) string {
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	if err := os.WriteFile(path, []byte(lines), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestBasicAuthValidate(t *testing.T) {
+	tests := []struct {
+		name      string
+		basicAuth BasicAuth
+		wantErr   bool
+	}{
+		{name: "accounts", basicAuth: BasicAuth{Accounts: []BasicAuthAccount{{Username: "alice", Password: "$2a$04$hash"}}}},
+		{name: "htpasswd file", basicAuth: BasicAuth{HtpasswdFile: "/etc/caddy/htpasswd"}},
+		{name: "no accounts", basicAuth: BasicAuth{}, wantErr: true},
+		{name: "no username", basicAuth: BasicAuth{Accounts: []BasicAuthAccount{{Password: "$2a$04$hash"}}}, wantErr: true},
+		{name: "no password", basicAuth: BasicAuth{Accounts: []BasicAuthAccount{{Username: "alice"}}}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		if err := tt.basicAuth.validate(); (err != nil) != tt.wantErr {
+			t.Errorf("unexpected error in test %s: %v", tt.name, err)
+		}
+	}
+}
+
+func TestNewBasicAuthenticator(t *testing.T) {
+	hash := hashPassword(t, "secret")
+	tests := []struct {
+		name      string
+		basicAuth BasicAuth
+		wantErr   bool
+	}{
+		{name: "ok", basicAuth: BasicAuth{Accounts: []BasicAuthAccount{{Username: "alice", Password: hash}}, HtpasswdFile: writeHtpasswd(t, "# users\nbob:"+hash+"\n")}},
+		{name: "duplicate username", basicAuth: BasicAuth{Accounts: []BasicAuthAccount{{Username: "alice", Password: hash}}, HtpasswdFile: writeHtpasswd(t, "alice:"+hash+"\n")}, wantErr: true},
+		{name: "not a bcrypt hash", basicAuth: BasicAuth{Accounts: []BasicAuthAccount{{Username: "alice", Password: "$apr1$salt$hash"}}}, wantErr: true},
+		{name: "invalid base64", basicAuth: BasicAuth{Accounts: []BasicAuthAccount{{Username: "alice", Password: "secret!"}}}, wantErr: true},
+		{name: "unsupported htpasswd hash", basicAuth: BasicAuth{HtpasswdFile: writeHtpasswd(t, "bob:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n")}, wantErr: true},
+		{name: "missing htpasswd file", basicAuth: BasicAuth{HtpasswdFile: filepath.Join(t.TempDir(), "missing")}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		if _, err := newBasicAuthenticator(&tt.basicAuth); (err != nil) != tt.wantErr {
+			t.Errorf("unexpected error in test %s: %v", tt.name, err)
+		}
+	}
+}
+
+func TestBasicAuthServeHTTP(t *testing.T) {
+
+	v, err := createValidator(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v.BasicAuth = &BasicAuth{
+		Accounts: []BasicAuthAccount{
+			{Username: "alice", Password: hashPassword(t, "alice-secret")},
+			{Username: "bob", Password: base64.StdEncoding.EncodeToString([]byte(hashPassword(t, "bob-secret")))},
+		},
+		HtpasswdFile: writeHtpasswd(t, "carol:"+hashPassword(t, "carol-secret")+"\n"),
+		Realm:        "petstore",
+	}
+	n, err := replaceValidator(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.specification.Components.SecuritySchemes = openapi3.SecuritySchemes{
+		"BasicAuth": &openapi3.SecuritySchemeRef{Value: &openapi3.SecurityScheme{Type: "http", Scheme: "basic"}},
+	}
+	n.specification.Security = openapi3.SecurityRequirements{{"BasicAuth": []string{}}}
+
+	tests := []struct {
+		name       string
+		username   string
+		password   string
+		wantStatus int
+		wantUser   string
+	}{
+		{name: "account", username: "alice", password: "alice-secret", wantStatus: http.StatusOK, wantUser: "alice"},
+		{name: "base64-encoded hash", username: "bob", password: "bob-secret", wantStatus: http.StatusOK, wantUser: "bob"},
+		{name: "htpasswd file", username: "carol", password: "carol-secret", wantStatus: http.StatusOK, wantUser: "carol"},
+		{name: "wrong password", username: "alice", password: "bob-secret", wantStatus: http.StatusUnauthorized},
+		{name: "unknown user", username: "dave", password: "alice-secret", wantStatus: http.StatusUnauthorized},
+		{name: "no credentials", wantStatus: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		req, err := prepareRequest("GET", "http://localhost:9443/api/pets/1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.username != "" {
+			req.SetBasicAuth(tt.username, tt.password)
+		}
+
+		recorder := httptest.NewRecorder()
+		n.ServeHTTP(recorder, req, &mockAPI{})
+
+		if status := recorder.Code; status != tt.wantStatus {
+			t.Errorf("handler returned wrong status code in test %s: got %v want %v", tt.name, status, tt.wantStatus)
+		}
+		if tt.wantStatus == http.StatusUnauthorized {
+			if challenge := recorder.Header().Get("Www-Authenticate"); challenge != `Basic realm="petstore"` {
+				t.Errorf("unexpected WWW-Authenticate header in test %s: %q", tt.name, challenge)
+			}
+		}
+
+		replacer := req.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+		if user, _ := replacer.GetString(ReplacerHTTPAuthUserID); user != tt.wantUser {
+			t.Errorf("unexpected user placeholder in test %s: got %q want %q", tt.name, user, tt.wantUser)
+		}
+	}
+}
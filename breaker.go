@@ -0,0 +1,222 @@
+// Copyright 2020 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package openapi
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/getkin/kin-openapi/routers"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultBreakerThreshold   = 0.5
+	defaultBreakerMinRequests = 20
+	defaultBreakerWindow      = time.Minute
+	defaultBreakerCooldown    = 5 * time.Minute
+
+	// breakerSlots is the number of slots the sliding window is divided in
+	breakerSlots = 10
+)
+
+// Breaker configures a circuit breaker for response validation. When the ratio of
+// invalid responses for an operation crosses the threshold within the sliding window,
+// response validation for the operation fails open: it is switched to report-only
+// until the cool-down has passed. Only responses are taken into account, so that
+// clients can't switch off enforcement by sending invalid requests.
+type Breaker struct {
+	// Ratio of invalid responses (between 0 and 1) at which the breaker opens.
+	// Default is 0.5
+	Threshold float64 `json:"threshold,omitempty"`
+	// Minimum number of responses within the window before the breaker can open.
+	// Default is 20
+	MinRequests int `json:"min_requests,omitempty"`
+	// Duration of the sliding window that responses are counted in.
+	// Default is 1m
+	Window caddy.Duration `json:"window,omitempty"`
+	// Duration after which enforcement is restored for an operation.
+	// Default is 5m
+	Cooldown caddy.Duration `json:"cooldown,omitempty"`
+}
+
+// validate checks the Breaker configuration
+func (b *Breaker) validate() error {
+	if b.Threshold < 0 || b.Threshold > 1 {
+		return fmt.Errorf("breaker threshold should be between 0 and 1; got %v", b.Threshold)
+	}
+	if b.MinRequests < 0 {
+		return fmt.Errorf("breaker minimum number of requests can't be negative")
+	}
+	if b.Window < 0 || b.Cooldown < 0 {
+		return fmt.Errorf("breaker window and cool-down can't be negative")
+	}
+	return nil
+}
+
+// breakerSlot counts the responses within a part of the sliding window
+type breakerSlot struct {
+	start      time.Time
+	total      int
+	violations int
+}
+
+// operationBreaker is the state of the circuit breaker for a single operation
+type operationBreaker struct {
+	slots     [breakerSlots]breakerSlot
+	openUntil time.Time
+}
+
+// breakers keeps track of the circuit breaker state for all operations
+type breakers struct {
+	threshold   float64
+	minRequests int
+	window      time.Duration
+	cooldown    time.Duration
+
+	mu         sync.Mutex
+	operations map[string]*operationBreaker
+
+	// now returns the current time; it can be replaced in tests
+	now func() time.Time
+	// onChange is called when the breaker for an operation opens or closes
+	onChange func(operation string, open bool)
+}
+
+// newBreakers creates the circuit breakers, using defaults for missing configuration
+func newBreakers(config *Breaker) *breakers {
+	b := &breakers{
+		threshold:   config.Threshold,
+		minRequests: config.MinRequests,
+		window:      time.Duration(config.Window),
+		cooldown:    time.Duration(config.Cooldown),
+		operations:  map[string]*operationBreaker{},
+		now:         time.Now,
+		onChange:    func(string, bool) {},
+	}
+	if b.threshold == 0 {
+		b.threshold = defaultBreakerThreshold
+	}
+	if b.minRequests == 0 {
+		b.minRequests = defaultBreakerMinRequests
+	}
+	if b.window == 0 {
+		b.window = defaultBreakerWindow
+	}
+	if b.cooldown == 0 {
+		b.cooldown = defaultBreakerCooldown
+	}
+	return b
+}
+
+// operationKey returns the key identifying the operation of a route
+func operationKey(route *routers.Route) string {
+	return route.Method + " " + route.Path
+}
+
+// open returns whether the breaker for the operation is open. A breaker that has
+// been open for the duration of the cool-down is closed again.
+func (b *breakers) open(operation string) bool {
+	b.mu.Lock()
+	ob, ok := b.operations[operation]
+	if !ok || ob.openUntil.IsZero() {
+		b.mu.Unlock()
+		return false
+	}
+	if b.now().Before(ob.openUntil) {
+		b.mu.Unlock()
+		return true
+	}
+	// The cool-down has passed; start with a clean window
+	*ob = operationBreaker{}
+	b.mu.Unlock()
+
+	b.onChange(operation, false)
+
+	return false
+}
+
+// record counts a validated response for the operation, opening
+// the breaker when the ratio of violations crosses the threshold.
+func (b *breakers) record(operation string, violation bool) {
+	now := b.now()
+	slotDuration := b.window / breakerSlots
+	if slotDuration <= 0 {
+		slotDuration = 1
+	}
+
+	b.mu.Lock()
+	ob, ok := b.operations[operation]
+	if !ok {
+		ob = &operationBreaker{}
+		b.operations[operation] = ob
+	}
+
+	start := now.Truncate(slotDuration)
+	slot := &ob.slots[(start.UnixNano()/int64(slotDuration))%breakerSlots]
+	if !slot.start.Equal(start) {
+		*slot = breakerSlot{start: start}
+	}
+	slot.total++
+	if violation {
+		slot.violations++
+	}
+
+	if !ob.openUntil.IsZero() {
+		b.mu.Unlock()
+		return
+	}
+
+	total, violations := 0, 0
+	for _, s := range ob.slots {
+		if now.Sub(s.start) >= b.window {
+			continue
+		}
+		total += s.total
+		violations += s.violations
+	}
+
+	opened := total >= b.minRequests && float64(violations)/float64(total) >= b.threshold
+	if opened {
+		ob.openUntil = now.Add(b.cooldown)
+	}
+	b.mu.Unlock()
+
+	if opened {
+		b.onChange(operation, true)
+	}
+}
+
+// breakerChanged records and emits a change of the breaker state for an operation
+func (v *Validator) breakerChanged(operation string, open bool) {
+
+	state, eventName := 0.0, "breaker_closed"
+	if open {
+		state, eventName = 1.0, "breaker_opened"
+		validatorMetrics.breakerTrips.WithLabelValues(v.Filepath, operation).Inc()
+		v.logger.Warn("response validation breaker opened; switching to report-only", zap.String("operation", operation))
+	} else {
+		v.logger.Info("response validation breaker closed; enforcement restored", zap.String("operation", operation))
+	}
+	validatorMetrics.breakerOpen.WithLabelValues(v.Filepath, operation).Set(state)
+
+	if v.events != nil {
+		v.events.Emit(v.ctx, eventName, map[string]any{
+			"operation": operation,
+		})
+	}
+}
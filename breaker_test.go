@@ -0,0 +1,150 @@
+// Copyright 2020 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package openapi
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestBreakerOpensAndCloses(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	b := newBreakers(&Breaker{
+		Threshold:   0.5,
+		MinRequests: 4,
+		Window:      caddy.Duration(time.Minute),
+		Cooldown:    caddy.Duration(5 * time.Minute),
+	})
+	b.now = func() time.Time { return now }
+
+	changes := []bool{}
+	b.onChange = func(operation string, open bool) {
+		changes = append(changes, open)
+	}
+
+	operation := "GET /pets/{petId}"
+
+	// Not enough requests in the window to open the breaker
+	b.record(operation, true)
+	b.record(operation, true)
+	b.record(operation, false)
+	if b.open(operation) {
+		t.Error("breaker should not be open before the minimum number of requests is reached")
+	}
+
+	// Three violations out of four crosses the threshold
+	b.record(operation, true)
+	if !b.open(operation) {
+		t.Error("breaker should be open after crossing the threshold")
+	}
+
+	if b.open("GET /pets") {
+		t.Error("breaker should only be open for the operation with violations")
+	}
+
+	// Still within the cool-down
+	now = now.Add(4 * time.Minute)
+	if !b.open(operation) {
+		t.Error("breaker should be open during the cool-down")
+	}
+
+	// After the cool-down, enforcement is restored
+	now = now.Add(2 * time.Minute)
+	if b.open(operation) {
+		t.Error("breaker should be closed after the cool-down")
+	}
+
+	if len(changes) != 2 || !changes[0] || changes[1] {
+		t.Errorf("unexpected breaker state changes: %v", changes)
+	}
+}
+
+func TestBreakerSlidingWindow(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	b := newBreakers(&Breaker{
+		Threshold:   0.5,
+		MinRequests: 4,
+		Window:      caddy.Duration(time.Minute),
+	})
+	b.now = func() time.Time { return now }
+
+	operation := "GET /pets"
+
+	b.record(operation, true)
+	b.record(operation, true)
+	b.record(operation, true)
+
+	// The violations above have moved out of the window
+	now = now.Add(2 * time.Minute)
+	b.record(operation, true)
+	b.record(operation, false)
+	b.record(operation, false)
+	if b.open(operation) {
+		t.Error("breaker should not take responses outside of the window into account")
+	}
+
+	b.record(operation, true)
+	if !b.open(operation) {
+		t.Error("breaker should be open after crossing the threshold")
+	}
+}
+
+func TestBreakerServeHTTP(t *testing.T) {
+	v, err := createValidator(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v.breakers = newBreakers(&Breaker{MinRequests: 2})
+	v.breakers.onChange = v.breakerChanged
+
+	for i := 0; i < 2; i++ {
+		req, err := prepareRequest("GET", "http://localhost:9443/api/pets/1")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = v.ServeHTTP(httptest.NewRecorder(), req, &mockWrongAPI{})
+		if err == nil {
+			t.Error("expected an error while enforcing response validation")
+		}
+	}
+
+	// The breaker is open now; invalid responses are only reported
+	req, err := prepareRequest("GET", "http://localhost:9443/api/pets/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := httptest.NewRecorder()
+
+	err = v.ServeHTTP(recorder, req, &mockWrongAPI{})
+	if err != nil {
+		t.Error(err)
+	}
+
+	if status := recorder.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusOK)
+	}
+
+	if got := outcomeOf(req, phaseResponse); got != "reported" {
+		t.Errorf("unexpected response outcome: got %s want reported", got)
+	}
+}
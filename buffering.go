@@ -0,0 +1,151 @@
+// Copyright 2020 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package openapi
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/getkin/kin-openapi/openapi3filter"
+)
+
+const (
+	// ReplacerOpenAPIValidatorResponseBuffer is a Caddy Replacer key for storing how a response was buffered
+	ReplacerOpenAPIValidatorResponseBuffer = "openapi_validator.response.buffer"
+)
+
+const (
+	responseOverflowStream = "stream"
+	responseOverflowSpill  = "spill"
+
+	defaultMaxSpillSize = 64 << 20
+
+	// The ways a response can be buffered
+	bufferMemory   = "memory"
+	bufferDisk     = "disk"
+	bufferBypass   = "bypass"
+	bufferOverflow = "overflow"
+	bufferStream   = "stream"
+)
+
+// streamValidator validates a response body that's written to it while it's streamed
+type streamValidator interface {
+	io.Writer
+	// result returns the error for an invalid response body, if any
+	result() *oapiError
+}
+
+// ResponseBuffering configures how responses are buffered for validation
+type ResponseBuffering struct {
+	// Maximum size in bytes of a response that is buffered in memory.
+	// Default is 0, resulting in no limit
+	MaxSize int64 `json:"max_size,omitempty"`
+	// What happens with responses larger than MaxSize: stream or spill. Streamed
+	// responses are passed through without validating the body. Spilled responses
+	// are written to a temporary file and validated from there.
+	// Default is stream
+	Overflow string `json:"overflow,omitempty"`
+	// Directory to spill responses to.
+	// Default is the default directory for temporary files
+	SpillDir string `json:"spill_dir,omitempty"`
+	// Maximum size in bytes of a spilled response of which the body is validated. Validating
+	// a body reads it into memory, so the body of larger spilled responses isn't validated;
+	// only their status and headers are.
+	// Default is 64MiB
+	MaxSpillSize int64 `json:"max_spill_size,omitempty"`
+}
+
+// validate checks the ResponseBuffering configuration
+func (b *ResponseBuffering) validate() error {
+	if b.MaxSize < 0 {
+		return fmt.Errorf("maximum response buffer size can't be negative")
+	}
+	if b.MaxSpillSize < 0 {
+		return fmt.Errorf("maximum spilled response size can't be negative")
+	}
+	switch b.Overflow {
+	case "", responseOverflowStream, responseOverflowSpill:
+	default:
+		return fmt.Errorf("invalid response overflow %q", b.Overflow)
+	}
+	return nil
+}
+
+// newRecorder returns a responseRecorder configured according to the ResponseBuffering
+func (v *Validator) newRecorder(w http.ResponseWriter, shouldBuffer func(status int, header http.Header) bool) *responseRecorder {
+	limit, spill, spillDir := int64(0), false, ""
+	if b := v.ResponseBuffering; b != nil {
+		limit, spill, spillDir = b.MaxSize, b.Overflow == responseOverflowSpill, b.SpillDir
+	}
+	return newResponseRecorder(w, v.bufferPool.Get(), shouldBuffer, limit, spill, spillDir)
+}
+
+// responseTooLarge returns whether the Content-Length of a response
+// exceeds the limit for responses that aren't spilled to disk.
+func (v *Validator) responseTooLarge(header http.Header) bool {
+	b := v.ResponseBuffering
+	if b == nil || b.MaxSize == 0 || b.Overflow == responseOverflowSpill {
+		return false
+	}
+	length, err := strconv.ParseInt(header.Get("Content-Length"), 10, 64)
+	return err == nil && length > b.MaxSize
+}
+
+// spillTooLarge returns whether a spilled response of the size is too large to validate its body
+func (v *Validator) spillTooLarge(size int64) bool {
+	limit := int64(defaultMaxSpillSize)
+	if b := v.ResponseBuffering; b != nil && b.MaxSpillSize != 0 {
+		limit = b.MaxSpillSize
+	}
+	return size > limit
+}
+
+// responseBodyValidated returns whether the body of a response with the status and headers
+// would be validated against a schema. When it's not, the response body doesn't need to
+// be buffered, because validating the status and headers gives the same result.
+func responseBodyValidated(input *openapi3filter.RequestValidationInput, status int, header http.Header) bool {
+
+	if bodyless(input, status) {
+		return false
+	}
+
+	responses := input.Route.Operation.Responses
+	if len(responses) == 0 {
+		return false
+	}
+
+	responseRef := responses.Get(status)
+	if responseRef == nil {
+		responseRef = responses.Default()
+	}
+	if responseRef == nil || responseRef.Value == nil {
+		return false
+	}
+
+	content := responseRef.Value.Content
+	if len(content) == 0 {
+		return false
+	}
+
+	mediaType := content.Get(header.Get("Content-Type"))
+	return mediaType != nil && mediaType.Schema != nil
+}
+
+// observeBuffering records how a response was buffered for validation
+func (v *Validator) observeBuffering(operation string, buffer string) {
+	validatorMetrics.responseBuffering.WithLabelValues(v.Filepath, operation, buffer).Inc()
+}
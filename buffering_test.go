@@ -0,0 +1,220 @@
+// Copyright 2020 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package openapi
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestResponseRecorderOverflow(t *testing.T) {
+	tests := []struct {
+		name        string
+		spill       bool
+		wantWritten string
+	}{
+		{name: "stream", spill: false, wantWritten: "123456789"},
+		{name: "spill", spill: true, wantWritten: ""},
+	}
+
+	for _, tt := range tests {
+		recorder := httptest.NewRecorder()
+		rr := newResponseRecorder(recorder, &bytes.Buffer{}, func(int, http.Header) bool { return true }, 4, tt.spill, t.TempDir())
+
+		rr.WriteHeader(http.StatusCreated)
+		rr.Write([]byte("1234"))
+		if rr.Overflowed() {
+			t.Errorf("unexpected overflow in test %s", tt.name)
+		}
+		rr.Write([]byte("56789"))
+
+		if !rr.Overflowed() || rr.Buffered() != tt.spill || rr.Spilled() != tt.spill || rr.Size() != 9 {
+			t.Errorf("unexpected recorder state in test %s: buffered %t, spilled %t, size %d", tt.name, rr.Buffered(), rr.Spilled(), rr.Size())
+		}
+
+		if got := recorder.Body.String(); got != tt.wantWritten {
+			t.Errorf("unexpected response written in test %s: got %q want %q", tt.name, got, tt.wantWritten)
+		}
+
+		if tt.spill {
+			body, err := rr.Body()
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, _ := io.ReadAll(body)
+			if string(data) != "123456789" {
+				t.Errorf("unexpected spilled body: %q", data)
+			}
+			if err := rr.WriteResponse(); err != nil {
+				t.Error(err)
+			}
+			if recorder.Code != http.StatusCreated || recorder.Body.String() != "123456789" {
+				t.Errorf("unexpected response written from spilled body: %d %q", recorder.Code, recorder.Body.String())
+			}
+			name := rr.file.Name()
+			rr.Close()
+			if _, err := os.Stat(name); !os.IsNotExist(err) {
+				t.Errorf("expected spilled file %s to be removed", name)
+			}
+		}
+	}
+}
+
+func TestResponseBufferingServeHTTP(t *testing.T) {
+	tests := []struct {
+		name         string
+		overflow     string
+		maxSpillSize int64
+		wantStatus   int
+		wantBuffer   string
+		wantOutcome  string
+		wantSample   string
+		wantErr      bool
+	}{
+		{name: "stream", overflow: "stream", wantStatus: http.StatusOK, wantBuffer: "overflow", wantOutcome: "skipped", wantSample: sampleOverflow},
+		{name: "spill", overflow: "spill", wantStatus: http.StatusInternalServerError, wantBuffer: "disk", wantOutcome: "blocked", wantSample: sampleValidated, wantErr: true},
+		{name: "spill too large", overflow: "spill", maxSpillSize: 8, wantStatus: http.StatusOK, wantBuffer: "overflow", wantOutcome: "passed", wantSample: sampleValidated},
+	}
+
+	for _, tt := range tests {
+		v, err := createValidator(t)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		v.ResponseBuffering = &ResponseBuffering{MaxSize: 4, Overflow: tt.overflow, SpillDir: t.TempDir(), MaxSpillSize: tt.maxSpillSize}
+		n, err := replaceValidator(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req, err := prepareRequest("GET", "http://localhost:9443/api/pets/1")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		responses := validatorMetrics.responses.WithLabelValues(n.Filepath, "GET /pets/{petId}", tt.wantSample)
+		before := testutil.ToFloat64(responses)
+
+		recorder := httptest.NewRecorder()
+		err = n.ServeHTTP(recorder, req, &mockWrongAPI{})
+		if (err != nil) != tt.wantErr {
+			t.Errorf("unexpected error in test %s: %v", tt.name, err)
+		}
+
+		if got := testutil.ToFloat64(responses) - before; got != 1 {
+			t.Errorf("unexpected number of %s responses in test %s: got %v want 1", tt.wantSample, tt.name, got)
+		}
+
+		if status := recorder.Code; status != tt.wantStatus {
+			t.Errorf("handler returned wrong status code in test %s: got %v want %v", tt.name, status, tt.wantStatus)
+		}
+
+		replacer := req.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+		if got, _ := replacer.GetString(ReplacerOpenAPIValidatorResponseBuffer); got != tt.wantBuffer {
+			t.Errorf("unexpected response buffer in test %s: got %s want %s", tt.name, got, tt.wantBuffer)
+		}
+
+		if got := outcomeOf(req, phaseResponse); got != tt.wantOutcome {
+			t.Errorf("unexpected response outcome in test %s: got %s want %s", tt.name, got, tt.wantOutcome)
+		}
+	}
+}
+
+func TestResponseBodyValidated(t *testing.T) {
+	v, err := createValidator(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := prepareRequest("GET", "http://localhost:9443/api/pets/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	input, oerr := v.validateRoute(req)
+	if oerr != nil {
+		t.Fatal(oerr)
+	}
+
+	json := http.Header{"Content-Type": []string{"application/json"}}
+	text := http.Header{"Content-Type": []string{"text/plain"}}
+
+	if !responseBodyValidated(input, http.StatusOK, json) {
+		t.Error("expected a JSON response body to be validated")
+	}
+	if responseBodyValidated(input, http.StatusOK, text) {
+		t.Error("expected a plain text response body not to be validated")
+	}
+}
+
+// hijackableRecorder is a ResponseRecorder with a connection that can be hijacked
+type hijackableRecorder struct {
+	*httptest.ResponseRecorder
+	hijacked bool
+}
+
+// Hijack returns one end of an in-memory connection
+func (h *hijackableRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h.hijacked = true
+	conn, _ := net.Pipe()
+	return conn, bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn)), nil
+}
+
+func TestResponseRecorderFlushAndHijack(t *testing.T) {
+
+	recorder := &hijackableRecorder{ResponseRecorder: httptest.NewRecorder()}
+	var w http.ResponseWriter = newResponseRecorder(recorder, &bytes.Buffer{}, func(int, http.Header) bool { return true }, 4, false, "")
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		t.Fatal("expected the recorder to implement http.Flusher")
+	}
+
+	// Nothing is flushed while the response is buffered
+	w.Write([]byte("1234"))
+	flusher.Flush()
+	if recorder.Flushed {
+		t.Error("unexpected flush while the response is buffered")
+	}
+
+	// Once the response overflows, it's streamed and flushed
+	w.Write([]byte("56789"))
+	flusher.Flush()
+	if !recorder.Flushed || recorder.Body.String() != "123456789" {
+		t.Errorf("expected the streamed response to be flushed: flushed %t, body %q", recorder.Flushed, recorder.Body.String())
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		t.Fatal("expected the recorder to implement http.Hijacker")
+	}
+	conn, _, err := hijacker.Hijack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if !recorder.hijacked {
+		t.Error("expected the underlying connection to be hijacked")
+	}
+}
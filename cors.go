@@ -0,0 +1,230 @@
+// Copyright 2020 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package openapi
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/routers"
+)
+
+// CORS configures answering CORS preflight requests based on the operations in the
+// OpenAPI specification. The methods of the operations for a path and the request
+// headers they document are allowed for the configured origins.
+type CORS struct {
+	// Origins that are allowed to make cross-origin requests, like https://example.com.
+	// An origin of "*" allows all origins.
+	// Default is empty, resulting in no origins being allowed
+	AllowedOrigins []string `json:"allowed_origins,omitempty"`
+	// Request headers that are allowed in addition to the headers documented for an operation.
+	// Default is empty
+	AllowedHeaders []string `json:"allowed_headers,omitempty"`
+	// Response headers that are exposed to the client.
+	// Default is empty
+	ExposedHeaders []string `json:"exposed_headers,omitempty"`
+	// Indicates whether credentials, like cookies, are allowed in cross-origin requests.
+	// Default is false
+	AllowCredentials bool `json:"allow_credentials,omitempty"`
+	// Duration that the result of a preflight request can be cached.
+	// Default is 0, resulting in no Access-Control-Max-Age header
+	MaxAge caddy.Duration `json:"max_age,omitempty"`
+}
+
+// validate checks the CORS configuration
+func (c *CORS) validate() error {
+	if len(c.AllowedOrigins) == 0 {
+		return fmt.Errorf("cors requires at least one allowed origin")
+	}
+	for _, origin := range c.AllowedOrigins {
+		if origin == "*" && c.AllowCredentials {
+			return fmt.Errorf("cors can't allow credentials for all origins")
+		}
+	}
+	if c.MaxAge < 0 {
+		return fmt.Errorf("cors max age can't be negative; got %s", time.Duration(c.MaxAge))
+	}
+	return nil
+}
+
+// allowsOrigin returns whether the origin is allowed to make cross-origin requests
+func (c *CORS) allowsOrigin(origin string) bool {
+	for _, allowed := range c.AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// setHeaders sets the CORS headers for a cross-origin request from an allowed origin
+func (c *CORS) setHeaders(w http.ResponseWriter, r *http.Request) {
+
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return
+	}
+
+	w.Header().Add("Vary", "Origin")
+	if !c.allowsOrigin(origin) {
+		return
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", origin)
+	if c.AllowCredentials {
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+	}
+	if len(c.ExposedHeaders) > 0 {
+		w.Header().Set("Access-Control-Expose-Headers", strings.Join(c.ExposedHeaders, ", "))
+	}
+}
+
+// isPreflight returns whether the request is a CORS preflight request
+func isPreflight(r *http.Request) bool {
+	return r.Method == http.MethodOptions && r.Header.Get("Origin") != "" && r.Header.Get("Access-Control-Request-Method") != ""
+}
+
+// answersOptions returns whether the Validator answers OPTIONS requests itself
+func (v *Validator) answersOptions() bool {
+	return v.AnswerOptions || v.CORS != nil
+}
+
+// serveOptions answers an OPTIONS request for a path with the methods of its operations.
+// CORS preflight requests are answered with the CORS headers when the origin, method and
+// request headers are allowed. Otherwise the CORS headers are left out, so that the
+// browser doesn't perform the actual request.
+func (v *Validator) serveOptions(w http.ResponseWriter, r *http.Request, routes map[string]*routers.Route) {
+
+	w.Header().Set("Allow", v.allowHeader(routes))
+
+	if v.CORS != nil && isPreflight(r) {
+		w.Header().Add("Vary", "Origin, Access-Control-Request-Method, Access-Control-Request-Headers")
+		if err := v.preflight(w, r, routes); err != nil {
+			v.logger.Debug(fmt.Sprintf("cors preflight request for %s denied: %s", r.URL.Path, err))
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// preflight sets the CORS headers for a preflight request, if it's allowed
+func (v *Validator) preflight(w http.ResponseWriter, r *http.Request, routes map[string]*routers.Route) error {
+
+	origin := r.Header.Get("Origin")
+	if !v.CORS.allowsOrigin(origin) {
+		return fmt.Errorf("origin %q is not allowed", origin)
+	}
+
+	method := r.Header.Get("Access-Control-Request-Method")
+	route, ok := routes[method]
+	if !ok {
+		return fmt.Errorf("method %s is not allowed", method)
+	}
+
+	allowedHeaders := v.requestHeaders(route)
+	requestedHeaders := []string{}
+	for _, value := range r.Header.Values("Access-Control-Request-Headers") {
+		for _, header := range strings.Split(value, ",") {
+			header = strings.ToLower(strings.TrimSpace(header))
+			if header == "" {
+				continue
+			}
+			if !allowedHeaders[header] {
+				return fmt.Errorf("header %q is not allowed", header)
+			}
+			requestedHeaders = append(requestedHeaders, header)
+		}
+	}
+
+	allowedMethods := []string{}
+	for _, m := range methods {
+		if _, ok := routes[m]; ok {
+			allowedMethods = append(allowedMethods, m)
+		}
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", origin)
+	if v.CORS.AllowCredentials {
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+	}
+	w.Header().Set("Access-Control-Allow-Methods", strings.Join(allowedMethods, ", "))
+	if len(requestedHeaders) > 0 {
+		w.Header().Set("Access-Control-Allow-Headers", strings.Join(requestedHeaders, ", "))
+	}
+	if maxAge := time.Duration(v.CORS.MaxAge); maxAge > 0 {
+		w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(maxAge.Seconds())))
+	}
+
+	return nil
+}
+
+// requestHeaders returns the lowercased names of the request headers that are allowed for the route:
+// the CORS-safelisted headers, the header parameters, Content-Type for operations with a request
+// body, the headers used by the security schemes and the additionally allowed headers.
+func (v *Validator) requestHeaders(route *routers.Route) map[string]bool {
+
+	headers := map[string]bool{
+		"accept":           true,
+		"accept-language":  true,
+		"content-language": true,
+	}
+
+	operation := route.Operation
+	parameters := append(openapi3.Parameters{}, route.PathItem.Parameters...)
+	parameters = append(parameters, operation.Parameters...)
+	for _, parameter := range parameters {
+		if parameter.Value != nil && parameter.Value.In == openapi3.ParameterInHeader {
+			headers[strings.ToLower(parameter.Value.Name)] = true
+		}
+	}
+
+	if operation.RequestBody != nil {
+		headers["content-type"] = true
+	}
+
+	security := v.specification.Security
+	if operation.Security != nil {
+		security = *operation.Security
+	}
+	var schemes openapi3.SecuritySchemes
+	if components := v.specification.Components; components != nil {
+		schemes = components.SecuritySchemes
+	}
+	for _, requirement := range security {
+		for name := range requirement {
+			scheme, ok := schemes[name]
+			if !ok || scheme.Value == nil {
+				continue
+			}
+			switch {
+			case scheme.Value.Type == "apiKey" && scheme.Value.In == "header":
+				headers[strings.ToLower(scheme.Value.Name)] = true
+			case scheme.Value.Type != "apiKey":
+				headers["authorization"] = true
+			}
+		}
+	}
+
+	for _, header := range v.CORS.AllowedHeaders {
+		headers[strings.ToLower(header)] = true
+	}
+
+	return headers
+}
@@ -0,0 +1,229 @@
+// Copyright 2020 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package openapi
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/routers"
+)
+
+func TestCORSValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		cors    CORS
+		wantErr bool
+	}{
+		{name: "ok", cors: CORS{AllowedOrigins: []string{"https://example.com"}, AllowCredentials: true}},
+		{name: "all origins", cors: CORS{AllowedOrigins: []string{"*"}}},
+		{name: "no origins", cors: CORS{}, wantErr: true},
+		{name: "credentials for all origins", cors: CORS{AllowedOrigins: []string{"*"}, AllowCredentials: true}, wantErr: true},
+		{name: "negative max age", cors: CORS{AllowedOrigins: []string{"*"}, MaxAge: -1}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		if err := tt.cors.validate(); (err != nil) != tt.wantErr {
+			t.Errorf("unexpected error in test %s: %v", tt.name, err)
+		}
+	}
+}
+
+func TestMethodNotAllowed(t *testing.T) {
+	v, err := createValidator(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := prepareRequest("DELETE", "http://localhost:9443/api/pets/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := httptest.NewRecorder()
+	if err := v.ServeHTTP(recorder, req, &mockAPI{}); err == nil {
+		t.Error("expected an error for a method that isn't allowed")
+	}
+
+	if status := recorder.Code; status != http.StatusMethodNotAllowed {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusMethodNotAllowed)
+	}
+	if allow := recorder.Header().Get("Allow"); allow != "GET" {
+		t.Errorf("unexpected Allow header: got %q want %q", allow, "GET")
+	}
+}
+
+func TestOptionsServeHTTP(t *testing.T) {
+	tests := []struct {
+		name          string
+		answerOptions bool
+		wantStatus    int
+		wantAllow     string
+	}{
+		{name: "answered", answerOptions: true, wantStatus: http.StatusNoContent, wantAllow: "GET, POST, OPTIONS"},
+		{name: "not answered", answerOptions: false, wantStatus: http.StatusMethodNotAllowed, wantAllow: "GET, POST"},
+	}
+
+	for _, tt := range tests {
+		v, err := createValidator(t)
+		if err != nil {
+			t.Fatal(err)
+		}
+		v.AnswerOptions = tt.answerOptions
+		n, err := replaceValidator(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req, err := prepareRequest("OPTIONS", "http://localhost:9443/api/pets")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		recorder := httptest.NewRecorder()
+		n.ServeHTTP(recorder, req, &mockAPI{})
+
+		if status := recorder.Code; status != tt.wantStatus {
+			t.Errorf("handler returned wrong status code in test %s: got %v want %v", tt.name, status, tt.wantStatus)
+		}
+		if allow := recorder.Header().Get("Allow"); allow != tt.wantAllow {
+			t.Errorf("unexpected Allow header in test %s: got %q want %q", tt.name, allow, tt.wantAllow)
+		}
+	}
+}
+
+func TestPreflightServeHTTP(t *testing.T) {
+	tests := []struct {
+		name        string
+		origin      string
+		method      string
+		headers     string
+		wantAllowed bool
+	}{
+		{name: "allowed", origin: "https://example.com", method: "POST", headers: "Content-Type, X-Request-ID", wantAllowed: true},
+		{name: "other origin", origin: "https://example.org", method: "POST"},
+		{name: "undocumented method", origin: "https://example.com", method: "DELETE"},
+		{name: "undocumented header", origin: "https://example.com", method: "POST", headers: "X-Custom"},
+	}
+
+	for _, tt := range tests {
+		v, err := createValidator(t)
+		if err != nil {
+			t.Fatal(err)
+		}
+		v.CORS = &CORS{
+			AllowedOrigins: []string{"https://example.com"},
+			AllowedHeaders: []string{"X-Request-ID"},
+			MaxAge:         caddy.Duration(10 * time.Minute),
+		}
+		n, err := replaceValidator(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		n.specification.Paths.Find("/pets").Post.RequestBody = &openapi3.RequestBodyRef{
+			Value: openapi3.NewRequestBody().WithJSONSchemaRef(n.specification.Components.Schemas["Pets"]),
+		}
+
+		req, err := prepareRequest("OPTIONS", "http://localhost:9443/api/pets")
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Origin", tt.origin)
+		req.Header.Set("Access-Control-Request-Method", tt.method)
+		if tt.headers != "" {
+			req.Header.Set("Access-Control-Request-Headers", tt.headers)
+		}
+
+		recorder := httptest.NewRecorder()
+		n.ServeHTTP(recorder, req, &mockAPI{})
+
+		if status := recorder.Code; status != http.StatusNoContent {
+			t.Errorf("handler returned wrong status code in test %s: got %v want %v", tt.name, status, http.StatusNoContent)
+		}
+
+		header := recorder.Header()
+		if allowed := header.Get("Access-Control-Allow-Origin") != ""; allowed != tt.wantAllowed {
+			t.Errorf("unexpected preflight result in test %s: got %t want %t", tt.name, allowed, tt.wantAllowed)
+		}
+		if !tt.wantAllowed {
+			continue
+		}
+		if methods := header.Get("Access-Control-Allow-Methods"); methods != "GET, POST" {
+			t.Errorf("unexpected allowed methods in test %s: %q", tt.name, methods)
+		}
+		if headers := header.Get("Access-Control-Allow-Headers"); headers != "content-type, x-request-id" {
+			t.Errorf("unexpected allowed headers in test %s: %q", tt.name, headers)
+		}
+		if maxAge := header.Get("Access-Control-Max-Age"); maxAge != "600" {
+			t.Errorf("unexpected max age in test %s: %q", tt.name, maxAge)
+		}
+	}
+}
+
+func TestCORSServeHTTP(t *testing.T) {
+	v, err := createValidator(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v.CORS = &CORS{AllowedOrigins: []string{"https://example.com"}, ExposedHeaders: []string{"X-Next"}}
+	n, err := replaceValidator(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := prepareRequest("GET", "http://localhost:9443/api/pets/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Origin", "https://example.com")
+
+	recorder := httptest.NewRecorder()
+	if err := n.ServeHTTP(recorder, req, &mockAPI{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if origin := recorder.Header().Get("Access-Control-Allow-Origin"); origin != "https://example.com" {
+		t.Errorf("unexpected allowed origin: %q", origin)
+	}
+	if exposed := recorder.Header().Get("Access-Control-Expose-Headers"); exposed != "X-Next" {
+		t.Errorf("unexpected exposed headers: %q", exposed)
+	}
+	if vary := recorder.Header().Get("Vary"); vary != "Origin" {
+		t.Errorf("unexpected Vary header: %q", vary)
+	}
+}
+
+func TestRequestHeadersWithoutComponents(t *testing.T) {
+	v, err := createValidator(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v.CORS = &CORS{AllowedOrigins: []string{"https://example.com"}}
+
+	v.specification.Components = nil
+	v.specification.Security = openapi3.SecurityRequirements{{"ApiKeyAuth": []string{}}}
+	pathItem := v.specification.Paths.Find("/pets")
+	route := &routers.Route{Spec: v.specification, PathItem: pathItem, Operation: pathItem.Get}
+
+	headers := v.requestHeaders(route)
+	if headers["authorization"] {
+		t.Errorf("unexpected headers for undeclared security schemes: %v", headers)
+	}
+}
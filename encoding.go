@@ -0,0 +1,276 @@
+// Copyright 2020 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package openapi
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+const defaultMaxDecompressedSize = 16 << 20
+
+var (
+	// errUnsupportedEncoding is returned for a content encoding that can't be decoded
+	errUnsupportedEncoding = errors.New("unsupported content encoding")
+	// errDecompressedTooLarge is returned when a decoded body exceeds the maximum size
+	errDecompressedTooLarge = errors.New("decompressed body exceeds the maximum size")
+)
+
+// contentEncodings returns the content encodings applied to a body, in the order they were applied
+func contentEncodings(header http.Header) []string {
+	encodings := []string{}
+	for _, value := range header.Values("Content-Encoding") {
+		for _, encoding := range strings.Split(value, ",") {
+			encoding = strings.ToLower(strings.TrimSpace(encoding))
+			if encoding != "" && encoding != "identity" {
+				encodings = append(encodings, encoding)
+			}
+		}
+	}
+	return encodings
+}
+
+// newDecoder returns a reader that decodes r, undoing the content encodings in reverse order.
+// The decoded body is limited to limit bytes; reading beyond it results in errDecompressedTooLarge.
+// A limit of 0 means the decoded body is not limited.
+func newDecoder(encodings []string, r io.Reader, limit int64) (io.ReadCloser, error) {
+
+	closers := []io.Closer{}
+	for i := len(encodings) - 1; i >= 0; i-- {
+		switch encodings[i] {
+		case "gzip", "x-gzip":
+			gr, err := gzip.NewReader(r)
+			if err != nil {
+				return nil, err
+			}
+			closers = append(closers, gr)
+			r = gr
+		case "deflate":
+			zr, err := zlib.NewReader(r)
+			if err != nil {
+				return nil, err
+			}
+			closers = append(closers, zr)
+			r = zr
+		case "br":
+			r = brotli.NewReader(r)
+		case "zstd":
+			options := []zstd.DOption{zstd.WithDecoderConcurrency(1)}
+			if limit > 0 {
+				options = append(options, zstd.WithDecoderMaxMemory(uint64(limit)))
+			}
+			zr, err := zstd.NewReader(r, options...)
+			if err != nil {
+				return nil, err
+			}
+			closers = append(closers, zr.IOReadCloser())
+			r = zr
+		default:
+			return nil, fmt.Errorf("%w %q", errUnsupportedEncoding, encodings[i])
+		}
+	}
+
+	if limit > 0 {
+		r = &limitedReader{r: r, n: limit}
+	}
+
+	return &decoder{Reader: r, closers: closers}, nil
+}
+
+// decoder reads a decoded body and closes the decoders it uses
+type decoder struct {
+	io.Reader
+	closers []io.Closer
+}
+
+// Close closes the decoders
+func (d *decoder) Close() error {
+	for _, c := range d.closers {
+		c.Close()
+	}
+	return nil
+}
+
+// limitedReader reads from r until n bytes have been read. Unlike an io.LimitedReader,
+// it returns errDecompressedTooLarge when r has more data than that.
+type limitedReader struct {
+	r io.Reader
+	n int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.n <= 0 {
+		var b [1]byte
+		n, err := l.r.Read(b[:])
+		if n > 0 {
+			return 0, errDecompressedTooLarge
+		}
+		return 0, err
+	}
+	if int64(len(p)) > l.n {
+		p = p[:l.n]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	return n, err
+}
+
+// maxDecompressedSize returns the maximum size of a decoded body
+func (v *Validator) maxDecompressedSize() int64 {
+	if v.MaxDecompressedSize == 0 {
+		return defaultMaxDecompressedSize
+	}
+	return v.MaxDecompressedSize
+}
+
+// decodeBody reads the body with the content encodings and returns it decoded
+func (v *Validator) decodeBody(encodings []string, body io.Reader) ([]byte, error) {
+	d, err := newDecoder(encodings, body, v.maxDecompressedSize())
+	if err != nil {
+		return nil, err
+	}
+	defer d.Close()
+	return io.ReadAll(d)
+}
+
+// decodeRequest returns a copy of the request with a decoded body for validating it. The body
+// of the original request is replaced, so that the original bytes are forwarded.
+func (v *Validator) decodeRequest(r *http.Request, encodings []string) (*http.Request, *oapiError) {
+
+	raw, err := io.ReadAll(r.Body)
+	r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(raw))
+	if oerr := requestTooLarge(err); oerr != nil {
+		return nil, oerr
+	}
+	if err != nil {
+		return nil, &oapiError{
+			Code:     http.StatusBadRequest,
+			Message:  fmt.Sprintf("request body has an error: reading failed: %s", err),
+			Internal: err,
+			phase:    phaseRequest,
+		}
+	}
+
+	decoded, err := v.decodeBody(encodings, bytes.NewReader(raw))
+	if err != nil {
+		return nil, decodingError(err)
+	}
+
+	decodedRequest := *r
+	decodedRequest.Header = r.Header.Clone()
+	decodedRequest.Header.Del("Content-Encoding")
+	decodedRequest.Body = io.NopCloser(bytes.NewReader(decoded))
+	decodedRequest.ContentLength = int64(len(decoded))
+	decodedRequest.GetBody = nil
+
+	return &decodedRequest, nil
+}
+
+// decodingError returns the error for a request body that can't be decoded
+func decodingError(err error) *oapiError {
+	switch {
+	case errors.Is(err, errUnsupportedEncoding):
+		return &oapiError{
+			Code:     http.StatusUnsupportedMediaType,
+			Message:  fmt.Sprintf("request body has an error: %s", err),
+			Internal: err,
+			phase:    phaseRequest,
+		}
+	case errors.Is(err, errDecompressedTooLarge):
+		return &oapiError{
+			Code:     http.StatusRequestEntityTooLarge,
+			Message:  fmt.Sprintf("request body has an error: %s", err),
+			Internal: err,
+			phase:    phaseRequest,
+		}
+	default:
+		return &oapiError{
+			Code:     http.StatusBadRequest,
+			Message:  fmt.Sprintf("request body has an error: decoding failed: %s", err),
+			Internal: err,
+			phase:    phaseRequest,
+		}
+	}
+}
+
+// decodingTap returns a streamValidator that decodes the response body before passing it to
+// the streamValidator when the response has a content encoding, or the streamValidator itself.
+func decodingTap(header http.Header, w streamValidator) streamValidator {
+	if encodings := contentEncodings(header); len(encodings) > 0 {
+		return newDecodingWriter(encodings, w)
+	}
+	return w
+}
+
+// decodingWriter decodes a body written to it and writes the decoded body to w.
+// Decoding happens in a separate goroutine; result waits for it to finish.
+type decodingWriter struct {
+	streamValidator
+	pw   *io.PipeWriter
+	done chan struct{}
+	err  error
+}
+
+// newDecodingWriter returns a decodingWriter that writes the decoded body to the streamValidator.
+// The size of the decoded body isn't limited, because streams are validated in parts.
+func newDecodingWriter(encodings []string, w streamValidator) *decodingWriter {
+	pr, pw := io.Pipe()
+	d := &decodingWriter{streamValidator: w, pw: pw, done: make(chan struct{})}
+	go func() {
+		defer close(d.done)
+		decoder, err := newDecoder(encodings, pr, 0)
+		if err == nil {
+			_, err = io.Copy(w, decoder)
+			decoder.Close()
+		}
+		d.err = err
+		// Keep consuming the body, so that writing the response isn't blocked
+		io.Copy(io.Discard, pr)
+	}()
+	return d
+}
+
+// Write passes the encoded body to the decoder
+func (d *decodingWriter) Write(p []byte) (int, error) {
+	return d.pw.Write(p)
+}
+
+// result waits for the body to be decoded and returns the error for an invalid response body, if any
+func (d *decodingWriter) result() *oapiError {
+	d.pw.Close()
+	<-d.done
+	if oerr := d.streamValidator.result(); oerr != nil {
+		return oerr
+	}
+	if d.err != nil {
+		return &oapiError{
+			Code:     http.StatusInternalServerError,
+			Message:  fmt.Sprintf("response body has an error: decoding failed: %s", d.err),
+			Internal: d.err,
+			phase:    phaseResponse,
+		}
+	}
+	return nil
+}
@@ -0,0 +1,235 @@
+// Copyright 2020 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package openapi
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/klauspost/compress/zstd"
+)
+
+// encode encodes data with the content encodings, in order
+func encode(t *testing.T, data []byte, encodings ...string) []byte {
+	for _, encoding := range encodings {
+		buffer := &bytes.Buffer{}
+		var w io.WriteCloser
+		switch encoding {
+		case "gzip":
+			w = gzip.NewWriter(buffer)
+		case "br":
+			w = brotli.NewWriter(buffer)
+		case "zstd":
+			zw, err := zstd.NewWriter(buffer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w = zw
+		}
+		w.Write(data)
+		w.Close()
+		data = buffer.Bytes()
+	}
+	return data
+}
+
+func TestNewDecoder(t *testing.T) {
+	data := []byte(strings.Repeat(`{"id": 1, "name": "Pet 1"}`, 100))
+
+	tests := []struct {
+		name      string
+		encodings []string
+		limit     int64
+		wantErr   error
+	}{
+		{name: "gzip", encodings: []string{"gzip"}},
+		{name: "br", encodings: []string{"br"}},
+		{name: "zstd", encodings: []string{"zstd"}},
+		{name: "stacked", encodings: []string{"gzip", "br"}},
+		{name: "too large", encodings: []string{"gzip"}, limit: 100, wantErr: errDecompressedTooLarge},
+		{name: "unsupported", encodings: []string{"compress"}, wantErr: errUnsupportedEncoding},
+	}
+
+	for _, tt := range tests {
+		encoded := data
+		if tt.wantErr != errUnsupportedEncoding {
+			encoded = encode(t, data, tt.encodings...)
+		}
+		limit := tt.limit
+		if limit == 0 {
+			limit = int64(len(data))
+		}
+
+		var decoded []byte
+		d, err := newDecoder(tt.encodings, bytes.NewReader(encoded), limit)
+		if err == nil {
+			decoded, err = io.ReadAll(d)
+			d.Close()
+		}
+
+		if tt.wantErr != nil {
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("unexpected error in test %s: got %v want %v", tt.name, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("unexpected error in test %s: %v", tt.name, err)
+		}
+		if !bytes.Equal(decoded, data) {
+			t.Errorf("unexpected decoded data in test %s", tt.name)
+		}
+	}
+}
+
+func TestContentEncodings(t *testing.T) {
+	header := http.Header{"Content-Encoding": []string{"gzip, identity", "BR"}}
+	if got := strings.Join(contentEncodings(header), ","); got != "gzip,br" {
+		t.Errorf("unexpected encodings: got %s want gzip,br", got)
+	}
+}
+
+func TestCompressedRequestServeHTTP(t *testing.T) {
+	body := []byte(`[{"id": 1, "name": "Pet 1"}]`)
+
+	tests := []struct {
+		name       string
+		body       []byte
+		encoding   string
+		maxSize    int64
+		wantStatus int
+	}{
+		{name: "gzip", body: body, encoding: "gzip", wantStatus: http.StatusCreated},
+		{name: "zstd", body: body, encoding: "zstd", wantStatus: http.StatusCreated},
+		{name: "invalid", body: []byte(`[{"id": 1}]`), encoding: "br", wantStatus: http.StatusBadRequest},
+		{name: "too large", body: body, encoding: "gzip", maxSize: 8, wantStatus: http.StatusRequestEntityTooLarge},
+	}
+
+	for _, tt := range tests {
+		v, err := createValidator(t)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		v.Enforcement = &Enforcement{Response: EnforceModeOff}
+		v.MaxDecompressedSize = tt.maxSize
+		n, err := replaceValidator(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		n.specification.Paths.Find("/pets").Post.RequestBody = &openapi3.RequestBodyRef{
+			Value: openapi3.NewRequestBody().WithJSONSchemaRef(n.specification.Components.Schemas["Pets"]),
+		}
+
+		req, err := prepareRequest("POST", "http://localhost:9443/api/pets")
+		if err != nil {
+			t.Fatal(err)
+		}
+		encoded := encode(t, tt.body, tt.encoding)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Content-Encoding", tt.encoding)
+		req.Body = io.NopCloser(bytes.NewReader(encoded))
+		req.ContentLength = int64(len(encoded))
+
+		recorder := httptest.NewRecorder()
+		api := &bodyAPI{}
+		n.ServeHTTP(recorder, req, api)
+
+		if status := recorder.Code; status != tt.wantStatus {
+			t.Errorf("handler returned wrong status code in test %s: got %v want %v", tt.name, status, tt.wantStatus)
+		}
+
+		if tt.wantStatus == http.StatusCreated && api.body != string(encoded) {
+			t.Errorf("expected the original compressed body to be forwarded in test %s", tt.name)
+		}
+	}
+}
+
+// compressedAPI returns a gzip compressed pet
+type compressedAPI struct {
+	body []byte
+}
+
+// ServeHTTP writes the compressed body
+func (m *compressedAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) error {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Encoding", "gzip")
+	w.WriteHeader(http.StatusOK)
+	w.Write(m.body)
+	return nil
+}
+
+func TestCompressedResponseServeHTTP(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+	}{
+		{name: "valid", body: `{"id": 1, "name": "Pet 1"}`, wantStatus: http.StatusOK},
+		{name: "invalid", body: `{"id": 1}`, wantStatus: http.StatusInternalServerError},
+	}
+
+	for _, tt := range tests {
+		v, err := createValidator(t)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req, err := prepareRequest("GET", "http://localhost:9443/api/pets/1")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		encoded := encode(t, []byte(tt.body), "gzip")
+		recorder := httptest.NewRecorder()
+		v.ServeHTTP(recorder, req, &compressedAPI{body: encoded})
+
+		if status := recorder.Code; status != tt.wantStatus {
+			t.Errorf("handler returned wrong status code in test %s: got %v want %v", tt.name, status, tt.wantStatus)
+		}
+
+		if tt.wantStatus == http.StatusOK && !bytes.Equal(recorder.Body.Bytes(), encoded) {
+			t.Errorf("expected the original compressed body to be returned in test %s", tt.name)
+		}
+	}
+}
+
+func TestCompressedLineResponse(t *testing.T) {
+	reported := 0
+	lines := newLineValidator(openapi3.NewObjectSchema().WithProperty("id", openapi3.NewIntegerSchema()), openapi3.VisitAsResponse(), 10, func(error) {
+		reported++
+	})
+
+	header := http.Header{"Content-Encoding": []string{"gzip"}}
+	tap := decodingTap(header, lines)
+
+	encoded := encode(t, []byte("{\"id\": 1}\n{\"id\": \"two\"}\n"), "gzip")
+	for _, b := range encoded {
+		tap.Write([]byte{b})
+	}
+
+	if oerr := tap.result(); oerr == nil || reported != 1 {
+		t.Errorf("expected the second line to be reported: %v (%d reported)", oerr, reported)
+	}
+}
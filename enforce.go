@@ -0,0 +1,161 @@
+// Copyright 2020 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package openapi
+
+import (
+	"fmt"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// EnforceMode determines what happens when validation in a specific phase fails
+type EnforceMode string
+
+const (
+	// EnforceModeBlock filters invalid requests and responses and returns an (appropriate) status
+	EnforceModeBlock EnforceMode = "block"
+	// EnforceModeReport logs and records validation failures, but lets requests and responses through
+	EnforceModeReport EnforceMode = "report"
+	// EnforceModeOff disables validation
+	EnforceModeOff EnforceMode = "off"
+)
+
+// Enforcement configures the EnforceMode for each of the validation phases.
+// Phases without an explicit mode fall back to the mode derived from the
+// Enforce and Validate* properties of the Validator.
+type Enforcement struct {
+	// Mode for validating that a route (path and method) exists
+	Route EnforceMode `json:"route,omitempty"`
+	// Mode for validating the server (scheme, host and base path)
+	Server EnforceMode `json:"server,omitempty"`
+	// Mode for validating security requirements
+	Security EnforceMode `json:"security,omitempty"`
+	// Mode for validating request parameters and bodies
+	Request EnforceMode `json:"request,omitempty"`
+	// Mode for validating responses
+	Response EnforceMode `json:"response,omitempty"`
+}
+
+// validationPhase is one of the distinct phases in validating a request and its response
+type validationPhase string
+
+const (
+	phaseRoute    validationPhase = "route"
+	phaseServer   validationPhase = "server"
+	phaseSecurity validationPhase = "security"
+	phaseRequest  validationPhase = "request"
+	phaseResponse validationPhase = "response"
+)
+
+// phases lists all validation phases in the order they're executed
+var phases = []validationPhase{phaseRoute, phaseServer, phaseSecurity, phaseRequest, phaseResponse}
+
+// outcome is the result of a validation phase for a single request
+type outcome string
+
+const (
+	outcomeSkipped  outcome = "skipped"
+	outcomePassed   outcome = "passed"
+	outcomeReported outcome = "reported"
+	outcomeBlocked  outcome = "blocked"
+	outcomeDeferred outcome = "deferred"
+)
+
+// enforcementModes holds the resolved EnforceMode per validation phase
+type enforcementModes map[validationPhase]EnforceMode
+
+// validates returns whether validation should be performed in the phase
+func (m enforcementModes) validates(phase validationPhase) bool {
+	return m[phase] != EnforceModeOff
+}
+
+// blocks returns whether a validation failure in the phase should block
+func (m enforcementModes) blocks(phase validationPhase) bool {
+	return m[phase] == EnforceModeBlock
+}
+
+// with returns a copy of the modes with the mode for phase replaced
+func (m enforcementModes) with(phase validationPhase, mode EnforceMode) enforcementModes {
+	modes := enforcementModes{}
+	for p, md := range m {
+		modes[p] = md
+	}
+	modes[phase] = mode
+	return modes
+}
+
+// replacerOutcomeKey returns the Caddy Replacer key for storing the outcome of a phase
+func replacerOutcomeKey(phase validationPhase) string {
+	return fmt.Sprintf("openapi_validator.%s.outcome", phase)
+}
+
+// resolveEnforcementModes determines the EnforceMode for every phase based on the
+// configuration of the Validator. An error is returned when an unknown mode is configured.
+func (v *Validator) resolveEnforcementModes() (enforcementModes, error) {
+
+	defaultMode := EnforceModeBlock
+	if v.Enforce != nil && !*v.Enforce {
+		defaultMode = EnforceModeReport
+	}
+
+	modeFor := func(enabled *bool) EnforceMode {
+		if enabled != nil && !*enabled {
+			return EnforceModeOff
+		}
+		return defaultMode
+	}
+
+	modes := enforcementModes{
+		phaseRoute:    modeFor(v.ValidateRoutes),
+		phaseServer:   modeFor(v.ValidateServers),
+		phaseSecurity: modeFor(v.ValidateSecurity),
+		phaseRequest:  modeFor(v.ValidateRequests),
+		phaseResponse: modeFor(v.ValidateResponses),
+	}
+
+	if e := v.Enforcement; e != nil {
+		overrides := map[validationPhase]EnforceMode{
+			phaseRoute:    e.Route,
+			phaseServer:   e.Server,
+			phaseSecurity: e.Security,
+			phaseRequest:  e.Request,
+			phaseResponse: e.Response,
+		}
+		for phase, mode := range overrides {
+			switch mode {
+			case "":
+				continue
+			case EnforceModeBlock, EnforceModeReport, EnforceModeOff:
+				modes[phase] = mode
+			default:
+				return nil, fmt.Errorf("invalid enforce mode %q for %s validation", mode, phase)
+			}
+		}
+	}
+
+	return modes, nil
+}
+
+// resetOutcomes initializes the outcome placeholders for all phases
+func resetOutcomes(replacer *caddy.Replacer) {
+	for _, phase := range phases {
+		replacer.Set(replacerOutcomeKey(phase), string(outcomeSkipped))
+	}
+}
+
+// setOutcome records the outcome of a phase in its placeholder
+func setOutcome(replacer *caddy.Replacer, phase validationPhase, o outcome) {
+	replacer.Set(replacerOutcomeKey(phase), string(o))
+}
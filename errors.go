@@ -14,12 +14,23 @@
 
 package openapi
 
-import "fmt"
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/getkin/kin-openapi/routers"
+)
 
 type oapiError struct {
 	Code     int         `json:"-"`
 	Message  interface{} `json:"message"`
 	Internal error       `json:"-"`
+
+	phase validationPhase
+	// header holds headers to add to the response when the error blocks the request
+	header http.Header
+	// allowed holds the routes for the other methods of the path when the method isn't allowed
+	allowed map[string]*routers.Route
 }
 
 func (oe *oapiError) Error() string {
@@ -0,0 +1,64 @@
+// Copyright 2020 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package openapi
+
+import (
+	"mime"
+	"net/http"
+
+	"github.com/getkin/kin-openapi/openapi3filter"
+)
+
+// isHeadAsGet returns whether the request is a HEAD request that is validated against a GET operation
+func isHeadAsGet(input *openapi3filter.RequestValidationInput) bool {
+	return input.Request.Method == http.MethodHead && input.Route.Method == http.MethodGet
+}
+
+// asGet returns a copy of the input for validating the response to a HEAD request against
+// the GET operation. The response validation skips HEAD requests completely otherwise.
+func asGet(input *openapi3filter.RequestValidationInput) *openapi3filter.RequestValidationInput {
+	get := *input
+	get.Request = input.Request.Clone(input.Request.Context())
+	get.Request.Method = http.MethodGet
+	return &get
+}
+
+// documentedStatus returns the status that a response is validated against. A response
+// with partial content is validated against the 200 response when the range request
+// was answered without a 206 response being documented for the operation.
+func documentedStatus(input *openapi3filter.RequestValidationInput, status int) int {
+	if status != http.StatusPartialContent || input.Request.Header.Get("Range") == "" {
+		return status
+	}
+	responses := input.Route.Operation.Responses
+	if responses.Get(http.StatusPartialContent) == nil && responses.Get(http.StatusOK) != nil {
+		return http.StatusOK
+	}
+	return status
+}
+
+// isByteRanges returns whether the content type is the multipart/byteranges media type
+// that's used for partial content with multiple ranges
+func isByteRanges(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && mediaType == "multipart/byteranges"
+}
+
+// bodyless returns whether the response has no body that can be validated: responses
+// to HEAD requests, 304 Not Modified responses without a body and partial content,
+// which is only a part of the representation.
+func bodyless(input *openapi3filter.RequestValidationInput, status int) bool {
+	return input.Request.Method == http.MethodHead || status == http.StatusNotModified || status == http.StatusPartialContent
+}
@@ -0,0 +1,143 @@
+// Copyright 2020 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package openapi
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// statusAPI returns a response with a fixed status, Content-Type and body
+type statusAPI struct {
+	status      int
+	contentType string
+	body        string
+}
+
+// ServeHTTP writes the response
+func (m *statusAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) error {
+	if m.contentType != "" {
+		w.Header().Set("Content-Type", m.contentType)
+	}
+	w.WriteHeader(m.status)
+	if r.Method != http.MethodHead {
+		w.Write([]byte(m.body))
+	}
+	return nil
+}
+
+func TestHeadServeHTTP(t *testing.T) {
+	tests := []struct {
+		name        string
+		headAsGet   bool
+		contentType string
+		wantStatus  int
+		wantAllow   string
+	}{
+		{name: "head operation required", headAsGet: false, contentType: "application/json", wantStatus: http.StatusMethodNotAllowed, wantAllow: "GET"},
+		{name: "head as get", headAsGet: true, contentType: "application/json", wantStatus: http.StatusOK},
+		{name: "undocumented content type", headAsGet: true, contentType: "text/plain", wantStatus: http.StatusInternalServerError},
+	}
+
+	for _, tt := range tests {
+		v, err := createValidator(t)
+		if err != nil {
+			t.Fatal(err)
+		}
+		v.HeadAsGet = tt.headAsGet
+		n, err := replaceValidator(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req, err := prepareRequest("HEAD", "http://localhost:9443/api/pets/1")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		recorder := httptest.NewRecorder()
+		n.ServeHTTP(recorder, req, &statusAPI{status: http.StatusOK, contentType: tt.contentType})
+
+		if status := recorder.Code; status != tt.wantStatus {
+			t.Errorf("handler returned wrong status code in test %s: got %v want %v", tt.name, status, tt.wantStatus)
+		}
+		if allow := recorder.Header().Get("Allow"); allow != tt.wantAllow {
+			t.Errorf("unexpected Allow header in test %s: got %q want %q", tt.name, allow, tt.wantAllow)
+		}
+	}
+}
+
+func TestHeadAllowed(t *testing.T) {
+	v, err := createValidator(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v.HeadAsGet = true
+	n, err := replaceValidator(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := prepareRequest("DELETE", "http://localhost:9443/api/pets/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := httptest.NewRecorder()
+	n.ServeHTTP(recorder, req, &mockAPI{})
+
+	if allow := recorder.Header().Get("Allow"); allow != "GET, HEAD" {
+		t.Errorf("unexpected Allow header: got %q want %q", allow, "GET, HEAD")
+	}
+}
+
+func TestConditionalAndPartialServeHTTP(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		value  string
+		api    statusAPI
+	}{
+		{name: "not modified", header: "If-None-Match", value: `"abc"`, api: statusAPI{status: http.StatusNotModified}},
+		{name: "partial content", header: "Range", value: "bytes=0-5", api: statusAPI{status: http.StatusPartialContent, contentType: "application/json", body: `{"id":`}},
+		{name: "byte ranges", header: "Range", value: "bytes=0-5,10-15", api: statusAPI{status: http.StatusPartialContent, contentType: "multipart/byteranges; boundary=abc", body: "--abc"}},
+	}
+
+	for _, tt := range tests {
+		v, err := createValidator(t)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req, err := prepareRequest("GET", "http://localhost:9443/api/pets/1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(tt.header, tt.value)
+
+		recorder := httptest.NewRecorder()
+		if err := v.ServeHTTP(recorder, req, &tt.api); err != nil {
+			t.Errorf("unexpected error in test %s: %v", tt.name, err)
+		}
+
+		if status := recorder.Code; status != tt.api.status {
+			t.Errorf("handler returned wrong status code in test %s: got %v want %v", tt.name, status, tt.api.status)
+		}
+		if body := recorder.Body.String(); body != tt.api.body {
+			t.Errorf("unexpected body in test %s: got %q want %q", tt.name, body, tt.api.body)
+		}
+	}
+}
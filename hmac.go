@@ -0,0 +1,415 @@
+// Copyright 2020 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package openapi
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/getkin/kin-openapi/openapi3"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule(HMACSecurity{})
+}
+
+const (
+	// extensionHMAC is the OpenAPI extension on a security scheme that declares
+	// the header with the signature and the headers that are signed
+	extensionHMAC = "x-hmac"
+
+	defaultHMACHeader      = "Signature"
+	defaultHMACClockSkew   = 5 * time.Minute
+	defaultHMACMaxBodySize = 10 << 20
+	defaultHMACMaxNonces   = 100000
+)
+
+// HMACSecurity validates requests that are signed with a shared secret. The signature header has
+// the form keyId="...", timestamp="...", nonce="...", signature="...", with the Unix timestamp of
+// the request, a unique nonce and the base64 encoded HMAC-SHA256 of these lines:
+//
+//	the method
+//	the path and query, as sent by the client
+//	name:value for each signed header, with the name in lowercase
+//	the hex encoded SHA-256 digest of the body
+//	the timestamp
+//	the nonce
+type HMACSecurity struct {
+	// Path to a JSON or YAML file with the shared secrets by key ID.
+	KeyFile string `json:"key_file,omitempty"`
+	// Name of the header with the signature. The x-hmac extension of the security scheme
+	// can declare the header too.
+	// Default is the name of an apiKey scheme in a header, or Signature
+	Header string `json:"header,omitempty"`
+	// Headers that are signed, in addition to those declared by the x-hmac extension.
+	// Default is empty
+	SignedHeaders []string `json:"signed_headers,omitempty"`
+	// Maximum difference between the timestamp of a request and the current time.
+	// Nonces are remembered for this window to reject replayed requests.
+	// Default is 5m
+	ClockSkew caddy.Duration `json:"clock_skew,omitempty"`
+	// The maximum size in bytes of request bodies that are signed. The request body
+	// size limit of the operation applies when it's smaller.
+	// Default is 10MiB
+	MaxBodySize int64 `json:"max_body_size,omitempty"`
+	// The maximum number of nonces that are remembered for a key. Requests signed with
+	// the key are rejected when it has been used for more requests within the clock skew.
+	// Default is 100000
+	MaxNonces int `json:"max_nonces,omitempty"`
+
+	secrets   map[string][]byte
+	clockSkew time.Duration
+	nonces    *nonceCache
+	now       func() time.Time
+	logger    *zap.Logger
+}
+
+// CaddyModule returns the Caddy module information.
+func (HMACSecurity) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.openapi_validator.security.hmac",
+		New: func() caddy.Module { return new(HMACSecurity) },
+	}
+}
+
+// Provision sets up the HMACSecurity module.
+func (h *HMACSecurity) Provision(ctx caddy.Context) error {
+
+	if err := h.validate(); err != nil {
+		return err
+	}
+
+	secrets, err := loadHMACSecrets(h.KeyFile)
+	if err != nil {
+		return err
+	}
+
+	h.secrets = secrets
+	h.clockSkew = defaultHMACClockSkew
+	if h.ClockSkew != 0 {
+		h.clockSkew = time.Duration(h.ClockSkew)
+	}
+	if h.MaxBodySize == 0 {
+		h.MaxBodySize = defaultHMACMaxBodySize
+	}
+	if h.MaxNonces == 0 {
+		h.MaxNonces = defaultHMACMaxNonces
+	}
+	h.nonces = newNonceCache(h.MaxNonces)
+	h.now = time.Now
+	h.logger = ctx.Logger()
+
+	return nil
+}
+
+// validate checks the HMACSecurity configuration
+func (h *HMACSecurity) validate() error {
+	if h.KeyFile == "" {
+		return fmt.Errorf("hmac requires a key_file")
+	}
+	if h.ClockSkew < 0 {
+		return fmt.Errorf("hmac clock skew can't be negative; got %s", time.Duration(h.ClockSkew))
+	}
+	if h.MaxBodySize < 0 {
+		return fmt.Errorf("hmac max body size can't be negative; got %d", h.MaxBodySize)
+	}
+	if h.MaxNonces < 0 {
+		return fmt.Errorf("hmac max nonces can't be negative; got %d", h.MaxNonces)
+	}
+	return nil
+}
+
+// loadHMACSecrets loads the shared secrets by key ID from a JSON or YAML file
+func loadHMACSecrets(path string) (map[string][]byte, error) {
+
+	keys := map[string]string{}
+	if err := loadKeyFile(path, &keys); err != nil {
+		return nil, fmt.Errorf("loading hmac key file: %w", err)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("hmac key file %s has no keys", path)
+	}
+
+	secrets := make(map[string][]byte, len(keys))
+	for id, secret := range keys {
+		if secret == "" {
+			return nil, fmt.Errorf("hmac key file %s has an empty secret for key %q", path, id)
+		}
+		secrets[id] = []byte(secret)
+	}
+
+	return secrets, nil
+}
+
+// hmacExtension is the value of the x-hmac extension on a security scheme
+type hmacExtension struct {
+	Header        string   `json:"header"`
+	SignedHeaders []string `json:"signedHeaders"`
+}
+
+// hmacSignature is a parsed signature header
+type hmacSignature struct {
+	keyID     string
+	timestamp int64
+	nonce     string
+	signature []byte
+}
+
+// ValidateSecurityScheme verifies the signature of the request and rejects replayed requests.
+func (h *HMACSecurity) ValidateSecurityScheme(input *SecurityInput) (*Identity, error) {
+
+	r := input.Request
+
+	extension, err := hmacExtensionOf(input.Scheme)
+	if err != nil {
+		return nil, err
+	}
+
+	header := h.signatureHeader(input.Scheme, extension)
+	value := r.Header.Get(header)
+	if value == "" {
+		return nil, &credentialsError{err: fmt.Errorf("no signature provided in header %s", header)}
+	}
+	signature, err := parseHMACSignature(value)
+	if err != nil {
+		return nil, &credentialsError{err: err}
+	}
+
+	secret, ok := h.secrets[signature.keyID]
+	if !ok {
+		return nil, &credentialsError{err: fmt.Errorf("unknown key %q", signature.keyID)}
+	}
+
+	now := h.now()
+	timestamp := time.Unix(signature.timestamp, 0)
+	if timestamp.Before(now.Add(-h.clockSkew)) || timestamp.After(now.Add(h.clockSkew)) {
+		return nil, &credentialsError{err: fmt.Errorf("signature timestamp %s is outside the allowed clock skew of %s", timestamp.UTC().Format(time.RFC3339), h.clockSkew)}
+	}
+
+	body, err := readSignedBody(r, h.maxBodySize(input.MaxBodySize))
+	if err != nil {
+		return nil, err
+	}
+
+	signedHeaders := append(append([]string{}, h.SignedHeaders...), extension.SignedHeaders...)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(stringToSign(r, signedHeaders, body, signature)))
+	if !hmac.Equal(mac.Sum(nil), signature.signature) {
+		return nil, &credentialsError{err: errors.New("signature doesn't match")}
+	}
+
+	// Nonces are only remembered for valid signatures, so that they can't be used up by others
+	err = h.nonces.add(signature.keyID, signature.nonce, timestamp.Add(h.clockSkew), now)
+	if errors.Is(err, errNonceCacheFull) {
+		h.logger.Warn(fmt.Sprintf("rejecting request signed with key %q: %s", signature.keyID, err))
+		return nil, fmt.Errorf("key %q: %w", signature.keyID, err)
+	}
+	if err != nil {
+		return nil, &credentialsError{err: err}
+	}
+
+	return &Identity{ID: signature.keyID}, nil
+}
+
+// hmacExtensionOf returns the x-hmac extension of the security scheme
+func hmacExtensionOf(scheme *openapi3.SecurityScheme) (*hmacExtension, error) {
+	extension := &hmacExtension{}
+	value, ok := scheme.Extensions[extensionHMAC]
+	if !ok {
+		return extension, nil
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, extension); err != nil {
+		return nil, fmt.Errorf("invalid %s extension: %w", extensionHMAC, err)
+	}
+	return extension, nil
+}
+
+// signatureHeader returns the name of the header with the signature
+func (h *HMACSecurity) signatureHeader(scheme *openapi3.SecurityScheme, extension *hmacExtension) string {
+	switch {
+	case h.Header != "":
+		return h.Header
+	case extension.Header != "":
+		return extension.Header
+	case scheme.Type == "apiKey" && scheme.In == "header":
+		return scheme.Name
+	default:
+		return defaultHMACHeader
+	}
+}
+
+// parseHMACSignature parses a signature header
+func parseHMACSignature(value string) (*hmacSignature, error) {
+
+	params := map[string]string{}
+	for _, param := range strings.Split(value, ",") {
+		name, v, ok := strings.Cut(strings.TrimSpace(param), "=")
+		if !ok {
+			return nil, fmt.Errorf("malformed signature parameter %q", param)
+		}
+		params[strings.TrimSpace(name)] = strings.Trim(strings.TrimSpace(v), `"`)
+	}
+
+	signature := &hmacSignature{keyID: params["keyId"], nonce: params["nonce"]}
+	if signature.keyID == "" || signature.nonce == "" {
+		return nil, errors.New("signature should have a keyId and a nonce")
+	}
+	timestamp, err := strconv.ParseInt(params["timestamp"], 10, 64)
+	if err != nil {
+		return nil, errors.New("signature should have a Unix timestamp")
+	}
+	signature.timestamp = timestamp
+	signature.signature, err = base64.StdEncoding.DecodeString(params["signature"])
+	if err != nil || len(signature.signature) == 0 {
+		return nil, errors.New("signature should be base64 encoded")
+	}
+
+	return signature, nil
+}
+
+// maxBodySize returns the maximum size of signed bodies, given the limit of the operation
+func (h *HMACSecurity) maxBodySize(limit int64) int64 {
+	if limit > 0 && limit < h.MaxBodySize {
+		return limit
+	}
+	return h.MaxBodySize
+}
+
+// readSignedBody reads the body of the request, up to the limit, and replaces it, so that
+// it can be read again. A body that is too large is replaced with what was read of it
+// followed by the rest of the body.
+func readSignedBody(r *http.Request, limit int64) ([]byte, error) {
+
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, nil
+	}
+
+	original := r.Body
+	body, err := io.ReadAll(io.LimitReader(original, limit+1))
+	if err != nil {
+		return nil, fmt.Errorf("reading body: %w", err)
+	}
+	if int64(len(body)) > limit {
+		r.Body = readCloser{Reader: io.MultiReader(bytes.NewReader(body), original), Closer: original}
+		return nil, fmt.Errorf("body is larger than %d bytes and can't be verified", limit)
+	}
+	original.Close()
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	return body, nil
+}
+
+// readCloser combines a reader with the closer of the body it reads
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// stringToSign returns the string that the signature of the request is computed over
+func stringToSign(r *http.Request, signedHeaders []string, body []byte, signature *hmacSignature) string {
+
+	digest := sha256.Sum256(body)
+
+	// The URL may have been changed, like by trimming a path prefix, so the target of the request is signed
+	target := r.RequestURI
+	if target == "" {
+		target = r.URL.RequestURI()
+	}
+
+	lines := []string{r.Method, target}
+	for _, name := range signedHeaders {
+		value := strings.Join(r.Header.Values(name), ",")
+		if strings.EqualFold(name, "host") {
+			value = r.Host
+		}
+		lines = append(lines, strings.ToLower(name)+":"+value)
+	}
+	lines = append(lines, hex.EncodeToString(digest[:]), strconv.FormatInt(signature.timestamp, 10), signature.nonce)
+
+	return strings.Join(lines, "\n")
+}
+
+// errNonceCacheFull is returned when no more nonces can be remembered for a key
+var errNonceCacheFull = errors.New("nonce cache is full")
+
+// nonceCache remembers the nonces for each key until they expire
+type nonceCache struct {
+	size int
+
+	mu     sync.Mutex
+	nonces map[string]map[string]time.Time
+}
+
+// newNonceCache returns a nonceCache for at most size nonces per key
+func newNonceCache(size int) *nonceCache {
+	return &nonceCache{size: size, nonces: map[string]map[string]time.Time{}}
+}
+
+// add remembers the nonce for the key until it expires. An error is returned when the nonce
+// was used before, or when there's no room for it; nonces are never forgotten before they
+// expire, so that a key can't be used for more requests than fit in the cache.
+func (c *nonceCache) add(key, nonce string, expires time.Time, now time.Time) error {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	nonces, ok := c.nonces[key]
+	if !ok {
+		nonces = map[string]time.Time{}
+		c.nonces[key] = nonces
+	}
+
+	if e, ok := nonces[nonce]; ok && now.Before(e) {
+		return fmt.Errorf("nonce %q was used before", nonce)
+	}
+
+	if len(nonces) >= c.size {
+		for n, e := range nonces {
+			if !now.Before(e) {
+				delete(nonces, n)
+			}
+		}
+		if len(nonces) >= c.size {
+			return errNonceCacheFull
+		}
+	}
+
+	nonces[nonce] = expires
+
+	return nil
+}
+
+var (
+	_ SecuritySchemeValidator = (*HMACSecurity)(nil)
+	_ caddy.Provisioner       = (*HMACSecurity)(nil)
+)
@@ -0,0 +1,280 @@
+// Copyright 2020 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package openapi
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/getkin/kin-openapi/openapi3"
+)
+
+// signRequest signs the request with the secret like a partner would
+func signRequest(t *testing.T, r *http.Request, keyID, secret string, timestamp time.Time, nonce string, signedHeaders []string) {
+	t.Helper()
+
+	var body []byte
+	if r.Body != nil {
+		var err error
+		body, err = io.ReadAll(r.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	signature := &hmacSignature{keyID: keyID, timestamp: timestamp.Unix(), nonce: nonce}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(stringToSign(r, signedHeaders, body, signature)))
+
+	r.Header.Set("X-Signature", fmt.Sprintf(`keyId="%s", timestamp="%d", nonce="%s", signature="%s"`,
+		keyID, timestamp.Unix(), nonce, base64.StdEncoding.EncodeToString(mac.Sum(nil))))
+}
+
+func TestHMACSecurityServeHTTP(t *testing.T) {
+
+	keyFile := filepath.Join(t.TempDir(), "keys.yaml")
+	if err := os.WriteFile(keyFile, []byte("partner: partner-secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := withSecurityValidators(t, map[string]string{
+		"Signature": `{"validator": "hmac", "key_file": "` + keyFile + `", "clock_skew": "1m"}`,
+	}, openapi3.SecuritySchemes{
+		"Signature": &openapi3.SecuritySchemeRef{Value: &openapi3.SecurityScheme{
+			Type: "apiKey", In: "header", Name: "X-Signature",
+			Extensions: map[string]interface{}{extensionHMAC: map[string]interface{}{"signedHeaders": []string{"Content-Type"}}},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.specification.Security = openapi3.SecurityRequirements{{"Signature": []string{}}}
+
+	now := time.Date(2020, 10, 1, 12, 0, 0, 0, time.UTC)
+	n.securityValidators["Signature"].(*HMACSecurity).now = func() time.Time { return now }
+
+	body := `[{"id": 1, "name": "Pet 1"}]`
+	tests := []struct {
+		name       string
+		keyID      string
+		secret     string
+		timestamp  time.Time
+		nonce      string
+		unsigned   bool
+		tamper     func(r *http.Request)
+		wantStatus int
+		wantUser   string
+	}{
+		{name: "valid", keyID: "partner", secret: "partner-secret", timestamp: now, nonce: "n1", wantStatus: http.StatusCreated, wantUser: "partner"},
+		{name: "replayed nonce", keyID: "partner", secret: "partner-secret", timestamp: now, nonce: "n1", wantStatus: http.StatusUnauthorized},
+		{name: "within clock skew", keyID: "partner", secret: "partner-secret", timestamp: now.Add(-50 * time.Second), nonce: "n2", wantStatus: http.StatusCreated, wantUser: "partner"},
+		{name: "stale timestamp", keyID: "partner", secret: "partner-secret", timestamp: now.Add(-2 * time.Minute), nonce: "n3", wantStatus: http.StatusUnauthorized},
+		{name: "unknown key", keyID: "other", secret: "partner-secret", timestamp: now, nonce: "n4", wantStatus: http.StatusUnauthorized},
+		{name: "wrong secret", keyID: "partner", secret: "wrong", timestamp: now, nonce: "n5", wantStatus: http.StatusUnauthorized},
+		{name: "missing signature", unsigned: true, wantStatus: http.StatusUnauthorized},
+		{name: "tampered body", keyID: "partner", secret: "partner-secret", timestamp: now, nonce: "n6", tamper: func(r *http.Request) {
+			r.Body = io.NopCloser(strings.NewReader(`[{"id": 2, "name": "Pet 2"}]`))
+		}, wantStatus: http.StatusUnauthorized},
+		{name: "tampered signed header", keyID: "partner", secret: "partner-secret", timestamp: now, nonce: "n7", tamper: func(r *http.Request) {
+			r.Header.Set("Content-Type", "text/plain")
+		}, wantStatus: http.StatusUnauthorized},
+		{name: "tampered path", keyID: "partner", secret: "partner-secret", timestamp: now, nonce: "n8", tamper: func(r *http.Request) {
+			r.URL.RawQuery = "limit=1"
+		}, wantStatus: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		req, err := prepareRequest("POST", "http://localhost:9443/api/pets")
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Body = io.NopCloser(strings.NewReader(body))
+		if !tt.unsigned {
+			signRequest(t, req, tt.keyID, tt.secret, tt.timestamp, tt.nonce, []string{"Content-Type"})
+		}
+		if tt.tamper != nil {
+			tt.tamper(req)
+		}
+
+		recorder := httptest.NewRecorder()
+		api := &bodyAPI{}
+		n.ServeHTTP(recorder, req, api)
+
+		if status := recorder.Code; status != tt.wantStatus {
+			t.Errorf("handler returned wrong status code in test %s: got %v want %v", tt.name, status, tt.wantStatus)
+		}
+		if tt.wantStatus == http.StatusCreated && api.body != body {
+			t.Errorf("expected the signed body to be forwarded in test %s: got %q", tt.name, api.body)
+		}
+
+		replacer := req.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+		if user, _ := replacer.GetString(ReplacerHTTPAuthUserID); user != tt.wantUser {
+			t.Errorf("unexpected user placeholder in test %s: got %q want %q", tt.name, user, tt.wantUser)
+		}
+	}
+}
+
+func TestHMACSecurityValidate(t *testing.T) {
+
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "keys.json")
+	if err := os.WriteFile(keyFile, []byte(`{"partner": "partner-secret"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	emptyFile := filepath.Join(dir, "empty.json")
+	if err := os.WriteFile(emptyFile, []byte(`{"partner": ""}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	schemes := openapi3.SecuritySchemes{
+		"Signature": &openapi3.SecuritySchemeRef{Value: &openapi3.SecurityScheme{Type: "apiKey", In: "header", Name: "X-Signature"}},
+	}
+	tests := []struct {
+		name    string
+		config  string
+		wantErr bool
+	}{
+		{name: "valid", config: `{"validator": "hmac", "key_file": "` + keyFile + `"}`},
+		{name: "no key file", config: `{"validator": "hmac"}`, wantErr: true},
+		{name: "missing key file", config: `{"validator": "hmac", "key_file": "` + filepath.Join(dir, "missing.json") + `"}`, wantErr: true},
+		{name: "empty secret", config: `{"validator": "hmac", "key_file": "` + emptyFile + `"}`, wantErr: true},
+		{name: "negative clock skew", config: `{"validator": "hmac", "key_file": "` + keyFile + `", "clock_skew": "-1m"}`, wantErr: true},
+		{name: "negative max nonces", config: `{"validator": "hmac", "key_file": "` + keyFile + `", "max_nonces": -1}`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		_, err := withSecurityValidators(t, map[string]string{"Signature": tt.config}, schemes)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("unexpected error in test %s: %v", tt.name, err)
+		}
+	}
+}
+
+func TestHMACSecurityServeHTTPWithPrefix(t *testing.T) {
+
+	keyFile := filepath.Join(t.TempDir(), "keys.yaml")
+	if err := os.WriteFile(keyFile, []byte("partner: partner-secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := withSecurityValidators(t, map[string]string{
+		"Signature": `{"validator": "hmac", "key_file": "` + keyFile + `"}`,
+	}, openapi3.SecuritySchemes{
+		"Signature": &openapi3.SecuritySchemeRef{Value: &openapi3.SecurityScheme{Type: "apiKey", In: "header", Name: "X-Signature"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.specification.Security = openapi3.SecurityRequirements{{"Signature": []string{}}}
+	n.PathPrefixToBeTrimmed = "/prefix"
+
+	// The client signs the path that it sent, before the prefix is trimmed
+	req, err := prepareRequest("GET", "http://localhost:9443/prefix/api/pets?limit=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.RequestURI = "/prefix/api/pets?limit=1"
+	signRequest(t, req, "partner", "partner-secret", time.Now(), "n1", nil)
+
+	recorder := httptest.NewRecorder()
+	n.ServeHTTP(recorder, req, &mockAPI{})
+
+	if got := outcomeOf(req, phaseSecurity); got != "passed" {
+		t.Errorf("unexpected security outcome: got %s want passed", got)
+	}
+}
+
+func TestReadSignedBody(t *testing.T) {
+	body := `[{"id": 1, "name": "Pet 1"}]`
+
+	tests := []struct {
+		name    string
+		limit   int64
+		wantErr bool
+	}{
+		{name: "within limit", limit: int64(len(body))},
+		{name: "too large", limit: 8, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest("POST", "/api/pets", strings.NewReader(body))
+		signed, err := readSignedBody(req, tt.limit)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("unexpected error in test %s: %v", tt.name, err)
+		}
+		if !tt.wantErr && string(signed) != body {
+			t.Errorf("unexpected signed body in test %s: got %q", tt.name, signed)
+		}
+
+		// The body can be read completely afterwards, also when it's too large
+		data, err := io.ReadAll(req.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != body {
+			t.Errorf("unexpected body after reading it in test %s: got %q want %q", tt.name, data, body)
+		}
+	}
+
+	h := &HMACSecurity{MaxBodySize: 1024}
+	if got := h.maxBodySize(0); got != 1024 {
+		t.Errorf("unexpected max body size without a limit for the operation: got %d want 1024", got)
+	}
+	if got := h.maxBodySize(128); got != 128 {
+		t.Errorf("unexpected max body size with a smaller limit for the operation: got %d want 128", got)
+	}
+	if got := h.maxBodySize(4096); got != 1024 {
+		t.Errorf("unexpected max body size with a larger limit for the operation: got %d want 1024", got)
+	}
+}
+
+func TestNonceCache(t *testing.T) {
+	now := time.Date(2020, 10, 1, 12, 0, 0, 0, time.UTC)
+	c := newNonceCache(1)
+
+	if err := c.add("partner", "a", now.Add(time.Minute), now); err != nil {
+		t.Errorf("expected a new nonce to be added: %v", err)
+	}
+	if err := c.add("partner", "a", now.Add(time.Minute), now); err == nil || errors.Is(err, errNonceCacheFull) {
+		t.Errorf("expected a used nonce to be rejected: %v", err)
+	}
+	if err := c.add("partner", "b", now.Add(time.Minute), now); !errors.Is(err, errNonceCacheFull) {
+		t.Errorf("expected a nonce to be rejected when the cache for the key is full: %v", err)
+	}
+
+	// The nonces of one key don't use up the room for other keys
+	if err := c.add("other", "a", now.Add(time.Minute), now); err != nil {
+		t.Errorf("expected a nonce for another key to be added: %v", err)
+	}
+
+	if err := c.add("partner", "b", now.Add(2*time.Minute), now.Add(time.Minute)); err != nil {
+		t.Errorf("expected a nonce to be added after the others expired: %v", err)
+	}
+}
@@ -0,0 +1,249 @@
+// Copyright 2020 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package openapi
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// ReplacerOpenAPIValidatorIntrospection is the prefix of the Caddy Replacer keys for the introspection
+// response of an active token, e.g. {openapi_validator.introspection.username}
+const ReplacerOpenAPIValidatorIntrospection = "openapi_validator.introspection"
+
+const (
+	defaultIntrospectionCacheTTL         = time.Minute
+	defaultIntrospectionNegativeCacheTTL = 10 * time.Second
+	maxIntrospectionCacheEntries         = 10000
+	introspectionCacheEvictions          = maxIntrospectionCacheEntries / 10
+	maxIntrospectionResponseSize         = 1 << 20
+	introspectionTimeout                 = 10 * time.Second
+)
+
+// Introspection configures OAuth 2.0 token introspection (RFC 7662) for the bearer tokens of
+// a security scheme. It's used for opaque tokens that can't be verified by the validator.
+type Introspection struct {
+	// URL of the introspection endpoint of the authorization server.
+	Endpoint string `json:"endpoint,omitempty"`
+	// Client ID that the validator authenticates with at the introspection endpoint.
+	// Default is empty, resulting in no client authentication
+	ClientID string `json:"client_id,omitempty"`
+	// Client secret that the validator authenticates with at the introspection endpoint.
+	// Default is empty
+	ClientSecret string `json:"client_secret,omitempty"`
+	// Duration that the result for an active token is cached. Results are
+	// never cached beyond the expiry of the token.
+	// Default is 1m
+	CacheTTL caddy.Duration `json:"cache_ttl,omitempty"`
+	// Duration that the result for an inactive token is cached.
+	// Default is 10s
+	NegativeCacheTTL caddy.Duration `json:"negative_cache_ttl,omitempty"`
+}
+
+// validate checks the Introspection configuration
+func (i *Introspection) validate() error {
+	if i.Endpoint == "" {
+		return fmt.Errorf("introspection requires an endpoint")
+	}
+	if u, err := url.Parse(i.Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return fmt.Errorf("introspection endpoint should be an http or https URL; got %q", i.Endpoint)
+	}
+	if i.ClientSecret != "" && i.ClientID == "" {
+		return fmt.Errorf("introspection requires a client ID with the client secret")
+	}
+	if i.CacheTTL < 0 || i.NegativeCacheTTL < 0 {
+		return fmt.Errorf("introspection cache TTLs can't be negative")
+	}
+	return nil
+}
+
+// introspectionResult is a cached introspection response
+type introspectionResult struct {
+	response map[string]interface{}
+	active   bool
+	expires  time.Time
+}
+
+// introspector verifies tokens using an introspection endpoint and caches the results
+type introspector struct {
+	config           *Introspection
+	clientID         string
+	clientSecret     string
+	client           *http.Client
+	cacheTTL         time.Duration
+	negativeCacheTTL time.Duration
+	now              func() time.Time
+
+	mu    sync.Mutex
+	cache map[[sha256.Size]byte]*introspectionResult
+}
+
+// newIntrospector returns an introspector for the configuration. Placeholders in the client
+// credentials, like {env.INTROSPECTION_SECRET}, are replaced.
+func newIntrospector(config *Introspection) *introspector {
+	repl := caddy.NewReplacer()
+	cacheTTL := defaultIntrospectionCacheTTL
+	if config.CacheTTL != 0 {
+		cacheTTL = time.Duration(config.CacheTTL)
+	}
+	negativeCacheTTL := defaultIntrospectionNegativeCacheTTL
+	if config.NegativeCacheTTL != 0 {
+		negativeCacheTTL = time.Duration(config.NegativeCacheTTL)
+	}
+	return &introspector{
+		config:           config,
+		clientID:         repl.ReplaceAll(config.ClientID, ""),
+		clientSecret:     repl.ReplaceAll(config.ClientSecret, ""),
+		client:           http.DefaultClient,
+		cacheTTL:         cacheTTL,
+		negativeCacheTTL: negativeCacheTTL,
+		now:              time.Now,
+		cache:            map[[sha256.Size]byte]*introspectionResult{},
+	}
+}
+
+// verify returns the introspection response for an active token. Tokens are cached by their hash,
+// so that the tokens themselves are not kept in memory.
+func (i *introspector) verify(ctx context.Context, token string) (map[string]interface{}, error) {
+
+	key := sha256.Sum256([]byte(token))
+	now := i.now()
+
+	i.mu.Lock()
+	result, ok := i.cache[key]
+	i.mu.Unlock()
+
+	if !ok || !now.Before(result.expires) {
+		response, err := i.introspect(ctx, token)
+		if err != nil {
+			return nil, err
+		}
+		result = i.store(key, response, now)
+	}
+
+	if !result.active {
+		return nil, &tokenError{err: errors.New("token is not active")}
+	}
+
+	return result.response, nil
+}
+
+// store caches the introspection response
+func (i *introspector) store(key [sha256.Size]byte, response map[string]interface{}, now time.Time) *introspectionResult {
+
+	active, _ := response["active"].(bool)
+	result := &introspectionResult{response: response, active: active, expires: now.Add(i.negativeCacheTTL)}
+	if active {
+		result.expires = now.Add(i.cacheTTL)
+		if exp, ok := response["exp"].(float64); ok {
+			if expiry := time.Unix(int64(exp), 0); expiry.Before(result.expires) {
+				result.expires = expiry
+			}
+		}
+		if !now.Before(result.expires) {
+			// The token has expired, although the authorization server didn't say so
+			result.active = false
+			result.expires = now.Add(i.negativeCacheTTL)
+		}
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if len(i.cache) >= maxIntrospectionCacheEntries {
+		i.evict(now)
+	}
+	i.cache[key] = result
+
+	return result
+}
+
+// evict removes the expired results from the cache. When that doesn't free up
+// enough space, the results that expire first are removed too.
+func (i *introspector) evict(now time.Time) {
+
+	for k, r := range i.cache {
+		if !now.Before(r.expires) {
+			delete(i.cache, k)
+		}
+	}
+
+	excess := len(i.cache) - (maxIntrospectionCacheEntries - introspectionCacheEvictions)
+	if excess <= 0 {
+		return
+	}
+
+	keys := make([][sha256.Size]byte, 0, len(i.cache))
+	for k := range i.cache {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(a, b int) bool {
+		return i.cache[keys[a]].expires.Before(i.cache[keys[b]].expires)
+	})
+	for _, k := range keys[:excess] {
+		delete(i.cache, k)
+	}
+}
+
+// introspect calls the introspection endpoint for the token
+func (i *introspector) introspect(ctx context.Context, token string) (map[string]interface{}, error) {
+
+	ctx, cancel := context.WithTimeout(ctx, introspectionTimeout)
+	defer cancel()
+
+	form := url.Values{"token": {token}, "token_type_hint": {"access_token"}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, i.config.Endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if i.clientID != "" {
+		// Client credentials are form-encoded before they're used for basic authentication, as described in RFC 6749
+		req.SetBasicAuth(url.QueryEscape(i.clientID), url.QueryEscape(i.clientSecret))
+	}
+
+	resp, err := i.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("introspecting token: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("introspecting token: unexpected status %d", resp.StatusCode)
+	}
+
+	response := map[string]interface{}{}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxIntrospectionResponseSize)).Decode(&response); err != nil {
+		return nil, fmt.Errorf("introspecting token: parsing response: %w", err)
+	}
+	if _, ok := response["active"].(bool); !ok {
+		return nil, errors.New("introspecting token: response has no active property")
+	}
+
+	return response, nil
+}
@@ -0,0 +1,211 @@
+// Copyright 2020 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package openapi
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/getkin/kin-openapi/openapi3"
+)
+
+// introspectionEndpointStub is a stand-in introspection endpoint with a fixed set of tokens
+type introspectionEndpointStub struct {
+	*httptest.Server
+	calls int32
+}
+
+// newIntrospectionEndpointStub starts a new introspectionEndpointStub
+func newIntrospectionEndpointStub(t *testing.T) *introspectionEndpointStub {
+	stub := &introspectionEndpointStub{}
+	stub.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&stub.calls, 1)
+		if id, secret, ok := r.BasicAuth(); !ok || id != "validator" || secret != "s3cr3t" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var response map[string]interface{}
+		switch r.PostFormValue("token") {
+		case "active-token":
+			response = map[string]interface{}{"active": true, "scope": "pets:read", "username": "alice", "exp": time.Now().Add(time.Hour).Unix()}
+		case "limited-token":
+			response = map[string]interface{}{"active": true, "scope": "pets:write", "username": "bob"}
+		case "broken-token":
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		default:
+			response = map[string]interface{}{"active": false}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	}))
+	t.Cleanup(stub.Close)
+	return stub
+}
+
+func TestIntrospectionValidate(t *testing.T) {
+	tests := []struct {
+		name          string
+		introspection Introspection
+		wantErr       bool
+	}{
+		{name: "ok", introspection: Introspection{Endpoint: "https://auth.example.com/introspect", ClientID: "validator", ClientSecret: "s3cr3t"}},
+		{name: "no endpoint", introspection: Introspection{}, wantErr: true},
+		{name: "invalid endpoint", introspection: Introspection{Endpoint: "auth.example.com"}, wantErr: true},
+		{name: "secret without client ID", introspection: Introspection{Endpoint: "https://auth.example.com/introspect", ClientSecret: "s3cr3t"}, wantErr: true},
+		{name: "negative TTL", introspection: Introspection{Endpoint: "https://auth.example.com/introspect", NegativeCacheTTL: -1}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		if err := tt.introspection.validate(); (err != nil) != tt.wantErr {
+			t.Errorf("unexpected error in test %s: %v", tt.name, err)
+		}
+	}
+}
+
+func TestIntrospectionServeHTTP(t *testing.T) {
+
+	endpoint := newIntrospectionEndpointStub(t)
+
+	tests := []struct {
+		name         string
+		token        string
+		wantStatus   int
+		wantUsername string
+	}{
+		{name: "active", token: "active-token", wantStatus: http.StatusOK, wantUsername: "alice"},
+		{name: "insufficient scope", token: "limited-token", wantStatus: http.StatusForbidden},
+		{name: "inactive", token: "inactive-token", wantStatus: http.StatusUnauthorized},
+		{name: "endpoint failure", token: "broken-token", wantStatus: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		v, err := createValidator(t)
+		if err != nil {
+			t.Fatal(err)
+		}
+		v.Introspection = map[string]*Introspection{
+			"OAuth2": {Endpoint: endpoint.URL, ClientID: "validator", ClientSecret: "s3cr3t"},
+		}
+		n, err := replaceValidator(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n.specification.Components.SecuritySchemes = openapi3.SecuritySchemes{
+			"OAuth2": &openapi3.SecuritySchemeRef{Value: &openapi3.SecurityScheme{Type: "oauth2"}},
+		}
+		n.specification.Security = openapi3.SecurityRequirements{{"OAuth2": []string{"pets:read"}}}
+
+		req, err := prepareRequest("GET", "http://localhost:9443/api/pets/1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+tt.token)
+
+		recorder := httptest.NewRecorder()
+		n.ServeHTTP(recorder, req, &mockAPI{})
+
+		if status := recorder.Code; status != tt.wantStatus {
+			t.Errorf("handler returned wrong status code in test %s: got %v want %v", tt.name, status, tt.wantStatus)
+		}
+
+		replacer := req.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+		if username, _ := replacer.GetString(ReplacerOpenAPIValidatorIntrospection + ".username"); username != tt.wantUsername {
+			t.Errorf("unexpected username placeholder in test %s: got %q want %q", tt.name, username, tt.wantUsername)
+		}
+	}
+}
+
+func TestIntrospectionCache(t *testing.T) {
+
+	endpoint := newIntrospectionEndpointStub(t)
+	introspector := newIntrospector(&Introspection{Endpoint: endpoint.URL, ClientID: "validator", ClientSecret: "s3cr3t"})
+
+	now := time.Now()
+	introspector.now = func() time.Time { return now }
+
+	verify := func(token string, wantActive bool, wantCalls int32) {
+		t.Helper()
+		_, err := introspector.verify(context.Background(), token)
+		if active := err == nil; active != wantActive {
+			t.Errorf("unexpected result for %s: got active %t want %t (%v)", token, active, wantActive, err)
+		}
+		if calls := atomic.LoadInt32(&endpoint.calls); calls != wantCalls {
+			t.Errorf("unexpected number of introspection calls for %s: got %d want %d", token, calls, wantCalls)
+		}
+	}
+
+	// Positive and negative results are cached
+	verify("active-token", true, 1)
+	verify("active-token", true, 1)
+	verify("inactive-token", false, 2)
+	verify("inactive-token", false, 2)
+
+	// The negative result expires before the positive result
+	now = now.Add(defaultIntrospectionNegativeCacheTTL)
+	verify("inactive-token", false, 3)
+	verify("active-token", true, 3)
+
+	now = now.Add(defaultIntrospectionCacheTTL)
+	verify("active-token", true, 4)
+
+	// Failures are not cached
+	verify("broken-token", false, 5)
+	verify("broken-token", false, 6)
+}
+
+func TestIntrospectionClientSecretPlaceholder(t *testing.T) {
+
+	t.Setenv("INTROSPECTION_SECRET", "s3cr3t")
+	endpoint := newIntrospectionEndpointStub(t)
+	introspector := newIntrospector(&Introspection{Endpoint: endpoint.URL, ClientID: "validator", ClientSecret: "{env.INTROSPECTION_SECRET}"})
+
+	if _, err := introspector.verify(context.Background(), "active-token"); err != nil {
+		t.Errorf("expected the client secret placeholder to be replaced: %v", err)
+	}
+}
+
+func TestIntrospectionCacheEviction(t *testing.T) {
+
+	introspector := newIntrospector(&Introspection{Endpoint: "https://auth.example.com/introspect"})
+	now := time.Now()
+
+	// The cache is filled with results that are still valid; the oldest expire first
+	for n := 0; n < maxIntrospectionCacheEntries; n++ {
+		introspector.store(sha256.Sum256([]byte(strconv.Itoa(n))), map[string]interface{}{"active": true}, now.Add(time.Duration(n)*time.Millisecond))
+	}
+	introspector.store(sha256.Sum256([]byte("new-token")), map[string]interface{}{"active": true}, now)
+
+	if got, want := len(introspector.cache), maxIntrospectionCacheEntries-introspectionCacheEvictions+1; got != want {
+		t.Errorf("unexpected number of cached results: got %d want %d", got, want)
+	}
+	if _, ok := introspector.cache[sha256.Sum256([]byte("0"))]; ok {
+		t.Error("expected the oldest result to be evicted")
+	}
+	if _, ok := introspector.cache[sha256.Sum256([]byte(strconv.Itoa(maxIntrospectionCacheEntries-1)))]; !ok {
+		t.Error("expected the newest result to be kept")
+	}
+	if _, ok := introspector.cache[sha256.Sum256([]byte("new-token"))]; !ok {
+		t.Error("expected the new result to be cached")
+	}
+}
@@ -0,0 +1,207 @@
+// Copyright 2020 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package openapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"gopkg.in/square/go-jose.v2"
+)
+
+const (
+	defaultJWKSCacheDuration = 10 * time.Minute
+	// jwksMinRefreshInterval limits how often tokens signed with unknown keys trigger a refresh
+	jwksMinRefreshInterval = 30 * time.Second
+	maxJWKSSize            = 1 << 20
+	jwksFetchTimeout       = 10 * time.Second
+)
+
+// errUnknownKey is returned when a key set doesn't have the key that a token refers to
+var errUnknownKey = errors.New("no key found")
+
+// jwks is a cached JSON Web Key Set. The key set is loaded again when the cache duration
+// has passed, and earlier when a token refers to a key that is not in the key set, so that
+// rotated keys are picked up. When loading the key set fails, the cached key set is used.
+// The key set is loaded by one request at a time, without holding the lock, so that
+// other requests can use the cached key set in the meantime.
+type jwks struct {
+	load          func(ctx context.Context) (*jose.JSONWebKeySet, error)
+	cacheDuration time.Duration
+	logger        *zap.Logger
+	now           func() time.Time
+
+	mu       sync.Mutex
+	set      *jose.JSONWebKeySet
+	loadedAt time.Time
+	err      error
+	// loading is closed when the key set that is being loaded is done; nil when it's not being loaded
+	loading chan struct{}
+}
+
+// newJWKS returns a new jwks that loads the key set with load
+func newJWKS(load func(ctx context.Context) (*jose.JSONWebKeySet, error), cacheDuration time.Duration, logger *zap.Logger) *jwks {
+	if cacheDuration == 0 {
+		cacheDuration = defaultJWKSCacheDuration
+	}
+	return &jwks{
+		load:          load,
+		cacheDuration: cacheDuration,
+		logger:        logger,
+		now:           time.Now,
+	}
+}
+
+// keys returns the keys with the key ID, or all keys when the key ID is empty
+func (j *jwks) keys(ctx context.Context, kid string) ([]jose.JSONWebKey, error) {
+
+	now := j.now()
+
+	j.mu.Lock()
+	set, loadedAt := j.set, j.loadedAt
+	j.mu.Unlock()
+
+	var err error
+	if set == nil || now.Sub(loadedAt) >= j.cacheDuration {
+		// An expired key set is used while another request loads it again
+		if set, loadedAt, err = j.refresh(ctx, now, set == nil); err != nil {
+			return nil, err
+		}
+	}
+
+	keys := findKeys(set, kid)
+	if len(keys) == 0 && now.Sub(loadedAt) >= jwksMinRefreshInterval {
+		// The key may have been rotated; the key set is refreshed to look for it
+		if set, _, err = j.refresh(ctx, now, true); err != nil {
+			return nil, err
+		}
+		keys = findKeys(set, kid)
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%w for key ID %q", errUnknownKey, kid)
+	}
+
+	return keys, nil
+}
+
+// refresh loads the key set and returns it with the time it was loaded. When the key set is being loaded already, the
+// cached key set is returned, or, when wait is true, the key set that is being loaded.
+// A failure is only an error when there's no key set to fall back to. The context is only used for waiting; the
+// key set is shared by all requests, so loading it isn't canceled with the request that triggered it.
+func (j *jwks) refresh(ctx context.Context, now time.Time, wait bool) (*jose.JSONWebKeySet, time.Time, error) {
+
+	j.mu.Lock()
+	if loading := j.loading; loading != nil {
+		if !wait && j.set != nil {
+			defer j.mu.Unlock()
+			return j.set, j.loadedAt, nil
+		}
+		j.mu.Unlock()
+		select {
+		case <-loading:
+		case <-ctx.Done():
+			return nil, time.Time{}, fmt.Errorf("loading JWKS: %w", ctx.Err())
+		}
+		j.mu.Lock()
+		defer j.mu.Unlock()
+		if j.set == nil {
+			return nil, time.Time{}, fmt.Errorf("loading JWKS: %w", j.err)
+		}
+		return j.set, j.loadedAt, nil
+	}
+	loading := make(chan struct{})
+	j.loading = loading
+	j.mu.Unlock()
+
+	set, err := j.load(context.Background())
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.loading = nil
+	close(loading)
+
+	j.err = err
+	if err != nil {
+		if j.set == nil {
+			return nil, time.Time{}, fmt.Errorf("loading JWKS: %w", err)
+		}
+		j.logger.Warn(fmt.Sprintf("loading JWKS failed; using the cached key set: %s", err))
+		j.loadedAt = now
+		return j.set, now, nil
+	}
+	j.set = set
+	j.loadedAt = now
+	return set, now, nil
+}
+
+// findKeys returns the keys with the key ID from the key set
+func findKeys(set *jose.JSONWebKeySet, kid string) []jose.JSONWebKey {
+	if kid == "" {
+		return set.Keys
+	}
+	return set.Key(kid)
+}
+
+// loadJWKSFile returns a function that loads a key set from a file
+func loadJWKSFile(path string) func(ctx context.Context) (*jose.JSONWebKeySet, error) {
+	return func(ctx context.Context) (*jose.JSONWebKeySet, error) {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return parseJWKS(f)
+	}
+}
+
+// loadJWKSURL returns a function that fetches a key set from a URL
+func loadJWKSURL(client *http.Client, url string) func(ctx context.Context) (*jose.JSONWebKeySet, error) {
+	return func(ctx context.Context) (*jose.JSONWebKeySet, error) {
+		ctx, cancel := context.WithTimeout(ctx, jwksFetchTimeout)
+		defer cancel()
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Accept", "application/json")
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("fetching %s: unexpected status %d", url, resp.StatusCode)
+		}
+		return parseJWKS(resp.Body)
+	}
+}
+
+// parseJWKS parses a JSON Web Key Set
+func parseJWKS(r io.Reader) (*jose.JSONWebKeySet, error) {
+	set := &jose.JSONWebKeySet{}
+	if err := json.NewDecoder(io.LimitReader(r, maxJWKSSize)).Decode(set); err != nil {
+		return nil, fmt.Errorf("parsing JWKS: %w", err)
+	}
+	return set, nil
+}
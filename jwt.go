@@ -0,0 +1,295 @@
+// Copyright 2020 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package openapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/getkin/kin-openapi/openapi3"
+	"go.uber.org/zap"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// ReplacerOpenAPIValidatorJWTClaims is the prefix of the Caddy Replacer keys for the claims of a verified JWT,
+// e.g. {openapi_validator.jwt.claims.sub}
+const ReplacerOpenAPIValidatorJWTClaims = "openapi_validator.jwt.claims"
+
+// defaultJWTAlgorithms are the signature algorithms accepted by default; symmetric
+// algorithms have to be enabled explicitly.
+var defaultJWTAlgorithms = []string{
+	string(jose.RS256), string(jose.RS384), string(jose.RS512),
+	string(jose.PS256), string(jose.PS384), string(jose.PS512),
+	string(jose.ES256), string(jose.ES384), string(jose.ES512),
+	string(jose.EdDSA),
+}
+
+// jwtAlgorithms are all signature algorithms that can be accepted
+var jwtAlgorithms = append([]string{string(jose.HS256), string(jose.HS384), string(jose.HS512)}, defaultJWTAlgorithms...)
+
+// JWT configures verification of JSON Web Tokens for http security schemes with the bearer
+// scheme. Tokens are verified for schemes with a bearerFormat of JWT or without a bearerFormat.
+type JWT struct {
+	// Path to a file with the JSON Web Key Set (JWKS) that tokens are verified with.
+	// Default is empty
+	JWKSFile string `json:"jwks_file,omitempty"`
+	// URL of the JSON Web Key Set (JWKS) that tokens are verified with.
+	// Default is empty
+	JWKSURL string `json:"jwks_url,omitempty"`
+	// Duration that the key set is cached. The key set is loaded earlier when a
+	// token is signed with a key that's not in the key set.
+	// Default is 10m
+	CacheDuration caddy.Duration `json:"cache_duration,omitempty"`
+	// The issuer that the iss claim of tokens should match.
+	// Default is empty, resulting in the issuer not being checked
+	Issuer string `json:"issuer,omitempty"`
+	// The audiences that tokens are accepted for; the aud claim should contain one of them.
+	// Default is empty, resulting in the audience not being checked
+	Audiences []string `json:"audiences,omitempty"`
+	// Leeway for checking the exp, nbf and iat claims, to account for clock skew.
+	// Default is 1m
+	Leeway caddy.Duration `json:"leeway,omitempty"`
+	// The signature algorithms that are accepted.
+	// Default is all RSA, RSA-PSS, ECDSA and EdDSA algorithms
+	Algorithms []string `json:"algorithms,omitempty"`
+	// Claims that tokens should have, with their values. A claim with a
+	// list of values should contain the value.
+	// Default is empty
+	RequiredClaims map[string]interface{} `json:"required_claims,omitempty"`
+}
+
+// validate checks the JWT configuration
+func (j *JWT) validate() error {
+	if (j.JWKSFile == "") == (j.JWKSURL == "") {
+		return fmt.Errorf("jwt requires either a jwks_file or a jwks_url")
+	}
+	if j.CacheDuration < 0 {
+		return fmt.Errorf("jwt cache duration can't be negative; got %s", time.Duration(j.CacheDuration))
+	}
+	if j.Leeway < 0 {
+		return fmt.Errorf("jwt leeway can't be negative; got %s", time.Duration(j.Leeway))
+	}
+	for _, algorithm := range j.Algorithms {
+		if !contains(jwtAlgorithms, algorithm) {
+			return fmt.Errorf("jwt algorithm %q is not supported", algorithm)
+		}
+	}
+	return nil
+}
+
+// tokenError is an error for a bearer token that's invalid
+type tokenError struct {
+	err error
+}
+
+func (e *tokenError) Error() string {
+	return fmt.Sprintf("invalid bearer token: %s", e.err)
+}
+
+func (e *tokenError) Unwrap() error {
+	return e.err
+}
+
+// jwtVerifier verifies JSON Web Tokens
+type jwtVerifier struct {
+	issuer         string
+	audiences      []string
+	leeway         time.Duration
+	algorithms     []string
+	requiredClaims map[string]interface{}
+	keys           *jwks
+	now            func() time.Time
+}
+
+// newJWTVerifier returns a jwtVerifier for the configuration
+func newJWTVerifier(config *JWT, logger *zap.Logger) *jwtVerifier {
+
+	load := loadJWKSFile(config.JWKSFile)
+	if config.JWKSURL != "" {
+		load = loadJWKSURL(http.DefaultClient, config.JWKSURL)
+	}
+
+	return newJWTVerifierWithKeys(config, newJWKS(load, time.Duration(config.CacheDuration), logger))
+}
+
+// newJWTVerifierWithKeys returns a jwtVerifier for the configuration that verifies tokens with the keys
+func newJWTVerifierWithKeys(config *JWT, keys *jwks) *jwtVerifier {
+
+	leeway := jwt.DefaultLeeway
+	if config.Leeway != 0 {
+		leeway = time.Duration(config.Leeway)
+	}
+
+	algorithms := config.Algorithms
+	if len(algorithms) == 0 {
+		algorithms = defaultJWTAlgorithms
+	}
+
+	return &jwtVerifier{
+		issuer:         config.Issuer,
+		audiences:      config.Audiences,
+		leeway:         leeway,
+		algorithms:     algorithms,
+		requiredClaims: config.RequiredClaims,
+		keys:           keys,
+		now:            time.Now,
+	}
+}
+
+// verify verifies the signature and the claims of the token and returns its claims
+func (j *jwtVerifier) verify(ctx context.Context, token string) (map[string]interface{}, error) {
+
+	parsed, err := jwt.ParseSigned(token)
+	if err != nil {
+		return nil, &tokenError{err: err}
+	}
+	if len(parsed.Headers) != 1 {
+		return nil, &tokenError{err: errors.New("token should have exactly one signature")}
+	}
+
+	header := parsed.Headers[0]
+	if !contains(j.algorithms, header.Algorithm) {
+		return nil, &tokenError{err: fmt.Errorf("algorithm %q is not accepted", header.Algorithm)}
+	}
+
+	keys, err := j.keys.keys(ctx, header.KeyID)
+	if errors.Is(err, errUnknownKey) {
+		return nil, &tokenError{err: err}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	claims := jwt.Claims{}
+	all := map[string]interface{}{}
+	verified := false
+	for _, key := range keys {
+		if (key.Algorithm != "" && key.Algorithm != header.Algorithm) || (key.Use != "" && key.Use != "sig") {
+			continue
+		}
+		if err = parsed.Claims(key.Key, &claims, &all); err == nil {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, &tokenError{err: errors.New("signature can't be verified")}
+	}
+
+	if claims.Expiry == nil {
+		return nil, &tokenError{err: errors.New("token has no expiry (exp)")}
+	}
+	if err := claims.ValidateWithLeeway(jwt.Expected{Issuer: j.issuer, Time: j.now()}, j.leeway); err != nil {
+		return nil, &tokenError{err: err}
+	}
+	if len(j.audiences) > 0 && !containsAny(claims.Audience, j.audiences) {
+		return nil, &tokenError{err: jwt.ErrInvalidAudience}
+	}
+	for name, value := range j.requiredClaims {
+		if !hasClaim(all, name, value) {
+			return nil, &tokenError{err: fmt.Errorf("claim %q doesn't have the required value %s", name, claimString(value))}
+		}
+	}
+
+	return all, nil
+}
+
+// isJWTScheme returns whether bearer tokens for the security scheme are JSON Web Tokens
+func isJWTScheme(scheme *openapi3.SecurityScheme) bool {
+	return scheme.BearerFormat == "" || strings.EqualFold(scheme.BearerFormat, "JWT")
+}
+
+// setClaims sets the claims of a verified token as placeholders with the prefix
+func setClaims(r *http.Request, prefix string, claims map[string]interface{}) {
+	for name, value := range claims {
+		setPlaceholder(r, prefix+"."+name, claimString(value))
+	}
+}
+
+// claimString returns the value of a claim as a string. Lists of strings are
+// joined with commas; other lists and objects are returned as JSON.
+func claimString(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case float64:
+		if v == math.Trunc(v) && math.Abs(v) < 1<<53 {
+			return strconv.FormatInt(int64(v), 10)
+		}
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	case []interface{}:
+		values := make([]string, 0, len(v))
+		for _, item := range v {
+			s, ok := item.(string)
+			if !ok {
+				break
+			}
+			values = append(values, s)
+		}
+		if len(values) == len(v) {
+			return strings.Join(values, ",")
+		}
+	}
+	data, _ := json.Marshal(value)
+	return string(data)
+}
+
+// hasClaim returns whether the claim has the value, or contains it when the claim is a list
+func hasClaim(claims map[string]interface{}, name string, value interface{}) bool {
+	claim, ok := claims[name]
+	if !ok {
+		return false
+	}
+	if list, ok := claim.([]interface{}); ok {
+		for _, item := range list {
+			if claimString(item) == claimString(value) {
+				return true
+			}
+		}
+		return false
+	}
+	return claimString(claim) == claimString(value)
+}
+
+// contains returns whether the values contain the value
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// containsAny returns whether the values contain one of the wanted values
+func containsAny(values []string, wanted []string) bool {
+	for _, w := range wanted {
+		if contains(values, w) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,351 @@
+// Copyright 2020 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package openapi
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/getkin/kin-openapi/openapi3"
+	"go.uber.org/zap/zaptest"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// generateKey generates an ECDSA key with the key ID for signing tokens
+func generateKey(t *testing.T, kid string) jose.JSONWebKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return jose.JSONWebKey{Key: key, KeyID: kid, Algorithm: string(jose.ES256), Use: "sig"}
+}
+
+// writeJWKS writes the public keys to a JWKS file and returns its path
+func writeJWKS(t *testing.T, keys ...jose.JSONWebKey) string {
+	set := jose.JSONWebKeySet{}
+	for _, key := range keys {
+		set.Keys = append(set.Keys, key.Public())
+	}
+	data, err := json.Marshal(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// signToken signs a token with the claims
+func signToken(t *testing.T, key jose.JSONWebKey, claims ...interface{}) string {
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: key}, (&jose.SignerOptions{}).WithType("JWT"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	builder := jwt.Signed(signer)
+	for _, c := range claims {
+		builder = builder.Claims(c)
+	}
+	token, err := builder.CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// withBearerSecurity requires a bearer token with the format for all operations
+func withBearerSecurity(v *Validator, bearerFormat string) {
+	scheme := openapi3.NewJWTSecurityScheme()
+	scheme.BearerFormat = bearerFormat
+	v.specification.Components.SecuritySchemes = openapi3.SecuritySchemes{
+		"BearerAuth": &openapi3.SecuritySchemeRef{Value: scheme},
+	}
+	v.specification.Security = openapi3.SecurityRequirements{{"BearerAuth": []string{}}}
+}
+
+func TestJWTValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		jwt     JWT
+		wantErr bool
+	}{
+		{name: "file", jwt: JWT{JWKSFile: "jwks.json"}},
+		{name: "url", jwt: JWT{JWKSURL: "https://example.com/jwks.json", Algorithms: []string{"HS256"}}},
+		{name: "no key set", jwt: JWT{}, wantErr: true},
+		{name: "file and url", jwt: JWT{JWKSFile: "jwks.json", JWKSURL: "https://example.com/jwks.json"}, wantErr: true},
+		{name: "negative leeway", jwt: JWT{JWKSFile: "jwks.json", Leeway: -1}, wantErr: true},
+		{name: "unknown algorithm", jwt: JWT{JWKSFile: "jwks.json", Algorithms: []string{"none"}}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		if err := tt.jwt.validate(); (err != nil) != tt.wantErr {
+			t.Errorf("unexpected error in test %s: %v", tt.name, err)
+		}
+	}
+}
+
+func TestJWTServeHTTP(t *testing.T) {
+
+	key := generateKey(t, "key-1")
+	unknownKey := generateKey(t, "key-2")
+	jwksFile := writeJWKS(t, key)
+
+	now := time.Now()
+	valid := jwt.Claims{
+		Subject:  "alice",
+		Issuer:   "https://issuer.example.com",
+		Audience: jwt.Audience{"petstore", "other"},
+		Expiry:   jwt.NewNumericDate(now.Add(time.Hour)),
+	}
+	expired := valid
+	expired.Expiry = jwt.NewNumericDate(now.Add(-time.Hour))
+	notYetValid := valid
+	notYetValid.NotBefore = jwt.NewNumericDate(now.Add(time.Hour))
+	otherIssuer := valid
+	otherIssuer.Issuer = "https://other.example.com"
+	otherAudience := valid
+	otherAudience.Audience = jwt.Audience{"other"}
+	noExpiry := valid
+	noExpiry.Expiry = nil
+
+	tests := []struct {
+		name         string
+		bearerFormat string
+		token        string
+		wantStatus   int
+		wantSubject  string
+	}{
+		{name: "valid", token: signToken(t, key, valid, map[string]interface{}{"scope": "pets:read"}), wantStatus: http.StatusOK, wantSubject: "alice"},
+		{name: "expired", token: signToken(t, key, expired), wantStatus: http.StatusUnauthorized},
+		{name: "not yet valid", token: signToken(t, key, notYetValid), wantStatus: http.StatusUnauthorized},
+		{name: "other issuer", token: signToken(t, key, otherIssuer), wantStatus: http.StatusUnauthorized},
+		{name: "other audience", token: signToken(t, key, otherAudience), wantStatus: http.StatusUnauthorized},
+		{name: "no expiry", token: signToken(t, key, noExpiry), wantStatus: http.StatusUnauthorized},
+		{name: "unknown key", token: signToken(t, unknownKey, valid), wantStatus: http.StatusUnauthorized},
+		{name: "malformed", token: "not-a-token", wantStatus: http.StatusUnauthorized},
+		{name: "opaque token", bearerFormat: "opaque", token: "not-a-token", wantStatus: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		v, err := createValidator(t)
+		if err != nil {
+			t.Fatal(err)
+		}
+		v.JWT = &JWT{
+			JWKSFile:  jwksFile,
+			Issuer:    "https://issuer.example.com",
+			Audiences: []string{"petstore"},
+		}
+		n, err := replaceValidator(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		withBearerSecurity(n, tt.bearerFormat)
+
+		req, err := prepareRequest("GET", "http://localhost:9443/api/pets/1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+tt.token)
+
+		recorder := httptest.NewRecorder()
+		n.ServeHTTP(recorder, req, &mockAPI{})
+
+		if status := recorder.Code; status != tt.wantStatus {
+			t.Errorf("handler returned wrong status code in test %s: got %v want %v", tt.name, status, tt.wantStatus)
+		}
+		if tt.wantStatus == http.StatusUnauthorized && recorder.Header().Get("WWW-Authenticate") != `Bearer error="invalid_token"` {
+			t.Errorf("unexpected WWW-Authenticate header in test %s: %q", tt.name, recorder.Header().Get("WWW-Authenticate"))
+		}
+
+		replacer := req.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+		subject, _ := replacer.GetString(ReplacerOpenAPIValidatorJWTClaims + ".sub")
+		if subject != tt.wantSubject {
+			t.Errorf("unexpected subject placeholder in test %s: got %q want %q", tt.name, subject, tt.wantSubject)
+		}
+		if tt.wantSubject != "" {
+			if audience, _ := replacer.GetString(ReplacerOpenAPIValidatorJWTClaims + ".aud"); audience != "petstore,other" {
+				t.Errorf("unexpected audience placeholder in test %s: %q", tt.name, audience)
+			}
+			if scope, _ := replacer.GetString(ReplacerOpenAPIValidatorJWTClaims + ".scope"); scope != "pets:read" {
+				t.Errorf("unexpected scope placeholder in test %s: %q", tt.name, scope)
+			}
+		}
+	}
+}
+
+func TestJWKSRotation(t *testing.T) {
+
+	oldKey := generateKey(t, "old")
+	newKey := generateKey(t, "new")
+
+	loads := 0
+	current := &jose.JSONWebKeySet{Keys: []jose.JSONWebKey{oldKey.Public()}}
+	keys := newJWKS(func(ctx context.Context) (*jose.JSONWebKeySet, error) {
+		loads++
+		return current, nil
+	}, time.Hour, zaptest.NewLogger(t))
+
+	now := time.Now()
+	keys.now = func() time.Time { return now }
+
+	if _, err := keys.keys(context.Background(), "old"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The key set is rotated; tokens signed with the new key trigger a refresh after the minimum interval
+	current = &jose.JSONWebKeySet{Keys: []jose.JSONWebKey{newKey.Public()}}
+	if _, err := keys.keys(context.Background(), "new"); err == nil {
+		t.Error("expected the new key to be unknown within the minimum refresh interval")
+	}
+
+	now = now.Add(jwksMinRefreshInterval)
+	if _, err := keys.keys(context.Background(), "new"); err != nil {
+		t.Errorf("expected the new key to be found after refreshing: %v", err)
+	}
+	if loads != 2 {
+		t.Errorf("unexpected number of loads: got %d want %d", loads, 2)
+	}
+
+	// The cached key set is used until the cache duration has passed
+	if _, err := keys.keys(context.Background(), "new"); err != nil {
+		t.Error(err)
+	}
+	now = now.Add(time.Hour)
+	if _, err := keys.keys(context.Background(), "new"); err != nil {
+		t.Error(err)
+	}
+	if loads != 3 {
+		t.Errorf("unexpected number of loads: got %d want %d", loads, 3)
+	}
+}
+
+func TestJWKSRefreshDoesNotBlock(t *testing.T) {
+
+	key := generateKey(t, "key-1")
+	set := &jose.JSONWebKeySet{Keys: []jose.JSONWebKey{key.Public()}}
+
+	loads := 0
+	started := make(chan struct{})
+	release := make(chan struct{})
+	keys := newJWKS(func(ctx context.Context) (*jose.JSONWebKeySet, error) {
+		loads++
+		if loads > 1 {
+			// The second load is slow
+			close(started)
+			<-release
+		}
+		return set, nil
+	}, time.Minute, zaptest.NewLogger(t))
+
+	now := time.Now()
+	keys.now = func() time.Time { return now }
+	if _, err := keys.keys(context.Background(), "key-1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The cached key set expires; the first request loads it again, while others use the cached key set
+	now = now.Add(time.Hour)
+	done := make(chan error)
+	go func() {
+		_, err := keys.keys(context.Background(), "key-1")
+		done <- err
+	}()
+	<-started
+
+	if _, err := keys.keys(context.Background(), "key-1"); err != nil {
+		t.Errorf("expected the cached key set to be used while it's loaded: %v", err)
+	}
+
+	close(release)
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+	if loads != 2 {
+		t.Errorf("unexpected number of loads: got %d want %d", loads, 2)
+	}
+}
+
+func TestJWKSRefreshWithCanceledRequest(t *testing.T) {
+
+	key := generateKey(t, "key-1")
+	keys := newJWKS(func(ctx context.Context) (*jose.JSONWebKeySet, error) {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		return &jose.JSONWebKeySet{Keys: []jose.JSONWebKey{key.Public()}}, nil
+	}, time.Minute, zaptest.NewLogger(t))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := keys.keys(ctx, "key-1"); err != nil {
+		t.Errorf("loading the key set shouldn't be canceled with the request: %v", err)
+	}
+	if keys.err != nil {
+		t.Errorf("unexpected cached error: %v", keys.err)
+	}
+}
+
+func TestJWKSURL(t *testing.T) {
+
+	key := generateKey(t, "key-1")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{key.Public()}})
+	}))
+	defer server.Close()
+
+	verifier := newJWTVerifier(&JWT{JWKSURL: server.URL}, zaptest.NewLogger(t))
+	claims, err := verifier.verify(context.Background(), signToken(t, key, jwt.Claims{Subject: "bob", Expiry: jwt.NewNumericDate(time.Now().Add(time.Minute))}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims["sub"] != "bob" {
+		t.Errorf("unexpected subject: %v", claims["sub"])
+	}
+}
+
+func TestClaimString(t *testing.T) {
+	tests := []struct {
+		value interface{}
+		want  string
+	}{
+		{value: "alice", want: "alice"},
+		{value: float64(1700000000), want: "1700000000"},
+		{value: 1.5, want: "1.5"},
+		{value: true, want: "true"},
+		{value: []interface{}{"a", "b"}, want: "a,b"},
+		{value: []interface{}{"a", 1.0}, want: `["a",1]`},
+		{value: map[string]interface{}{"roles": []interface{}{"admin"}}, want: `{"roles":["admin"]}`},
+	}
+
+	for _, tt := range tests {
+		if got := claimString(tt.value); got != tt.want {
+			t.Errorf("unexpected string for %v: got %q want %q", tt.value, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+// Copyright 2020 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package openapi
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+)
+
+// extensionMaxBodySize is the OpenAPI extension for limiting the size of request bodies,
+// which can be set on operations and request bodies.
+const extensionMaxBodySize = "x-max-body-size"
+
+// requestBodyLimit returns the maximum size in bytes of the request body for the route of
+// the input, or 0 when the size isn't limited. The x-max-body-size extension on the operation
+// takes precedence over the one on the request body, which takes precedence over the maxLength
+// of a binary or byte string schema for the media type; for other schemas, like those of text
+// and form bodies, maxLength doesn't limit the size of the body. The MaxRequestBodySize is used
+// as a default.
+func (v *Validator) requestBodyLimit(r *http.Request, input *openapi3filter.RequestValidationInput) int64 {
+
+	operation := input.Route.Operation
+	if limit, ok := extensionSize(operation.Extensions); ok {
+		return limit
+	}
+
+	if requestBody := operation.RequestBody; requestBody != nil && requestBody.Value != nil {
+		if limit, ok := extensionSize(requestBody.Value.Extensions); ok {
+			return limit
+		}
+		if content := requestBody.Value.Content.Get(r.Header.Get("Content-Type")); content != nil && content.Schema != nil {
+			schema := content.Schema.Value
+			if schema != nil && schema.Type == openapi3.TypeString && (schema.Format == "binary" || schema.Format == "byte") && schema.MaxLength != nil {
+				return int64(*schema.MaxLength)
+			}
+		}
+	}
+
+	return v.MaxRequestBodySize
+}
+
+// extensionSize returns the size configured by the x-max-body-size extension, if any
+func extensionSize(extensions map[string]interface{}) (int64, bool) {
+	switch value := extensions[extensionMaxBodySize].(type) {
+	case float64:
+		return int64(value), true
+	case int:
+		return int64(value), true
+	case int64:
+		return value, true
+	case json.Number:
+		size, err := value.Int64()
+		return size, err == nil
+	case json.RawMessage:
+		size, err := strconv.ParseInt(string(value), 10, 64)
+		return size, err == nil
+	case string:
+		size, err := strconv.ParseInt(value, 10, 64)
+		return size, err == nil
+	}
+	return 0, false
+}
+
+// limitRequestBody rejects requests with a Content-Length larger than the limit for the operation,
+// before any of the body is read. When blocks is set, bodies of unknown length are cut off once they
+// exceed the limit. Otherwise they're only counted while they're read, so that the next handler still
+// receives all of the body; the returned function reports a body that exceeded the limit after it
+// has been read for validation.
+func (v *Validator) limitRequestBody(w http.ResponseWriter, r *http.Request, input *openapi3filter.RequestValidationInput, blocks bool) (func() *oapiError, *oapiError) {
+
+	exceeded := func() *oapiError { return nil }
+
+	limit := v.requestBodyLimit(r, input)
+	if limit <= 0 || r.Body == nil || r.Body == http.NoBody {
+		return exceeded, nil
+	}
+
+	if r.ContentLength > limit {
+		return exceeded, requestTooLarge(&http.MaxBytesError{Limit: limit})
+	}
+
+	if r.ContentLength < 0 {
+		if blocks {
+			r.Body = http.MaxBytesReader(w, r.Body, limit)
+			return exceeded, nil
+		}
+		body := &countingBody{ReadCloser: r.Body}
+		r.Body = body
+		exceeded = func() *oapiError {
+			if body.n > limit {
+				return requestTooLarge(&http.MaxBytesError{Limit: limit})
+			}
+			return nil
+		}
+	}
+
+	return exceeded, nil
+}
+
+// countingBody is a request body that counts the bytes read from it
+type countingBody struct {
+	io.ReadCloser
+	n int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	return n, err
+}
+
+// requestTooLarge returns an error for a request with a body that exceeds the
+// limit, or nil when err isn't caused by reading beyond the limit.
+func requestTooLarge(err error) *oapiError {
+	var maxBytesErr *http.MaxBytesError
+	if !errors.As(err, &maxBytesErr) {
+		return nil
+	}
+	return &oapiError{
+		Code:     http.StatusRequestEntityTooLarge,
+		Message:  fmt.Sprintf("request body exceeds the maximum size of %d bytes", maxBytesErr.Limit),
+		Internal: err,
+		phase:    phaseRequest,
+	}
+}
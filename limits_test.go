@@ -0,0 +1,159 @@
+// Copyright 2020 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package openapi
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/getkin/kin-openapi/openapi3"
+)
+
+func TestRequestBodyLimit(t *testing.T) {
+	v, err := createValidator(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v.MaxRequestBodySize = 1024
+
+	binary := openapi3.NewStringSchema().WithFormat("binary").WithMaxLength(512)
+	text := openapi3.NewStringSchema().WithMaxLength(16)
+	operation := v.specification.Paths.Find("/pets").Post
+	operation.RequestBody = &openapi3.RequestBodyRef{
+		Value: openapi3.NewRequestBody().WithSchema(binary, []string{"application/octet-stream"}),
+	}
+	operation.RequestBody.Value.Content["text/plain"] = openapi3.NewMediaType().WithSchema(text)
+
+	req, err := prepareRequest("POST", "http://localhost:9443/api/pets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	input, oerr := v.validateRoute(req)
+	if oerr != nil {
+		t.Fatal(oerr)
+	}
+
+	if limit := v.requestBodyLimit(req, input); limit != 512 {
+		t.Errorf("unexpected limit from the schema: got %d want 512", limit)
+	}
+
+	// The maxLength of other string schemas is the length of a string, not of the body
+	req.Header.Set("Content-Type", "text/plain")
+	if limit := v.requestBodyLimit(req, input); limit != 1024 {
+		t.Errorf("unexpected limit from a text schema: got %d want 1024", limit)
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	operation.RequestBody.Value.Extensions = map[string]interface{}{"x-max-body-size": float64(256)}
+	if limit := v.requestBodyLimit(req, input); limit != 256 {
+		t.Errorf("unexpected limit from the request body: got %d want 256", limit)
+	}
+
+	operation.Extensions = map[string]interface{}{"x-max-body-size": float64(128)}
+	if limit := v.requestBodyLimit(req, input); limit != 128 {
+		t.Errorf("unexpected limit from the operation: got %d want 128", limit)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	operation.Extensions = nil
+	operation.RequestBody.Value.Extensions = nil
+	if limit := v.requestBodyLimit(req, input); limit != 1024 {
+		t.Errorf("unexpected default limit: got %d want 1024", limit)
+	}
+}
+
+func TestLimitRequestBodyServeHTTP(t *testing.T) {
+	body := `[{"id": 1, "name": "Pet 1"}]`
+
+	tests := []struct {
+		name          string
+		extension     interface{}
+		defaultLimit  int64
+		body          io.Reader
+		contentLength int64
+		request       EnforceMode
+		streaming     bool
+		wantStatus    int
+		wantErr       bool
+		wantOutcome   string
+	}{
+		{name: "within limit", extension: float64(64), body: strings.NewReader(body), contentLength: int64(len(body)), wantStatus: http.StatusCreated},
+		// The body is never read, because the Content-Length exceeds the limit already
+		{name: "content length", extension: float64(16), body: iotestErrReader{}, contentLength: int64(len(body)), wantStatus: http.StatusRequestEntityTooLarge, wantErr: true},
+		{name: "chunked", defaultLimit: 16, body: strings.NewReader(body), contentLength: -1, wantStatus: http.StatusRequestEntityTooLarge, wantErr: true},
+		// Bodies that are only reported aren't cut off, so the next handler receives all of the body
+		{name: "chunked report", defaultLimit: 16, body: strings.NewReader(body), contentLength: -1, request: EnforceModeReport, wantStatus: http.StatusCreated, wantOutcome: "reported"},
+		{name: "chunked streaming report", defaultLimit: 16, body: strings.NewReader(body), contentLength: -1, request: EnforceModeReport, streaming: true, wantStatus: http.StatusCreated, wantOutcome: "reported"},
+		{name: "chunked within limit report", defaultLimit: 64, body: strings.NewReader(body), contentLength: -1, request: EnforceModeReport, wantStatus: http.StatusCreated, wantOutcome: "passed"},
+	}
+
+	for _, tt := range tests {
+		v, err := createValidator(t)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		v.Enforcement = &Enforcement{Request: tt.request, Response: EnforceModeOff}
+		v.MaxRequestBodySize = tt.defaultLimit
+		if tt.streaming {
+			v.RequestStreaming = &RequestStreaming{SpoolDir: t.TempDir()}
+		}
+		n, err := replaceValidator(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		operation := n.specification.Paths.Find("/pets").Post
+		operation.RequestBody = &openapi3.RequestBodyRef{
+			Value: openapi3.NewRequestBody().WithJSONSchemaRef(n.specification.Components.Schemas["Pets"]),
+		}
+		if tt.extension != nil {
+			operation.Extensions = map[string]interface{}{"x-max-body-size": tt.extension}
+		}
+
+		req, err := prepareRequest("POST", "http://localhost:9443/api/pets")
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Body = io.NopCloser(tt.body)
+		req.ContentLength = tt.contentLength
+
+		recorder := httptest.NewRecorder()
+		api := &bodyAPI{}
+		err = n.ServeHTTP(recorder, req, api)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("unexpected error in test %s: %v", tt.name, err)
+		}
+
+		if status := recorder.Code; status != tt.wantStatus {
+			t.Errorf("handler returned wrong status code in test %s: got %v want %v", tt.name, status, tt.wantStatus)
+		}
+
+		if tt.wantStatus == http.StatusCreated && api.body != body {
+			t.Errorf("unexpected body received by the next handler in test %s: got %q want %q", tt.name, api.body, body)
+		}
+
+		if tt.wantOutcome != "" {
+			if got := outcomeOf(req, phaseRequest); got != tt.wantOutcome {
+				t.Errorf("unexpected request outcome in test %s: got %s want %s", tt.name, got, tt.wantOutcome)
+			}
+		}
+	}
+}
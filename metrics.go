@@ -0,0 +1,103 @@
+// Copyright 2020 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package openapi
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// validatorMetrics are the metrics exposed by the Validator. Like the Caddy
+// HTTP metrics, they're registered with the default Prometheus registry,
+// so that they're exposed on the Caddy metrics endpoint.
+var validatorMetrics = struct {
+	init              sync.Once
+	rolloutPercentage *prometheus.GaugeVec
+	rolloutRequests   *prometheus.CounterVec
+	breakerOpen       *prometheus.GaugeVec
+	breakerTrips      *prometheus.CounterVec
+
+	responses                   *prometheus.CounterVec
+	responseViolations          *prometheus.CounterVec
+	responseViolationsEstimated *prometheus.CounterVec
+	asyncDropped                *prometheus.CounterVec
+	responseBuffering           *prometheus.CounterVec
+}{
+	init: sync.Once{},
+}
+
+func initValidatorMetrics() {
+	const ns, sub = "caddy", "openapi_validator"
+
+	validatorMetrics.rolloutPercentage = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "rollout_percentage",
+		Help:      "Percentage of requests for which validation is enforced.",
+	}, []string{"spec"})
+	validatorMetrics.rolloutRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "rollout_requests_total",
+		Help:      "Counter of requests per rollout bucket and validation outcome.",
+	}, []string{"spec", "bucket", "outcome"})
+
+	operationLabels := []string{"spec", "operation"}
+	validatorMetrics.breakerOpen = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "breaker_open",
+		Help:      "Whether the response validation breaker for an operation is open (1) or closed (0).",
+	}, operationLabels)
+	validatorMetrics.breakerTrips = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "breaker_trips_total",
+		Help:      "Counter of response validation breaker trips per operation.",
+	}, operationLabels)
+
+	validatorMetrics.responses = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "responses_total",
+		Help:      "Counter of responses per operation by sampling outcome: validated, not_sampled or dropped.",
+	}, []string{"spec", "operation", "outcome"})
+	validatorMetrics.responseViolations = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "response_violations_total",
+		Help:      "Counter of invalid responses found in the sampled responses per operation.",
+	}, operationLabels)
+	validatorMetrics.responseViolationsEstimated = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "response_violations_estimated_total",
+		Help:      "Estimated number of invalid responses per operation, extrapolated from the sampled responses.",
+	}, operationLabels)
+	validatorMetrics.asyncDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "async_dropped_total",
+		Help:      "Counter of responses that were dropped instead of being validated asynchronously.",
+	}, []string{"spec", "reason"})
+	validatorMetrics.responseBuffering = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "response_buffering_total",
+		Help:      "Counter of responses per operation by how they were buffered: memory, disk, bypass or overflow.",
+	}, []string{"spec", "operation", "buffer"})
+}
@@ -0,0 +1,186 @@
+// Copyright 2020 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package openapi
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/getkin/kin-openapi/openapi3"
+)
+
+// ReplacerOpenAPIValidatorMutualTLS is the prefix of the Caddy Replacer keys for the identity fields of
+// the client certificate for a mutualTLS security scheme, e.g. {openapi_validator.mutual_tls.subject}
+const ReplacerOpenAPIValidatorMutualTLS = "openapi_validator.mutual_tls"
+
+// MutualTLS configures constraints on the client certificates for a mutualTLS security scheme. The
+// client certificate should have been verified by the TLS server, like with Caddy's client_auth.
+type MutualTLS struct {
+	// The subjects that are accepted, as distinguished names like CN=billing,O=Example.
+	// Default is empty, resulting in the subject not being checked
+	Subjects []string `json:"subjects,omitempty"`
+	// The subject alternative names that are accepted: DNS names, email addresses,
+	// IP addresses or URIs. The certificate should have one of them.
+	// Default is empty, resulting in the subject alternative names not being checked
+	SANs []string `json:"sans,omitempty"`
+	// The issuers that are accepted, as distinguished names like CN=Example CA,O=Example.
+	// Default is empty, resulting in the issuer not being checked
+	Issuers []string `json:"issuers,omitempty"`
+}
+
+// verifiedClientCertificate returns the client certificate of the request, which should
+// have been verified against the trusted CAs of the TLS server
+func verifiedClientCertificate(r *http.Request) (*x509.Certificate, error) {
+	if r.TLS == nil {
+		return nil, &credentialsError{err: errors.New("no TLS connection")}
+	}
+	if len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil, &credentialsError{err: errors.New("no verified client certificate provided")}
+	}
+	return r.TLS.VerifiedChains[0][0], nil
+}
+
+// check returns an error when the certificate doesn't satisfy the constraints
+func (m *MutualTLS) check(cert *x509.Certificate) error {
+	if len(m.Subjects) > 0 && !containsDN(m.Subjects, cert.Subject.String()) {
+		return fmt.Errorf("client certificate subject %q is not accepted", cert.Subject.String())
+	}
+	if len(m.SANs) > 0 && !containsAny(subjectAltNames(cert), m.SANs) {
+		return fmt.Errorf("client certificate for %q has no accepted subject alternative name", cert.Subject.String())
+	}
+	if len(m.Issuers) > 0 && !containsDN(m.Issuers, cert.Issuer.String()) {
+		return fmt.Errorf("client certificate issuer %q is not accepted", cert.Issuer.String())
+	}
+	return nil
+}
+
+// containsDN returns whether the distinguished names contain the distinguished name,
+// ignoring spaces after the separators
+func containsDN(names []string, name string) bool {
+	for _, n := range names {
+		if strings.EqualFold(normalizeDN(n), normalizeDN(name)) {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeDN removes the spaces around the separators of a distinguished name
+func normalizeDN(name string) string {
+	parts := strings.Split(name, ",")
+	for i, part := range parts {
+		attribute, value, ok := strings.Cut(part, "=")
+		if !ok {
+			// Part of a value with an escaped separator
+			parts[i] = strings.TrimSpace(part)
+			continue
+		}
+		parts[i] = strings.TrimSpace(attribute) + "=" + strings.TrimSpace(value)
+	}
+	return strings.Join(parts, ",")
+}
+
+// subjectAltNames returns the subject alternative names of the certificate
+func subjectAltNames(cert *x509.Certificate) []string {
+	names := append([]string{}, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	for _, ip := range cert.IPAddresses {
+		names = append(names, ip.String())
+	}
+	for _, uri := range cert.URIs {
+		names = append(names, uri.String())
+	}
+	return names
+}
+
+// certificateIdentity returns the identity for the client certificate: the common name of the
+// subject, or the subject itself when it has no common name
+func certificateIdentity(cert *x509.Certificate) *Identity {
+	if cert.Subject.CommonName != "" {
+		return &Identity{ID: cert.Subject.CommonName}
+	}
+	return &Identity{ID: cert.Subject.String()}
+}
+
+// setCertificate sets the identity fields of the client certificate as placeholders
+func setCertificate(r *http.Request, cert *x509.Certificate) {
+	ips := make([]string, 0, len(cert.IPAddresses))
+	for _, ip := range cert.IPAddresses {
+		ips = append(ips, ip.String())
+	}
+	uris := make([]string, 0, len(cert.URIs))
+	for _, uri := range cert.URIs {
+		uris = append(uris, uri.String())
+	}
+	fingerprint := sha256.Sum256(cert.Raw)
+
+	setPlaceholder(r, ReplacerOpenAPIValidatorMutualTLS+".subject", cert.Subject.String())
+	setPlaceholder(r, ReplacerOpenAPIValidatorMutualTLS+".common_name", cert.Subject.CommonName)
+	setPlaceholder(r, ReplacerOpenAPIValidatorMutualTLS+".issuer", cert.Issuer.String())
+	setPlaceholder(r, ReplacerOpenAPIValidatorMutualTLS+".serial", cert.SerialNumber.String())
+	setPlaceholder(r, ReplacerOpenAPIValidatorMutualTLS+".fingerprint", hex.EncodeToString(fingerprint[:]))
+	setPlaceholder(r, ReplacerOpenAPIValidatorMutualTLS+".san.dns_names", strings.Join(cert.DNSNames, ","))
+	setPlaceholder(r, ReplacerOpenAPIValidatorMutualTLS+".san.emails", strings.Join(cert.EmailAddresses, ","))
+	setPlaceholder(r, ReplacerOpenAPIValidatorMutualTLS+".san.ips", strings.Join(ips, ","))
+	setPlaceholder(r, ReplacerOpenAPIValidatorMutualTLS+".san.uris", strings.Join(uris, ","))
+}
+
+// authorizeClientCertificate checks that the request has a verified client certificate that
+// satisfies the constraints, when configured
+func authorizeClientCertificate(r *http.Request, constraints *MutualTLS) (*x509.Certificate, error) {
+
+	cert, err := verifiedClientCertificate(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if constraints != nil {
+		if err := constraints.check(cert); err != nil {
+			return nil, err
+		}
+	}
+
+	return cert, nil
+}
+
+// withoutMutualTLSSchemes calls fn with the mutualTLS security schemes removed from the specification
+// and adds them back afterwards. The specification is validated when a router is created, but kin-openapi
+// doesn't know the mutualTLS type, which was added in OpenAPI 3.1, and rejects it.
+func withoutMutualTLSSchemes(specification *openapi3.T, fn func() error) error {
+
+	if specification.Components == nil {
+		return fn()
+	}
+
+	removed := openapi3.SecuritySchemes{}
+	for name, ref := range specification.Components.SecuritySchemes {
+		if ref != nil && ref.Value != nil && ref.Value.Type == "mutualTLS" {
+			removed[name] = ref
+			delete(specification.Components.SecuritySchemes, name)
+		}
+	}
+	defer func() {
+		for name, ref := range removed {
+			specification.Components.SecuritySchemes[name] = ref
+		}
+	}()
+
+	return fn()
+}
@@ -0,0 +1,236 @@
+// Copyright 2020 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package openapi
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// testCA is a locally generated certificate authority for client certificates
+type testCA struct {
+	cert *x509.Certificate
+	key  crypto.Signer
+}
+
+// newTestCA generates a new testCA with the common name
+func newTestCA(t *testing.T, commonName string) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: commonName, Organization: []string{"Example"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key}
+}
+
+// issue issues a client certificate for the common name and subject alternative names
+func (ca *testCA) issue(t *testing.T, commonName string, dnsNames []string, uris []string) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName, Organization: []string{"Example"}},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	for _, uri := range uris {
+		u, err := url.Parse(uri)
+		if err != nil {
+			t.Fatal(err)
+		}
+		template.URIs = append(template.URIs, u)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, key.Public(), ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// connectionState returns the TLS connection state for a client certificate, which is verified
+// against the CAs like a TLS server requiring client certificates does
+func connectionState(t *testing.T, cert *x509.Certificate, cas ...*testCA) *tls.ConnectionState {
+	roots := x509.NewCertPool()
+	for _, ca := range cas {
+		roots.AddCert(ca.cert)
+	}
+	chains, err := cert.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}, VerifiedChains: chains}
+}
+
+// mutualTLSSpecification returns the path to a version of the PetStore API that is secured
+// by a mutualTLS security scheme
+func mutualTLSSpecification(t *testing.T) string {
+	data, err := os.ReadFile("examples/petstore.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data = append(data, []byte("  securitySchemes:\n    ClientCertificate:\n      type: mutualTLS\nsecurity:\n  - ClientCertificate: []\n")...)
+	path := filepath.Join(t.TempDir(), "petstore-mtls.yaml")
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestMutualTLSSpecification(t *testing.T) {
+
+	v, err := createValidator(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v.Filepath = mutualTLSSpecification(t)
+	n, err := replaceValidator(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ref := n.specification.Components.SecuritySchemes["ClientCertificate"]
+	if ref == nil || ref.Value == nil || ref.Value.Type != "mutualTLS" {
+		t.Errorf("mutualTLS security scheme should be kept in the specification: got %v", ref)
+	}
+}
+
+func TestMutualTLS(t *testing.T) {
+
+	ca := newTestCA(t, "Example CA")
+	partnerCA := newTestCA(t, "Partner CA")
+	billing := ca.issue(t, "billing", []string{"billing.example.com"}, []string{"spiffe://example.com/billing"})
+	partner := partnerCA.issue(t, "partner", []string{"partner.example.com"}, nil)
+	specification := mutualTLSSpecification(t)
+
+	tests := []struct {
+		name        string
+		constraints *MutualTLS
+		state       *tls.ConnectionState
+		wantStatus  int
+		wantUser    string
+	}{
+		{name: "verified certificate", state: connectionState(t, billing, ca), wantStatus: http.StatusOK, wantUser: "billing"},
+		{name: "verified certificate of other CA", state: connectionState(t, partner, ca, partnerCA), wantStatus: http.StatusOK, wantUser: "partner"},
+		{name: "no TLS", wantStatus: http.StatusUnauthorized},
+		{name: "unverified certificate", state: &tls.ConnectionState{PeerCertificates: []*x509.Certificate{billing}}, wantStatus: http.StatusUnauthorized},
+		{name: "accepted subject", constraints: &MutualTLS{Subjects: []string{"CN=billing, O=Example"}}, state: connectionState(t, billing, ca), wantStatus: http.StatusOK, wantUser: "billing"},
+		{name: "other subject", constraints: &MutualTLS{Subjects: []string{"CN=reporting,O=Example"}}, state: connectionState(t, billing, ca), wantStatus: http.StatusForbidden},
+		{name: "accepted URI SAN", constraints: &MutualTLS{SANs: []string{"spiffe://example.com/billing"}}, state: connectionState(t, billing, ca), wantStatus: http.StatusOK, wantUser: "billing"},
+		{name: "accepted DNS SAN", constraints: &MutualTLS{SANs: []string{"other.example.com", "billing.example.com"}}, state: connectionState(t, billing, ca), wantStatus: http.StatusOK, wantUser: "billing"},
+		{name: "other SAN", constraints: &MutualTLS{SANs: []string{"reporting.example.com"}}, state: connectionState(t, billing, ca), wantStatus: http.StatusForbidden},
+		{name: "accepted issuer", constraints: &MutualTLS{Issuers: []string{"CN=Example CA,O=Example"}}, state: connectionState(t, billing, ca), wantStatus: http.StatusOK, wantUser: "billing"},
+		{name: "other issuer", constraints: &MutualTLS{Issuers: []string{"CN=Example CA,O=Example"}}, state: connectionState(t, partner, ca, partnerCA), wantStatus: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		v, err := createValidator(t)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.constraints != nil {
+			v.MutualTLS = map[string]*MutualTLS{"ClientCertificate": tt.constraints}
+		}
+		v.Filepath = specification
+		n, err := replaceValidator(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req, err := prepareRequest("GET", "http://localhost:9443/api/pets/1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.TLS = tt.state
+
+		recorder := httptest.NewRecorder()
+		n.ServeHTTP(recorder, req, &mockAPI{})
+
+		if status := recorder.Code; status != tt.wantStatus {
+			t.Errorf("handler returned wrong status code in test %s: got %v want %v", tt.name, status, tt.wantStatus)
+		}
+
+		replacer := req.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+		if user, _ := replacer.GetString(ReplacerHTTPAuthUserID); user != tt.wantUser {
+			t.Errorf("unexpected user placeholder in test %s: got %q want %q", tt.name, user, tt.wantUser)
+		}
+	}
+}
+
+func TestMutualTLSPlaceholders(t *testing.T) {
+
+	ca := newTestCA(t, "Example CA")
+	billing := ca.issue(t, "billing", []string{"billing.example.com"}, []string{"spiffe://example.com/billing"})
+
+	req, err := prepareRequest("GET", "http://localhost:9443/api/pets/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	setCertificate(req, billing)
+
+	replacer := req.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	want := map[string]string{
+		"subject":       "CN=billing,O=Example",
+		"common_name":   "billing",
+		"issuer":        "CN=Example CA,O=Example",
+		"serial":        billing.SerialNumber.String(),
+		"san.dns_names": "billing.example.com",
+		"san.uris":      "spiffe://example.com/billing",
+	}
+	for name, value := range want {
+		if got, _ := replacer.GetString(ReplacerOpenAPIValidatorMutualTLS + "." + name); got != value {
+			t.Errorf("unexpected %s placeholder: got %q want %q", name, got, value)
+		}
+	}
+}
@@ -0,0 +1,264 @@
+// Copyright 2020 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package openapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+)
+
+const (
+	defaultMaxLineErrors = 10
+	maxLineSize          = 1 << 20
+)
+
+// isLineStream returns whether the content type is one of the media types for newline delimited JSON
+func isLineStream(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	switch mediaType {
+	case "application/x-ndjson", "application/ndjson", "application/jsonl", "application/x-jsonlines":
+		return true
+	}
+	return false
+}
+
+// lineSchema returns the schema each line of newline delimited JSON is validated against: the
+// items schema of an array schema, or the schema itself for other schemas. It returns nil when
+// the content type isn't newline delimited JSON or there's no schema for it.
+func lineSchema(content openapi3.Content, contentType string) *openapi3.Schema {
+
+	if !isLineStream(contentType) {
+		return nil
+	}
+
+	mediaType := content.Get(contentType)
+	if mediaType == nil || mediaType.Schema == nil || mediaType.Schema.Value == nil {
+		return nil
+	}
+
+	schema := mediaType.Schema.Value
+	if schema.Type == openapi3.TypeArray {
+		if schema.Items == nil {
+			return nil
+		}
+		return schema.Items.Value
+	}
+
+	return schema
+}
+
+// requestLineSchema returns the schema for the lines of a newline delimited JSON request body, if any
+func requestLineSchema(r *http.Request, input *openapi3filter.RequestValidationInput) *openapi3.Schema {
+	requestBody := input.Route.Operation.RequestBody
+	if requestBody == nil || requestBody.Value == nil || r.Body == nil || r.Body == http.NoBody {
+		return nil
+	}
+	return lineSchema(requestBody.Value.Content, r.Header.Get("Content-Type"))
+}
+
+// responseLineSchema returns the schema for the lines of a newline delimited JSON response body, if any
+func responseLineSchema(input *openapi3filter.RequestValidationInput, status int, header http.Header) *openapi3.Schema {
+	responses := input.Route.Operation.Responses
+	responseRef := responses.Get(status)
+	if responseRef == nil {
+		responseRef = responses.Default()
+	}
+	if responseRef == nil || responseRef.Value == nil {
+		return nil
+	}
+	return lineSchema(responseRef.Value.Content, header.Get("Content-Type"))
+}
+
+// maxLineErrors returns the maximum number of errors reported for newline delimited JSON
+func (v *Validator) maxLineErrors() int {
+	if v.MaxLineErrors == 0 {
+		return defaultMaxLineErrors
+	}
+	return v.MaxLineErrors
+}
+
+// validateLines returns a function for validating a newline delimited JSON request body,
+// which stops reading when the maximum number of errors has been reached.
+func (v *Validator) validateLines(schema *openapi3.Schema) func(r io.Reader) error {
+	return func(r io.Reader) error {
+
+		lines := newLineValidator(schema, openapi3.VisitAsRequest(), v.maxLineErrors(), func(error) {})
+
+		buffer := make([]byte, 32*1024)
+		for !lines.full() {
+			n, err := r.Read(buffer)
+			lines.Write(buffer[:n])
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+		}
+		lines.Close()
+
+		if lines.records == 0 && lines.errors == 0 {
+			return errEmptyJSONStream
+		}
+
+		return lines.err()
+	}
+}
+
+// lineValidator validates newline delimited JSON written to it. Every line is validated
+// against the schema as soon as it's complete. Errors are passed to report until the
+// maximum number of errors has been reached; the rest of the errors are only counted.
+type lineValidator struct {
+	schema    *openapi3.Schema
+	option    openapi3.SchemaValidationOption
+	maxErrors int
+	report    func(err error)
+
+	line     bytes.Buffer
+	tooLarge bool
+
+	// lines counts the lines, including blank ones, for the positions of errors;
+	// records counts the lines that were validated
+	lines    int
+	records  int
+	errors   int
+	reported []error
+}
+
+// newLineValidator returns a new lineValidator
+func newLineValidator(schema *openapi3.Schema, option openapi3.SchemaValidationOption, maxErrors int, report func(err error)) *lineValidator {
+	return &lineValidator{
+		schema:    schema,
+		option:    option,
+		maxErrors: maxErrors,
+		report:    report,
+	}
+}
+
+// Write validates the lines that are completed by p
+func (l *lineValidator) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			l.append(p)
+			break
+		}
+		l.append(p[:i])
+		l.validate()
+		p = p[i+1:]
+	}
+	return n, nil
+}
+
+// Close validates the last line, if it's not terminated by a newline
+func (l *lineValidator) Close() error {
+	if l.line.Len() > 0 || l.tooLarge {
+		l.validate()
+	}
+	return nil
+}
+
+// append adds data to the current line, unless it grows too large
+func (l *lineValidator) append(p []byte) {
+	if l.tooLarge || l.line.Len()+len(p) > maxLineSize {
+		l.tooLarge = true
+		return
+	}
+	l.line.Write(p)
+}
+
+// validate validates the current line
+func (l *lineValidator) validate() {
+
+	defer func() {
+		l.line.Reset()
+		l.tooLarge = false
+	}()
+
+	l.lines++
+
+	line := bytes.TrimSpace(l.line.Bytes())
+	if len(line) == 0 && !l.tooLarge {
+		return
+	}
+
+	l.records++
+
+	var err error
+	var value interface{}
+	switch {
+	case l.tooLarge:
+		err = fmt.Errorf("line exceeds the maximum size of %d bytes", maxLineSize)
+	case json.Unmarshal(line, &value) != nil:
+		err = errors.New("line is not valid JSON")
+	case l.schema != nil:
+		err = schemaViolation("", l.schema.VisitJSON(value, l.option))
+	}
+	if err == nil {
+		return
+	}
+
+	l.errors++
+	if len(l.reported) < l.maxErrors {
+		err = fmt.Errorf("line %d: %w", l.lines, err)
+		l.reported = append(l.reported, err)
+		l.report(err)
+	}
+}
+
+// full returns whether the maximum number of errors has been reached
+func (l *lineValidator) full() bool {
+	return l.maxErrors > 0 && l.errors >= l.maxErrors
+}
+
+// err returns an error listing the reported errors, or nil when all lines were valid
+func (l *lineValidator) err() error {
+	if l.errors == 0 {
+		return nil
+	}
+	messages := make([]string, 0, len(l.reported))
+	for _, err := range l.reported {
+		messages = append(messages, err.Error())
+	}
+	return fmt.Errorf("%d of %d lines have errors: %s", l.errors, l.records, strings.Join(messages, "; "))
+}
+
+// result returns an error for a response with invalid lines, or nil when all lines were valid
+func (l *lineValidator) result() *oapiError {
+	l.Close()
+	err := l.err()
+	if err == nil {
+		return nil
+	}
+	return &oapiError{
+		Code:     http.StatusInternalServerError,
+		Message:  fmt.Sprintf("response body has an error: %s", err),
+		Internal: err,
+		phase:    phaseResponse,
+	}
+}
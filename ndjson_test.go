@@ -0,0 +1,203 @@
+// Copyright 2020 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package openapi
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/getkin/kin-openapi/openapi3"
+)
+
+func TestLineValidator(t *testing.T) {
+	v, err := createValidator(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pet := v.specification.Components.Schemas["Pet"].Value
+
+	reported := []string{}
+	lines := newLineValidator(pet, openapi3.VisitAsRequest(), 2, func(err error) {
+		reported = append(reported, err.Error())
+	})
+
+	body := `{"id": 1, "name": "Pet 1"}` + "\n" +
+		`{"id": 2}` + "\n" +
+		"\n" +
+		`{"id": 3, "name": ` + "\n" +
+		`{"id": "four", "name": "Pet 4"}`
+
+	for i := 0; i < len(body); i += 5 {
+		end := i + 5
+		if end > len(body) {
+			end = len(body)
+		}
+		lines.Write([]byte(body[i:end]))
+	}
+	lines.Close()
+
+	want := []string{
+		`line 2: doesn't match schema at "/name": property "name" is missing`,
+		`line 4: line is not valid JSON`,
+	}
+	if strings.Join(reported, "\n") != strings.Join(want, "\n") {
+		t.Errorf("unexpected errors: got %q want %q", reported, want)
+	}
+
+	if !lines.full() || lines.errors != 3 || lines.records != 4 || lines.lines != 5 {
+		t.Errorf("unexpected state: %d errors in %d records on %d lines", lines.errors, lines.records, lines.lines)
+	}
+
+	if err := lines.err(); err == nil || !strings.HasPrefix(err.Error(), "3 of 4 lines have errors: line 2") {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestLineValidatorBlankLines(t *testing.T) {
+	v, err := createValidator(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pet := v.specification.Components.Schemas["Pet"].Value
+
+	reported := []string{}
+	lines := newLineValidator(pet, openapi3.VisitAsRequest(), 10, func(err error) {
+		reported = append(reported, err.Error())
+	})
+
+	body := "\n" +
+		`{"id": 1, "name": "Pet 1"}` + "\n" +
+		"\n" +
+		"  \n" +
+		`{"id": 2}` + "\n" +
+		"\n" +
+		`{"id": 3, "name": "Pet 3"}` + "\n"
+	lines.Write([]byte(body))
+	lines.Close()
+
+	want := []string{`line 5: doesn't match schema at "/name": property "name" is missing`}
+	if strings.Join(reported, "\n") != strings.Join(want, "\n") {
+		t.Errorf("unexpected errors: got %q want %q", reported, want)
+	}
+
+	if err := lines.err(); err == nil || !strings.HasPrefix(err.Error(), "1 of 3 lines have errors: line 5") {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestLineRequestServeHTTP(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+		wantErr    string
+	}{
+		{name: "valid", body: "{\"id\": 1, \"name\": \"Pet 1\"}\n{\"id\": 2, \"name\": \"Pet 2\"}\n", wantStatus: http.StatusCreated},
+		{name: "invalid", body: "{\"id\": 1, \"name\": \"Pet 1\"}\n{\"id\": 2}\n", wantStatus: http.StatusBadRequest, wantErr: "1 of 2 lines have errors: line 2"},
+	}
+
+	for _, tt := range tests {
+		v, err := createValidator(t)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		v.Enforcement = &Enforcement{Response: EnforceModeOff}
+		n, err := replaceValidator(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		n.specification.Paths.Find("/pets").Post.RequestBody = &openapi3.RequestBodyRef{
+			Value: openapi3.NewRequestBody().WithSchemaRef(n.specification.Components.Schemas["Pets"], []string{"application/x-ndjson"}),
+		}
+
+		req, err := prepareRequest("POST", "http://localhost:9443/api/pets")
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/x-ndjson")
+		req.Body = io.NopCloser(strings.NewReader(tt.body))
+		req.ContentLength = int64(len(tt.body))
+
+		recorder := httptest.NewRecorder()
+		api := &bodyAPI{}
+		err = n.ServeHTTP(recorder, req, api)
+		if tt.wantErr == "" && err != nil {
+			t.Errorf("unexpected error in test %s: %v", tt.name, err)
+		}
+		if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+			t.Errorf("unexpected error in test %s: got %v want %s", tt.name, err, tt.wantErr)
+		}
+
+		if status := recorder.Code; status != tt.wantStatus {
+			t.Errorf("handler returned wrong status code in test %s: got %v want %v", tt.name, status, tt.wantStatus)
+		}
+
+		if tt.wantErr == "" && api.body != tt.body {
+			t.Errorf("unexpected body passed on in test %s: got %q want %q", tt.name, api.body, tt.body)
+		}
+	}
+}
+
+// lineAPI exports pets as newline delimited JSON
+type lineAPI struct{}
+
+// ServeHTTP writes a valid and an invalid pet
+func (m *lineAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) error {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintln(w, `{"id": 1, "name": "Pet 1"}`)
+	fmt.Fprintln(w, `{"id": 2}`)
+	return nil
+}
+
+func TestLineResponseServeHTTP(t *testing.T) {
+	v, err := createValidator(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := replaceValidator(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content := n.specification.Paths.Find("/pets").Get.Responses.Get(200).Value.Content
+	content["application/x-ndjson"] = openapi3.NewMediaType().WithSchemaRef(n.specification.Components.Schemas["Pets"])
+
+	req, err := prepareRequest("GET", "http://localhost:9443/api/pets")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := httptest.NewRecorder()
+	err = n.ServeHTTP(recorder, req, &lineAPI{})
+	if err != nil {
+		t.Error(err)
+	}
+
+	if status := recorder.Code; status != http.StatusOK || strings.Count(recorder.Body.String(), "\n") != 2 {
+		t.Errorf("unexpected response: %d %q", status, recorder.Body.String())
+	}
+
+	if got := outcomeOf(req, phaseResponse); got != "reported" {
+		t.Errorf("unexpected response outcome: got %s want reported", got)
+	}
+}
@@ -0,0 +1,216 @@
+// Copyright 2020 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package openapi
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+)
+
+// validateContentNegotiation checks that the media type of the request body is declared
+// for the operation and that at least one of the documented response media types is
+// acceptable to the client.
+func (v *Validator) validateContentNegotiation(r *http.Request, input *openapi3filter.RequestValidationInput) *oapiError {
+
+	operation := input.Route.Operation
+
+	if requestBody := operation.RequestBody; requestBody != nil && requestBody.Value != nil && len(requestBody.Value.Content) > 0 && hasBody(r) {
+		content := requestBody.Value.Content
+		contentType := r.Header.Get("Content-Type")
+		if content.Get(contentType) == nil {
+			supported := mediaTypes(content)
+			oerr := &oapiError{
+				Code:    http.StatusUnsupportedMediaType,
+				Message: fmt.Sprintf("request Content-Type %q is not supported; supported: %s", contentType, strings.Join(supported, ", ")),
+				phase:   phaseRequest,
+			}
+			// Accept-Post (RFC 9110) and Accept-Patch (RFC 5789) advertise the supported media types
+			switch r.Method {
+			case http.MethodPost:
+				oerr.header = http.Header{"Accept-Post": []string{strings.Join(supported, ", ")}}
+			case http.MethodPatch:
+				oerr.header = http.Header{"Accept-Patch": []string{strings.Join(supported, ", ")}}
+			}
+			return oerr
+		}
+	}
+
+	available := []string{}
+	for _, response := range operation.Responses {
+		if response.Value != nil {
+			available = append(available, mediaTypes(response.Value.Content)...)
+		}
+	}
+	available = distinct(available)
+	if len(available) == 0 {
+		return nil
+	}
+
+	accepted := parseAccept(r.Header.Values("Accept"))
+	if len(accepted) == 0 {
+		return nil
+	}
+	for _, mediaType := range available {
+		if accepts(accepted, mediaType) {
+			return nil
+		}
+	}
+
+	return &oapiError{
+		Code:    http.StatusNotAcceptable,
+		Message: fmt.Sprintf("none of the media types in Accept are available; available: %s", strings.Join(available, ", ")),
+		phase:   phaseRequest,
+	}
+}
+
+// validateResponseContentType checks that the Content-Type of a response is documented for its status
+func validateResponseContentType(status int, header http.Header, input *openapi3filter.RequestValidationInput) *oapiError {
+
+	contentType := header.Get("Content-Type")
+	if contentType == "" || (input.Request.Method == http.MethodHead && !isHeadAsGet(input)) || status == http.StatusNotModified {
+		return nil
+	}
+	if status == http.StatusPartialContent && isByteRanges(contentType) {
+		return nil
+	}
+	status = documentedStatus(input, status)
+
+	responses := input.Route.Operation.Responses
+	responseRef := responses.Get(status)
+	if responseRef == nil {
+		responseRef = responses.Default()
+	}
+	if responseRef == nil || responseRef.Value == nil || len(responseRef.Value.Content) == 0 {
+		return nil
+	}
+
+	content := responseRef.Value.Content
+	if content.Get(contentType) != nil {
+		return nil
+	}
+
+	return &oapiError{
+		Code:    http.StatusInternalServerError,
+		Message: fmt.Sprintf("response header Content-Type has unexpected value: %q; documented for status %d: %s", contentType, status, strings.Join(mediaTypes(content), ", ")),
+		phase:   phaseResponse,
+	}
+}
+
+// hasBody returns whether the request has a body
+func hasBody(r *http.Request) bool {
+	return r.Body != nil && r.Body != http.NoBody && r.ContentLength != 0
+}
+
+// mediaTypes returns the sorted media types of the content
+func mediaTypes(content openapi3.Content) []string {
+	types := make([]string, 0, len(content))
+	for mediaType := range content {
+		types = append(types, mediaType)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// distinct returns the sorted distinct values
+func distinct(values []string) []string {
+	seen := map[string]bool{}
+	result := []string{}
+	for _, value := range values {
+		if !seen[value] {
+			seen[value] = true
+			result = append(result, value)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+// mediaRange is a media range from an Accept header
+type mediaRange struct {
+	typ     string
+	subtype string
+	q       float64
+}
+
+// parseAccept parses the media ranges in Accept headers. Invalid ranges are ignored.
+func parseAccept(values []string) []mediaRange {
+	ranges := []mediaRange{}
+	for _, value := range values {
+		for _, part := range strings.Split(value, ",") {
+			mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+			if err != nil {
+				continue
+			}
+			typ, subtype, ok := strings.Cut(mediaType, "/")
+			if !ok {
+				continue
+			}
+			q := 1.0
+			if value, ok := params["q"]; ok {
+				if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+					q = parsed
+				}
+			}
+			ranges = append(ranges, mediaRange{typ: typ, subtype: subtype, q: q})
+		}
+	}
+	return ranges
+}
+
+// accepts returns whether the media type, which may be a range itself, is acceptable. The
+// most specific range that matches the media type decides, so that a media type excluded
+// with q=0 is not accepted because of a wildcard range.
+func accepts(ranges []mediaRange, mediaType string) bool {
+	mediaType, _, err := mime.ParseMediaType(mediaType)
+	if err != nil {
+		return false
+	}
+	typ, subtype, _ := strings.Cut(mediaType, "/")
+	specificity, q := -1, 0.0
+	for _, r := range ranges {
+		if !matchesMediaPart(r.typ, typ) || !matchesMediaPart(r.subtype, subtype) {
+			continue
+		}
+		s := r.specificity()
+		if s > specificity || (s == specificity && r.q > q) {
+			specificity, q = s, r.q
+		}
+	}
+	return q > 0
+}
+
+// specificity returns how specific the media range is: 0 for */*, 1 for type/* and 2 for type/subtype
+func (r mediaRange) specificity() int {
+	switch {
+	case r.typ == "*":
+		return 0
+	case r.subtype == "*":
+		return 1
+	default:
+		return 2
+	}
+}
+
+// matchesMediaPart returns whether the type or subtype parts match, taking wildcards into account
+func matchesMediaPart(a, b string) bool {
+	return a == "*" || b == "*" || strings.EqualFold(a, b)
+}
@@ -0,0 +1,146 @@
+// Copyright 2020 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package openapi
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/getkin/kin-openapi/openapi3"
+)
+
+func TestAccepts(t *testing.T) {
+	tests := []struct {
+		accept    string
+		mediaType string
+		want      bool
+	}{
+		{accept: "application/json", mediaType: "application/json", want: true},
+		{accept: "text/html, application/*;q=0.5", mediaType: "application/json", want: true},
+		{accept: "*/*", mediaType: "application/json", want: true},
+		{accept: "text/html", mediaType: "application/json", want: false},
+		{accept: "application/json;q=0", mediaType: "application/json", want: false},
+		{accept: "image/png", mediaType: "image/*", want: true},
+		{accept: "application/json;q=0, */*", mediaType: "application/json", want: false},
+		{accept: "application/json;q=0, */*", mediaType: "text/plain", want: true},
+		{accept: "application/*;q=0, application/json", mediaType: "application/json", want: true},
+		{accept: "application/*;q=0, */*", mediaType: "application/xml", want: false},
+	}
+
+	for _, tt := range tests {
+		if got := accepts(parseAccept([]string{tt.accept}), tt.mediaType); got != tt.want {
+			t.Errorf("unexpected result for %q accepting %s: got %t want %t", tt.accept, tt.mediaType, got, tt.want)
+		}
+	}
+}
+
+func TestContentNegotiationServeHTTP(t *testing.T) {
+	tests := []struct {
+		name        string
+		method      string
+		url         string
+		contentType string
+		accept      string
+		wantStatus  int
+	}{
+		{name: "acceptable", method: "GET", url: "http://localhost:9443/api/pets/1", accept: "text/html, application/*;q=0.5", wantStatus: http.StatusOK},
+		{name: "not acceptable", method: "GET", url: "http://localhost:9443/api/pets/1", accept: "text/html", wantStatus: http.StatusNotAcceptable},
+		{name: "supported media type", method: "POST", url: "http://localhost:9443/api/pets", contentType: "application/json", accept: "application/json", wantStatus: http.StatusCreated},
+		{name: "unsupported media type", method: "POST", url: "http://localhost:9443/api/pets", contentType: "text/plain", accept: "application/json", wantStatus: http.StatusUnsupportedMediaType},
+	}
+
+	for _, tt := range tests {
+		v, err := createValidator(t)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		v.Enforcement = &Enforcement{Response: EnforceModeOff}
+		n, err := replaceValidator(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		n.specification.Paths.Find("/pets").Post.RequestBody = &openapi3.RequestBodyRef{
+			Value: openapi3.NewRequestBody().WithJSONSchemaRef(n.specification.Components.Schemas["Pets"]),
+		}
+
+		req, err := prepareRequest(tt.method, tt.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Accept", tt.accept)
+		if tt.contentType != "" {
+			body := `[{"id": 1, "name": "Pet 1"}]`
+			req.Header.Set("Content-Type", tt.contentType)
+			req.Body = io.NopCloser(strings.NewReader(body))
+			req.ContentLength = int64(len(body))
+		}
+
+		recorder := httptest.NewRecorder()
+		var api bodyAPI
+		if tt.method == "GET" {
+			n.ServeHTTP(recorder, req, &mockAPI{})
+		} else {
+			n.ServeHTTP(recorder, req, &api)
+		}
+
+		if status := recorder.Code; status != tt.wantStatus {
+			t.Errorf("handler returned wrong status code in test %s: got %v want %v", tt.name, status, tt.wantStatus)
+		}
+
+		if tt.wantStatus == http.StatusUnsupportedMediaType && recorder.Header().Get("Accept-Post") != "application/json" {
+			t.Errorf("expected the supported media types in the Accept-Post header: got %q", recorder.Header().Get("Accept-Post"))
+		}
+		if accept := recorder.Header().Get("Accept"); accept != "" {
+			t.Errorf("unexpected Accept response header in test %s: %q", tt.name, accept)
+		}
+	}
+}
+
+// plainAPI returns an empty plain text response
+type plainAPI struct{}
+
+// ServeHTTP writes the headers only
+func (m *plainAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) error {
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+func TestResponseContentType(t *testing.T) {
+	v, err := createValidator(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := prepareRequest("GET", "http://localhost:9443/api/pets/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := httptest.NewRecorder()
+	err = v.ServeHTTP(recorder, req, &plainAPI{})
+	if err == nil || !strings.Contains(err.Error(), `Content-Type has unexpected value: "text/plain"`) {
+		t.Errorf("expected an undocumented Content-Type to be an error: %v", err)
+	}
+
+	if status := recorder.Code; status != http.StatusInternalServerError {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusInternalServerError)
+	}
+}
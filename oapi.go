@@ -19,10 +19,10 @@ import (
 	"net/url"
 	"os"
 	"regexp"
+	"sort"
 	"strings"
 
 	"github.com/getkin/kin-openapi/openapi3"
-	"github.com/getkin/kin-openapi/openapi3filter"
 )
 
 // TODO: add some other functionality for wrapping kin-openapi / swagger functionality, like validation
@@ -89,16 +89,27 @@ func isValidOpenAPIUrl(str string) bool {
 	return err == nil
 }
 
-func formatFullError(err *openapi3filter.SecurityRequirementsError) error {
-
-	if len(err.Errors) == 0 {
-		return err
+// serverBasePaths returns the distinct base paths of the servers, longest first.
+// The empty base path is always included, so that it's tried last.
+func serverBasePaths(servers openapi3.Servers) []string {
+	seen := map[string]bool{"": true}
+	basePaths := []string{}
+	for _, s := range servers {
+		basePath, err := s.BasePath()
+		if err != nil {
+			continue
+		}
+		basePath = strings.TrimSuffix(basePath, "/")
+		if seen[basePath] {
+			continue
+		}
+		seen[basePath] = true
+		basePaths = append(basePaths, basePath)
 	}
 
-	r := "Compound error: (0) " + err.Errors[0].Error()
-	for i := 1; i < len(err.Errors); i++ {
-		r = strings.Join([]string{r, fmt.Sprintf("(%d) %s", i, err.Errors[i].Error())}, ", ")
-	}
+	sort.Slice(basePaths, func(i, j int) bool {
+		return len(basePaths[i]) > len(basePaths[j])
+	})
 
-	return fmt.Errorf(r)
+	return append(basePaths, "")
 }
@@ -0,0 +1,240 @@
+// Copyright 2020 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package openapi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+const (
+	oidcDiscoveryPath        = "/.well-known/openid-configuration"
+	maxOIDCDiscoverySize     = 1 << 20
+	oidcDiscoveryTimeout     = 10 * time.Second
+	defaultOIDCCacheDuration = 10 * time.Minute
+)
+
+// OpenIDConnect configures verification of tokens for openIdConnect security schemes. The
+// discovery document at the openIdConnectUrl of a scheme provides the issuer and the URL
+// of the JSON Web Key Set that tokens are verified with.
+type OpenIDConnect struct {
+	// The audiences that tokens are accepted for, like the client ID for ID tokens;
+	// the aud claim should contain one of them.
+	// Default is empty, resulting in the audience not being checked
+	Audiences []string `json:"audiences,omitempty"`
+	// Claims that tokens should have, with their values. A claim with a
+	// list of values should contain the value.
+	// Default is empty
+	RequiredClaims map[string]interface{} `json:"required_claims,omitempty"`
+	// Duration that the discovery document and the key set are cached.
+	// Default is 10m
+	CacheDuration caddy.Duration `json:"cache_duration,omitempty"`
+	// Leeway for checking the exp, nbf and iat claims, to account for clock skew.
+	// Default is 1m
+	Leeway caddy.Duration `json:"leeway,omitempty"`
+	// The signature algorithms that are accepted.
+	// Default is all RSA, RSA-PSS, ECDSA and EdDSA algorithms
+	Algorithms []string `json:"algorithms,omitempty"`
+}
+
+// validate checks the OpenIDConnect configuration
+func (o *OpenIDConnect) validate() error {
+	if o.CacheDuration < 0 {
+		return fmt.Errorf("openid connect cache duration can't be negative; got %s", time.Duration(o.CacheDuration))
+	}
+	if o.Leeway < 0 {
+		return fmt.Errorf("openid connect leeway can't be negative; got %s", time.Duration(o.Leeway))
+	}
+	for _, algorithm := range o.Algorithms {
+		if !contains(jwtAlgorithms, algorithm) {
+			return fmt.Errorf("openid connect algorithm %q is not supported", algorithm)
+		}
+	}
+	return nil
+}
+
+// oidcDocument holds the properties of an OpenID Connect discovery document that are used for verifying tokens
+type oidcDocument struct {
+	Issuer  string `json:"issuer"`
+	JWKSURI string `json:"jwks_uri"`
+}
+
+// oidcProviders holds the OpenID Connect providers by the URL of their discovery document
+type oidcProviders struct {
+	config *OpenIDConnect
+	client *http.Client
+	logger *zap.Logger
+
+	mu        sync.Mutex
+	providers map[string]*oidcProvider
+}
+
+// newOIDCProviders returns a new oidcProviders
+func newOIDCProviders(config *OpenIDConnect, logger *zap.Logger) *oidcProviders {
+	return &oidcProviders{
+		config:    config,
+		client:    http.DefaultClient,
+		logger:    logger,
+		providers: map[string]*oidcProvider{},
+	}
+}
+
+// verifier returns the jwtVerifier for the provider with the discovery document at the URL
+func (o *oidcProviders) verifier(ctx context.Context, url string) (*jwtVerifier, error) {
+	o.mu.Lock()
+	provider, ok := o.providers[url]
+	if !ok {
+		provider = &oidcProvider{url: url, providers: o, now: time.Now}
+		o.providers[url] = provider
+	}
+	o.mu.Unlock()
+	return provider.verifier(ctx)
+}
+
+// cacheDuration returns the duration that discovery documents and key sets are cached
+func (o *oidcProviders) cacheDuration() time.Duration {
+	if o.config.CacheDuration == 0 {
+		return defaultOIDCCacheDuration
+	}
+	return time.Duration(o.config.CacheDuration)
+}
+
+// oidcProvider is an OpenID Connect provider with a cached discovery document
+type oidcProvider struct {
+	url       string
+	providers *oidcProviders
+	now       func() time.Time
+
+	mu        sync.Mutex
+	document  *oidcDocument
+	fetchedAt time.Time
+	current   *jwtVerifier
+	err       error
+	// fetching is closed when the discovery document that is being fetched is done; nil when it's not being fetched
+	fetching chan struct{}
+}
+
+// verifier returns the jwtVerifier for the issuer and key set in the discovery document. The
+// discovery document is fetched again when the cache duration has passed; when that fails,
+// the cached document is used. The document is fetched by one request at a time, without
+// holding the lock, so that other requests can use the cached document in the meantime.
+func (p *oidcProvider) verifier(ctx context.Context) (*jwtVerifier, error) {
+
+	now := p.now()
+
+	p.mu.Lock()
+	if p.document != nil && now.Sub(p.fetchedAt) < p.providers.cacheDuration() {
+		defer p.mu.Unlock()
+		return p.current, nil
+	}
+	if fetching := p.fetching; fetching != nil {
+		if p.document != nil {
+			defer p.mu.Unlock()
+			return p.current, nil
+		}
+		p.mu.Unlock()
+		select {
+		case <-fetching:
+		case <-ctx.Done():
+			return nil, fmt.Errorf("openid connect discovery: %w", ctx.Err())
+		}
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if p.document == nil {
+			return nil, fmt.Errorf("openid connect discovery: %w", p.err)
+		}
+		return p.current, nil
+	}
+	fetching := make(chan struct{})
+	p.fetching = fetching
+	p.mu.Unlock()
+
+	// The document is shared by all requests, so fetching it isn't canceled with the request that triggered it
+	document, err := p.discover(context.Background())
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.fetching = nil
+	close(fetching)
+
+	p.err = err
+	switch {
+	case err != nil && p.document == nil:
+		return nil, fmt.Errorf("openid connect discovery: %w", err)
+	case err != nil:
+		p.providers.logger.Warn(fmt.Sprintf("openid connect discovery failed; using the cached document: %s", err))
+	case p.document == nil || *document != *p.document:
+		config := p.providers.config
+		keys := newJWKS(loadJWKSURL(p.providers.client, document.JWKSURI), p.providers.cacheDuration(), p.providers.logger)
+		p.current = newJWTVerifierWithKeys(&JWT{
+			Issuer:         document.Issuer,
+			Audiences:      config.Audiences,
+			Leeway:         config.Leeway,
+			Algorithms:     config.Algorithms,
+			RequiredClaims: config.RequiredClaims,
+		}, keys)
+		p.document = document
+	}
+	p.fetchedAt = now
+
+	return p.current, nil
+}
+
+// discover fetches the discovery document
+func (p *oidcProvider) discover(ctx context.Context) (*oidcDocument, error) {
+
+	ctx, cancel := context.WithTimeout(ctx, oidcDiscoveryTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := p.providers.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %s: unexpected status %d", p.url, resp.StatusCode)
+	}
+
+	document := &oidcDocument{}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxOIDCDiscoverySize)).Decode(document); err != nil {
+		return nil, fmt.Errorf("parsing discovery document: %w", err)
+	}
+	if document.Issuer == "" || document.JWKSURI == "" {
+		return nil, fmt.Errorf("discovery document at %s should have an issuer and a jwks_uri", p.url)
+	}
+
+	// The issuer should be the URL that the discovery document was retrieved from, without the well-known path
+	if strings.HasSuffix(p.url, oidcDiscoveryPath) && strings.TrimSuffix(document.Issuer, "/") != strings.TrimSuffix(strings.TrimSuffix(p.url, oidcDiscoveryPath), "/") {
+		return nil, fmt.Errorf("issuer %q doesn't match the discovery document URL %s", document.Issuer, p.url)
+	}
+
+	return document, nil
+}
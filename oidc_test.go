@@ -0,0 +1,236 @@
+// Copyright 2020 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package openapi
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"go.uber.org/zap/zaptest"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// oidcProviderStub is a stand-in OpenID Connect provider serving a discovery document and a key set
+type oidcProviderStub struct {
+	*httptest.Server
+	key         jose.JSONWebKey
+	issuer      string
+	discoveries int32
+	keySets     int32
+}
+
+// newOIDCProviderStub starts a new oidcProviderStub
+func newOIDCProviderStub(t *testing.T) *oidcProviderStub {
+	stub := &oidcProviderStub{key: generateKey(t, "oidc-key")}
+	mux := http.NewServeMux()
+	mux.HandleFunc(oidcDiscoveryPath, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&stub.discoveries, 1)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                                stub.issuer,
+			"jwks_uri":                              stub.URL + "/keys",
+			"id_token_signing_alg_values_supported": []string{"ES256"},
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&stub.keySets, 1)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{stub.key.Public()}})
+	})
+	stub.Server = httptest.NewServer(mux)
+	stub.issuer = stub.URL
+	t.Cleanup(stub.Close)
+	return stub
+}
+
+func TestOpenIDConnectServeHTTP(t *testing.T) {
+
+	provider := newOIDCProviderStub(t)
+
+	claims := jwt.Claims{
+		Subject:  "alice",
+		Issuer:   provider.issuer,
+		Audience: jwt.Audience{"petstore-client"},
+		Expiry:   jwt.NewNumericDate(time.Now().Add(time.Hour)),
+	}
+	otherIssuer := claims
+	otherIssuer.Issuer = "https://other.example.com"
+
+	tests := []struct {
+		name       string
+		token      string
+		wantStatus int
+	}{
+		{name: "valid", token: signToken(t, provider.key, claims, map[string]interface{}{"scope": "openid pets:read", "email_verified": true}), wantStatus: http.StatusOK},
+		{name: "missing scope", token: signToken(t, provider.key, claims, map[string]interface{}{"scope": "openid", "email_verified": true}), wantStatus: http.StatusForbidden},
+		{name: "missing claim", token: signToken(t, provider.key, claims, map[string]interface{}{"scope": "openid pets:read", "email_verified": false}), wantStatus: http.StatusUnauthorized},
+		{name: "other issuer", token: signToken(t, provider.key, otherIssuer, map[string]interface{}{"scope": "openid pets:read", "email_verified": true}), wantStatus: http.StatusUnauthorized},
+	}
+
+	v, err := createValidator(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v.OpenIDConnect = &OpenIDConnect{
+		Audiences:      []string{"petstore-client"},
+		RequiredClaims: map[string]interface{}{"email_verified": true},
+	}
+	n, err := replaceValidator(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.specification.Components.SecuritySchemes = openapi3.SecuritySchemes{
+		"OIDC": &openapi3.SecuritySchemeRef{Value: &openapi3.SecurityScheme{Type: "openIdConnect", OpenIdConnectUrl: provider.URL + oidcDiscoveryPath}},
+	}
+	n.specification.Security = openapi3.SecurityRequirements{{"OIDC": []string{"pets:read"}}}
+
+	for _, tt := range tests {
+		req, err := prepareRequest("GET", "http://localhost:9443/api/pets/1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+tt.token)
+
+		recorder := httptest.NewRecorder()
+		n.ServeHTTP(recorder, req, &mockAPI{})
+
+		if status := recorder.Code; status != tt.wantStatus {
+			t.Errorf("handler returned wrong status code in test %s: got %v want %v", tt.name, status, tt.wantStatus)
+		}
+	}
+
+	// The discovery document and the key set are cached
+	if discoveries := atomic.LoadInt32(&provider.discoveries); discoveries != 1 {
+		t.Errorf("unexpected number of discovery requests: got %d want %d", discoveries, 1)
+	}
+	if keySets := atomic.LoadInt32(&provider.keySets); keySets != 1 {
+		t.Errorf("unexpected number of key set requests: got %d want %d", keySets, 1)
+	}
+}
+
+func TestOpenIDConnectDiscovery(t *testing.T) {
+
+	provider := newOIDCProviderStub(t)
+	providers := newOIDCProviders(&OpenIDConnect{CacheDuration: 0}, zaptest.NewLogger(t))
+
+	now := time.Now()
+	p := &oidcProvider{url: provider.URL + oidcDiscoveryPath, providers: providers, now: func() time.Time { return now }}
+
+	first, err := p.verifier(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The discovery document is fetched again after the cache duration; an unchanged document keeps the verifier and its cached keys
+	now = now.Add(defaultOIDCCacheDuration)
+	second, err := p.verifier(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != second {
+		t.Error("expected the verifier to be kept for an unchanged discovery document")
+	}
+	if discoveries := atomic.LoadInt32(&provider.discoveries); discoveries != 2 {
+		t.Errorf("unexpected number of discovery requests: got %d want %d", discoveries, 2)
+	}
+
+	// A failing provider results in the cached document being used
+	provider.Close()
+	now = now.Add(defaultOIDCCacheDuration)
+	if third, err := p.verifier(context.Background()); err != nil || third != first {
+		t.Errorf("expected the cached verifier to be used: %v", err)
+	}
+
+	// An issuer that doesn't match the discovery URL is rejected
+	mismatch := newOIDCProviderStub(t)
+	mismatch.issuer = "https://other.example.com"
+	p = &oidcProvider{url: mismatch.URL + oidcDiscoveryPath, providers: providers, now: time.Now}
+	if _, err := p.verifier(context.Background()); err == nil {
+		t.Error("expected an error for an issuer that doesn't match the discovery URL")
+	}
+}
+
+func TestOpenIDConnectDiscoveryDoesNotBlock(t *testing.T) {
+
+	var discoveries int32
+	started := make(chan struct{})
+	release := make(chan struct{})
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&discoveries, 1) > 1 {
+			// The second discovery is slow
+			close(started)
+			<-release
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"issuer": server.URL, "jwks_uri": server.URL + "/keys"})
+	}))
+	t.Cleanup(server.Close)
+
+	now := time.Now()
+	var mu sync.Mutex
+	clock := func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return now
+	}
+	providers := newOIDCProviders(&OpenIDConnect{}, zaptest.NewLogger(t))
+	p := &oidcProvider{url: server.URL + oidcDiscoveryPath, providers: providers, now: clock}
+	first, err := p.verifier(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The cached document expires; the first request fetches it again, while others use the cached document
+	mu.Lock()
+	now = now.Add(defaultOIDCCacheDuration)
+	mu.Unlock()
+	done := make(chan error)
+	go func() {
+		_, err := p.verifier(context.Background())
+		done <- err
+	}()
+	<-started
+
+	cached := make(chan *jwtVerifier)
+	go func() {
+		second, _ := p.verifier(context.Background())
+		cached <- second
+	}()
+	select {
+	case second := <-cached:
+		if second != first {
+			t.Error("expected the cached verifier to be used while the document is fetched")
+		}
+	case <-time.After(time.Second):
+		t.Error("expected the cached verifier to be used without waiting for the document")
+	}
+
+	close(release)
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+	if got := atomic.LoadInt32(&discoveries); got != 2 {
+		t.Errorf("unexpected number of discovery requests: got %d want %d", got, 2)
+	}
+}
@@ -21,5 +21,7 @@ import "github.com/getkin/kin-openapi/openapi3filter"
 type validatorOptions struct {
 	Options      openapi3filter.Options
 	ParamDecoder openapi3filter.ContentParameterDecoder
+	// AuthenticationFunc is used when validating security requirements
+	AuthenticationFunc openapi3filter.AuthenticationFunc
 	// TODO: additional options to be used in validation?
 }
@@ -0,0 +1,219 @@
+// Copyright 2020 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package openapi
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"os"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// responseRecorder records a response, so that it can be validated before it's written.
+// It works like the caddyhttp.ResponseRecorder, but limits the size of the response that
+// is buffered in memory. When a response grows larger than the limit, it is either spilled
+// to a temporary file, or the part that was buffered is written and the rest of the
+// response is streamed to the underlying ResponseWriter directly.
+type responseRecorder struct {
+	*caddyhttp.ResponseWriterWrapper
+	statusCode   int
+	wroteHeader  bool
+	shouldBuffer caddyhttp.ShouldBufferFunc
+	buf          *bytes.Buffer
+	limit        int64
+	spill        bool
+	spillDir     string
+	file         *os.File
+	size         int64
+	stream       bool
+	overflowed   bool
+	tap          io.Writer
+}
+
+// newResponseRecorder returns a new responseRecorder. A limit of 0 means the
+// size of the buffered response is not limited.
+func newResponseRecorder(w http.ResponseWriter, buf *bytes.Buffer, shouldBuffer caddyhttp.ShouldBufferFunc, limit int64, spill bool, spillDir string) *responseRecorder {
+	return &responseRecorder{
+		ResponseWriterWrapper: &caddyhttp.ResponseWriterWrapper{ResponseWriter: w},
+		buf:                   buf,
+		shouldBuffer:          shouldBuffer,
+		limit:                 limit,
+		spill:                 spill,
+		spillDir:              spillDir,
+	}
+}
+
+// WriteHeader writes the headers with statusCode to the wrapped
+// ResponseWriter unless the response is to be buffered instead.
+// 1xx responses are never buffered.
+func (rr *responseRecorder) WriteHeader(statusCode int) {
+	if rr.wroteHeader {
+		return
+	}
+
+	rr.statusCode = statusCode
+
+	// 1xx responses aren't final; just informational
+	if statusCode < 100 || statusCode > 199 {
+		rr.wroteHeader = true
+		rr.stream = rr.shouldBuffer == nil || !rr.shouldBuffer(rr.statusCode, rr.ResponseWriterWrapper.Header())
+	}
+
+	// if informational or not buffered, immediately write header
+	if rr.stream || (100 <= statusCode && statusCode <= 199) {
+		rr.ResponseWriterWrapper.WriteHeader(statusCode)
+	}
+}
+
+func (rr *responseRecorder) Write(data []byte) (int, error) {
+	rr.WriteHeader(http.StatusOK)
+
+	if !rr.stream && rr.file == nil && rr.limit > 0 && rr.size+int64(len(data)) > rr.limit {
+		if err := rr.overflow(); err != nil {
+			return 0, err
+		}
+	}
+
+	var n int
+	var err error
+	switch {
+	case rr.stream:
+		n, err = rr.ResponseWriterWrapper.Write(data)
+		if rr.tap != nil {
+			rr.tap.Write(data[:n])
+		}
+	case rr.file != nil:
+		n, err = rr.file.Write(data)
+	default:
+		n, err = rr.buf.Write(data)
+	}
+
+	rr.size += int64(n)
+	return n, err
+}
+
+// ReadFrom makes sure that data read from r goes through Write, so that the limit is respected
+func (rr *responseRecorder) ReadFrom(r io.Reader) (int64, error) {
+	return io.Copy(struct{ io.Writer }{rr}, r)
+}
+
+// overflow is called when the buffered response grows larger than the limit
+func (rr *responseRecorder) overflow() error {
+	rr.overflowed = true
+
+	if rr.spill {
+		file, err := os.CreateTemp(rr.spillDir, "openapi-validator-response-*")
+		if err != nil {
+			return err
+		}
+		rr.file = file
+		_, err = rr.buf.WriteTo(file)
+		return err
+	}
+
+	// Write what was buffered so far and stream the rest of the response
+	rr.stream = true
+	rr.ResponseWriterWrapper.WriteHeader(rr.statusCode)
+	_, err := rr.buf.WriteTo(rr.ResponseWriterWrapper)
+	return err
+}
+
+// Flush flushes the streamed response to the client. While the response is buffered, it's a no-op,
+// because nothing has been written to the client yet.
+func (rr *responseRecorder) Flush() {
+	if !rr.stream {
+		return
+	}
+	http.NewResponseController(rr.ResponseWriterWrapper).Flush()
+}
+
+// Hijack hijacks the connection of the underlying ResponseWriter. A response that was
+// buffered before the connection was hijacked isn't written.
+func (rr *responseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(rr.ResponseWriterWrapper).Hijack()
+}
+
+// Tap sets a writer that receives a copy of the response body when it's streamed.
+func (rr *responseRecorder) Tap(w io.Writer) {
+	rr.tap = w
+}
+
+// Status returns the status code that was written, if any.
+func (rr *responseRecorder) Status() int {
+	return rr.statusCode
+}
+
+// Size returns the number of bytes written, not including the response headers.
+func (rr *responseRecorder) Size() int64 {
+	return rr.size
+}
+
+// Buffered returns whether the complete response was recorded.
+func (rr *responseRecorder) Buffered() bool {
+	return !rr.stream
+}
+
+// Overflowed returns whether the response grew larger than the limit.
+func (rr *responseRecorder) Overflowed() bool {
+	return rr.overflowed
+}
+
+// Spilled returns whether the response was spilled to a temporary file.
+func (rr *responseRecorder) Spilled() bool {
+	return rr.file != nil
+}
+
+// Body returns a reader for the recorded response body.
+func (rr *responseRecorder) Body() (io.Reader, error) {
+	if rr.file == nil {
+		return bytes.NewReader(rr.buf.Bytes()), nil
+	}
+	if _, err := rr.file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return rr.file, nil
+}
+
+// WriteResponse writes the recorded response to the underlying ResponseWriter.
+func (rr *responseRecorder) WriteResponse() error {
+	if rr.stream {
+		return nil
+	}
+	if rr.statusCode == 0 {
+		// could happen if no handlers actually wrote anything,
+		// and this prevents a panic; status must be > 0
+		rr.statusCode = http.StatusOK
+	}
+	body, err := rr.Body()
+	if err != nil {
+		return err
+	}
+	rr.ResponseWriterWrapper.WriteHeader(rr.statusCode)
+	_, err = io.Copy(rr.ResponseWriterWrapper, body)
+	return err
+}
+
+// Close removes the temporary file the response was spilled to, if any.
+func (rr *responseRecorder) Close() error {
+	if rr.file == nil {
+		return nil
+	}
+	rr.file.Close()
+	return os.Remove(rr.file.Name())
+}
@@ -31,7 +31,22 @@ func (v *Validator) validateRequest(rw http.ResponseWriter, r *http.Request, val
 
 	requestContext := r.Context() // TODO: add things to the request context, if required?
 
+	// Compressed request bodies are validated after decoding them; the original body is forwarded
+	excludeBody := validationInput.Options != nil && validationInput.Options.ExcludeRequestBody
+	if encodings := contentEncodings(r.Header); len(encodings) > 0 && !excludeBody && r.Body != nil && r.Body != http.NoBody {
+		decodedRequest, oerr := v.decodeRequest(r, encodings)
+		if oerr != nil {
+			return oerr
+		}
+		decodedInput := *validationInput
+		decodedInput.Request = decodedRequest
+		validationInput = &decodedInput
+	}
+
 	err := openapi3filter.ValidateRequest(requestContext, validationInput)
+	if oerr := requestTooLarge(err); oerr != nil {
+		return oerr
+	}
 	if err != nil {
 		switch e := err.(type) {
 		case *openapi3filter.RequestError:
@@ -41,14 +56,7 @@ func (v *Validator) validateRequest(rw http.ResponseWriter, r *http.Request, val
 				Code:     http.StatusBadRequest,
 				Message:  errorLines[0],
 				Internal: err,
-			}
-		case *openapi3filter.SecurityRequirementsError:
-			if v.shouldValidateSecurity() {
-				return &oapiError{
-					Code:     http.StatusForbidden, // TOOD: is this the right code? The validator is not the authorizing party.
-					Message:  formatFullError(e),
-					Internal: err,
-				}
+				phase:    phaseRequest,
 			}
 		default:
 			// Fallback for unexpected or unimplemented cases
@@ -56,9 +64,70 @@ func (v *Validator) validateRequest(rw http.ResponseWriter, r *http.Request, val
 				Code:     http.StatusInternalServerError,
 				Message:  fmt.Sprintf("error validating request: %s", err),
 				Internal: err,
+				phase:    phaseRequest,
 			}
 		}
 	}
 
 	return nil
 }
+
+// validateSecurity validates the security requirements for an HTTP request according to an OpenAPI spec
+func (v *Validator) validateSecurity(r *http.Request, validationInput *openapi3filter.RequestValidationInput) *oapiError {
+
+	route := validationInput.Route
+	security := route.Operation.Security
+	if security == nil {
+		// Use the global security requirements if there are none for the operation
+		security = &route.Spec.Security
+	}
+
+	// Requests are validated without authentication, so the actual authentication
+	// function is only used when validating the security requirements.
+	e := v.validateSecurityRequirements(r.Context(), validationInput, *security)
+	if e == nil {
+		return nil
+	}
+
+	var tokenErr *tokenError
+	var scopeErr *scopeError
+	var credentialsErr *credentialsError
+	switch {
+	case e.failedWith(&tokenErr):
+		// Invalid bearer tokens are rejected as described in RFC 6750
+		return &oapiError{
+			Code:     http.StatusUnauthorized,
+			Message:  e.Error(),
+			Internal: e,
+			phase:    phaseSecurity,
+			header:   http.Header{"Www-Authenticate": []string{`Bearer error="invalid_token"`}},
+		}
+	case e.failedWith(&credentialsErr):
+		header := http.Header{}
+		if credentialsErr.challenge != "" {
+			header.Set("Www-Authenticate", credentialsErr.challenge)
+		}
+		return &oapiError{
+			Code:     http.StatusUnauthorized,
+			Message:  e.Error(),
+			Internal: e,
+			phase:    phaseSecurity,
+			header:   header,
+		}
+	case e.failedWith(&scopeErr):
+		return &oapiError{
+			Code:     http.StatusForbidden,
+			Message:  e.Error(),
+			Internal: e,
+			phase:    phaseSecurity,
+			header:   http.Header{"Www-Authenticate": []string{fmt.Sprintf(`Bearer error="insufficient_scope", scope="%s"`, strings.Join(scopeErr.required, " "))}},
+		}
+	}
+
+	return &oapiError{
+		Code:     http.StatusForbidden, // TOOD: is this the right code? The validator is not the authorizing party.
+		Message:  e.Error(),
+		Internal: e,
+		phase:    phaseSecurity,
+	}
+}
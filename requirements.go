@@ -0,0 +1,168 @@
+// Copyright 2020 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package openapi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+)
+
+// requirementError is the reason that a security requirement is not satisfied
+type requirementError struct {
+	// schemes are the names of the schemes in the requirement, which should all be satisfied
+	schemes []string
+	// scheme is the name of the scheme that is not satisfied
+	scheme string
+	err    error
+}
+
+func (e *requirementError) Error() string {
+	if len(e.schemes) == 1 {
+		return fmt.Sprintf("%s: %s", e.scheme, e.err)
+	}
+	return fmt.Sprintf("%s: %s failed: %s", strings.Join(e.schemes, " and "), e.scheme, e.err)
+}
+
+func (e *requirementError) Unwrap() error {
+	return e.err
+}
+
+// securityError is the error for a request that satisfies none of the alternative security
+// requirements of its operation. It holds the reason for each requirement that was tried.
+type securityError struct {
+	requirements []*requirementError
+}
+
+func (e *securityError) Error() string {
+	if len(e.requirements) == 1 {
+		return fmt.Sprintf("security requirement not satisfied: %s", e.requirements[0])
+	}
+	reasons := make([]string, 0, len(e.requirements))
+	for i, requirement := range e.requirements {
+		reasons = append(reasons, fmt.Sprintf("(%d) %s", i+1, requirement))
+	}
+	return fmt.Sprintf("none of the %d alternative security requirements is satisfied: %s", len(e.requirements), strings.Join(reasons, "; "))
+}
+
+// failedWith returns whether one of the security requirements failed with an error that
+// matches the target, which is set to that error like errors.As does
+func (e *securityError) failedWith(target interface{}) bool {
+	for _, requirement := range e.requirements {
+		if errors.As(requirement, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateSecurityRequirements validates the alternative security requirements in order and returns
+// nil for the first requirement that is satisfied, which is when all of its schemes are satisfied.
+// An empty list of requirements, or an empty requirement, doesn't require authentication. Placeholders
+// are only set for the requirement that is satisfied.
+func (v *Validator) validateSecurityRequirements(ctx context.Context, input *openapi3filter.RequestValidationInput, requirements openapi3.SecurityRequirements) *securityError {
+
+	if len(requirements) == 0 {
+		return nil
+	}
+
+	var schemes openapi3.SecuritySchemes
+	if components := input.Route.Spec.Components; components != nil {
+		schemes = components.SecuritySchemes
+	}
+
+	e := &securityError{}
+	for _, requirement := range requirements {
+		staged := placeholders{}
+		stagedInput := *input
+		stagedInput.Request = input.Request.WithContext(context.WithValue(input.Request.Context(), placeholdersCtxKey{}, staged))
+		err := v.validateSecurityRequirement(ctx, &stagedInput, schemes, requirement)
+		// Schemes that read the body, like signed requests, replace it; the replacement should be used from now on
+		input.Request.Body = stagedInput.Request.Body
+		if err != nil {
+			e.requirements = append(e.requirements, err)
+			continue
+		}
+		staged.apply(input.Request)
+		return nil
+	}
+
+	return e
+}
+
+// validateSecurityRequirement validates that all schemes of the security requirement are satisfied.
+// Schemes are validated in order of their names; validation stops at the first scheme that is not satisfied.
+func (v *Validator) validateSecurityRequirement(ctx context.Context, input *openapi3filter.RequestValidationInput, schemes openapi3.SecuritySchemes, requirement openapi3.SecurityRequirement) *requirementError {
+
+	names := make([]string, 0, len(requirement))
+	for name := range requirement {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		ref := schemes[name]
+		if ref == nil || ref.Value == nil {
+			return &requirementError{schemes: names, scheme: name, err: fmt.Errorf("security scheme %q is not declared", name)}
+		}
+		err := v.options.AuthenticationFunc(ctx, &openapi3filter.AuthenticationInput{
+			RequestValidationInput: input,
+			SecuritySchemeName:     name,
+			SecurityScheme:         ref.Value,
+			Scopes:                 requirement[name],
+		})
+		if err != nil {
+			return &requirementError{schemes: names, scheme: name, err: err}
+		}
+	}
+
+	return nil
+}
+
+// placeholders are placeholders that are staged while a security requirement is validated
+type placeholders map[string]interface{}
+
+// placeholdersCtxKey is the context key for the placeholders staged for a request
+type placeholdersCtxKey struct{}
+
+// apply sets the staged placeholders on the replacer of the request
+func (p placeholders) apply(r *http.Request) {
+	replacer, ok := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	if !ok {
+		return
+	}
+	for key, value := range p {
+		replacer.Set(key, value)
+	}
+}
+
+// setPlaceholder sets a placeholder for the request. While a security requirement is validated,
+// the placeholder is staged until all schemes of the requirement are satisfied.
+func setPlaceholder(r *http.Request, key string, value interface{}) {
+	if staged, ok := r.Context().Value(placeholdersCtxKey{}).(placeholders); ok {
+		staged[key] = value
+		return
+	}
+	if replacer, ok := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer); ok {
+		replacer.Set(key, value)
+	}
+}
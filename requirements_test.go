@@ -0,0 +1,159 @@
+// Copyright 2020 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package openapi
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/getkin/kin-openapi/openapi3"
+)
+
+func TestSecurityRequirements(t *testing.T) {
+
+	tests := []struct {
+		name         string
+		global       openapi3.SecurityRequirements
+		operation    *openapi3.SecurityRequirements
+		apiKey       string
+		basicAuth    bool
+		wantStatus   int
+		wantUser     string
+		wantMessages []string
+	}{
+		{
+			name:       "first alternative",
+			global:     openapi3.SecurityRequirements{{"ApiKey": {}}, {"BasicAuth": {}}},
+			apiKey:     "billing-key",
+			wantStatus: http.StatusOK,
+			wantUser:   "billing",
+		},
+		{
+			name:       "second alternative",
+			global:     openapi3.SecurityRequirements{{"ApiKey": {}}, {"BasicAuth": {}}},
+			basicAuth:  true,
+			wantStatus: http.StatusOK,
+			wantUser:   "alice",
+		},
+		{
+			name:         "no alternative",
+			global:       openapi3.SecurityRequirements{{"ApiKey": {}}, {"BasicAuth": {}}},
+			apiKey:       "unknown-key",
+			wantStatus:   http.StatusUnauthorized,
+			wantMessages: []string{"none of the 2 alternative security requirements is satisfied", "(1) ApiKey: invalid credentials: unknown api key", "(2) BasicAuth: invalid credentials"},
+		},
+		{
+			// Schemes are validated in order of their names; the identity of the last one is used
+			name:       "all schemes of a requirement",
+			global:     openapi3.SecurityRequirements{{"ApiKey": {}, "BasicAuth": {}}},
+			apiKey:     "billing-key",
+			basicAuth:  true,
+			wantStatus: http.StatusOK,
+			wantUser:   "alice",
+		},
+		{
+			name:         "one scheme of a requirement",
+			global:       openapi3.SecurityRequirements{{"ApiKey": {}, "BasicAuth": {}}},
+			apiKey:       "billing-key",
+			wantStatus:   http.StatusUnauthorized,
+			wantMessages: []string{"security requirement not satisfied: ApiKey and BasicAuth: BasicAuth failed"},
+		},
+		{
+			name:       "partially satisfied requirement before satisfied requirement",
+			global:     openapi3.SecurityRequirements{{"ApiKey": {}, "Token": {}}, {"BasicAuth": {}}},
+			apiKey:     "billing-key",
+			basicAuth:  true,
+			wantStatus: http.StatusOK,
+			wantUser:   "alice",
+		},
+		{
+			name:         "undeclared scheme",
+			global:       openapi3.SecurityRequirements{{"Unknown": {}}},
+			wantStatus:   http.StatusForbidden,
+			wantMessages: []string{`Unknown: security scheme "Unknown" is not declared`},
+		},
+		{
+			name:       "optional authentication",
+			global:     openapi3.SecurityRequirements{{"ApiKey": {}}, {}},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "no authentication for operation",
+			global:     openapi3.SecurityRequirements{{"ApiKey": {}}},
+			operation:  &openapi3.SecurityRequirements{},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "requirements of operation",
+			global:     openapi3.SecurityRequirements{{"ApiKey": {}}},
+			operation:  &openapi3.SecurityRequirements{{"BasicAuth": {}}},
+			basicAuth:  true,
+			wantStatus: http.StatusOK,
+			wantUser:   "alice",
+		},
+	}
+
+	for _, tt := range tests {
+		v, err := createValidator(t)
+		if err != nil {
+			t.Fatal(err)
+		}
+		v.APIKeys = &APIKeys{Keys: []APIKey{{Key: "billing-key", Client: "billing"}}}
+		v.BasicAuth = &BasicAuth{Accounts: []BasicAuthAccount{{Username: "alice", Password: hashPassword(t, "alice-secret")}}}
+		n, err := replaceValidator(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n.specification.Components.SecuritySchemes = openapi3.SecuritySchemes{
+			"ApiKey":    &openapi3.SecuritySchemeRef{Value: &openapi3.SecurityScheme{Type: "apiKey", In: "header", Name: "X-API-Key"}},
+			"BasicAuth": &openapi3.SecuritySchemeRef{Value: &openapi3.SecurityScheme{Type: "http", Scheme: "basic"}},
+			"Token":     &openapi3.SecuritySchemeRef{Value: &openapi3.SecurityScheme{Type: "apiKey", In: "header", Name: "X-Token"}},
+		}
+		n.specification.Security = tt.global
+		n.specification.Paths["/pets/{petId}"].Get.Security = tt.operation
+
+		req, err := prepareRequest("GET", "http://localhost:9443/api/pets/1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.apiKey != "" {
+			req.Header.Set("X-API-Key", tt.apiKey)
+		}
+		if tt.basicAuth {
+			req.SetBasicAuth("alice", "alice-secret")
+		}
+
+		recorder := httptest.NewRecorder()
+		n.ServeHTTP(recorder, req, &mockAPI{})
+
+		if status := recorder.Code; status != tt.wantStatus {
+			t.Errorf("handler returned wrong status code in test %s: got %v want %v", tt.name, status, tt.wantStatus)
+		}
+
+		replacer := req.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+		if user, _ := replacer.GetString(ReplacerHTTPAuthUserID); user != tt.wantUser {
+			t.Errorf("unexpected user placeholder in test %s: got %q want %q", tt.name, user, tt.wantUser)
+		}
+		message, _ := replacer.GetString(ReplacerOpenAPIValidatorErrorMessage)
+		for _, want := range tt.wantMessages {
+			if !strings.Contains(message, want) {
+				t.Errorf("error message in test %s doesn't contain %q: %s", tt.name, want, message)
+			}
+		}
+	}
+}
@@ -15,37 +15,78 @@
 package openapi
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"strings"
 
-	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
 	"github.com/getkin/kin-openapi/openapi3filter"
 )
 
-// validateResponse validates an HTTP response against an OpenAPI spec
-func (v *Validator) validateResponse(rr caddyhttp.ResponseRecorder, request *http.Request, requestValidationInput *openapi3filter.RequestValidationInput) *oapiError {
+// validateResponse validates an HTTP response against an OpenAPI spec. The size of the body
+// should be provided, or be negative when it's unknown. An empty body is not validated.
+func (v *Validator) validateResponse(ctx context.Context, status int, header http.Header, body io.Reader, size int64, requestValidationInput *openapi3filter.RequestValidationInput) *oapiError {
+
+	if bodyless(requestValidationInput, status) {
+		size = 0
+	}
+
+	// Responses to HEAD requests without a HEAD operation are validated against the GET operation
+	if isHeadAsGet(requestValidationInput) {
+		requestValidationInput = asGet(requestValidationInput)
+	}
+
+	// The Content-Type is checked for every response, including the ones without a body
+	if oerr := validateResponseContentType(status, header, requestValidationInput); oerr != nil {
+		return oerr
+	}
+
+	// The options are copied, so that changing them doesn't affect other responses
+	options := v.options.Options
 
 	responseValidationInput := &openapi3filter.ResponseValidationInput{
 		RequestValidationInput: requestValidationInput,
-		Status:                 rr.Status(),
-		Header:                 rr.Header(),
-		Options:                &v.options.Options,
+		Status:                 documentedStatus(requestValidationInput, status),
+		Header:                 header,
+		Options:                &options,
+	}
+
+	// Compressed response bodies are validated after decoding them
+	if encodings := contentEncodings(header); len(encodings) > 0 && size != 0 {
+		decoded, err := v.decodeBody(encodings, body)
+		switch {
+		case errors.Is(err, errUnsupportedEncoding), errors.Is(err, errDecompressedTooLarge):
+			// The body can't be validated, but that doesn't make the response invalid
+			v.logger.Debug(fmt.Sprintf("not validating response body: %s", err))
+			size = 0
+		case err != nil:
+			return &oapiError{
+				Code:     http.StatusInternalServerError,
+				Message:  fmt.Sprintf("response body has an error: decoding failed: %s", err),
+				Internal: err,
+				phase:    phaseResponse,
+			}
+		default:
+			body, size = bytes.NewReader(decoded), int64(len(decoded))
+		}
+		header = header.Clone()
+		header.Del("Content-Encoding")
 	}
 
-	body := rr.Buffer().Bytes()
-	responseValidationInput.SetBodyBytes(body)
+	responseValidationInput.Header = header
+	responseValidationInput.Body = io.NopCloser(body)
 
-	if len(body) == 0 {
+	if size == 0 {
 		// In case the response body is empty, we exclude it from being validated
-		responseValidationInput.Options.ExcludeResponseBody = true
+		options.ExcludeResponseBody = true
 	}
 
 	v.logger.Debug(fmt.Sprintf("%#v", responseValidationInput))
 
-	requestContext := request.Context()
-
-	err := openapi3filter.ValidateResponse(requestContext, responseValidationInput)
+	err := openapi3filter.ValidateResponse(ctx, responseValidationInput)
 	if err != nil {
 		// TODO: do something with different cases (switch) and return an error (overwrite http status code, if possible?)
 		switch e := err.(type) {
@@ -56,6 +97,7 @@ func (v *Validator) validateResponse(rr caddyhttp.ResponseRecorder, request *htt
 				Code:     http.StatusInternalServerError,
 				Message:  errorLines[0],
 				Internal: err,
+				phase:    phaseResponse,
 			}
 		default:
 			// Fallback for unexpected or unimplemented cases
@@ -63,6 +105,7 @@ func (v *Validator) validateResponse(rr caddyhttp.ResponseRecorder, request *htt
 				Code:     http.StatusInternalServerError,
 				Message:  fmt.Sprintf("error validating response: %s", err),
 				Internal: err,
+				phase:    phaseResponse,
 			}
 		}
 	}
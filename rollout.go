@@ -0,0 +1,190 @@
+// Copyright 2020 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package openapi
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net"
+	"net/http"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/getkin/kin-openapi/openapi3"
+)
+
+const (
+	// ReplacerOpenAPIValidatorRolloutBucket is a Caddy Replacer key for storing the rollout bucket of a request
+	ReplacerOpenAPIValidatorRolloutBucket = "openapi_validator.rollout.bucket"
+)
+
+const (
+	rolloutKeyIP     = "ip"
+	rolloutKeyAPIKey = "api_key"
+	rolloutKeyHeader = "header"
+
+	rolloutBucketEnforced   = "enforced"
+	rolloutBucketReportOnly = "report_only"
+
+	// rolloutBuckets is the number of buckets client keys are hashed into,
+	// allowing percentages to be configured with two decimals.
+	rolloutBuckets = 10000
+)
+
+// Rollout configures gradual enforcement of the OpenAPI specification. Only the
+// configured share of requests is enforced; the remaining requests are only reported.
+// Whether a request is enforced is determined by hashing a client key, so that a
+// specific client consistently falls in the same bucket.
+type Rollout struct {
+	// Percentage of requests (0-100) for which validation is enforced
+	Percentage float64 `json:"percentage"`
+	// The client key that determines the bucket of a request: ip, api_key or header.
+	// When using api_key, the first API key found for the apiKey security schemes
+	// in the OpenAPI specification is used. When the key is empty, the client IP
+	// is used instead.
+	// Default is ip
+	Key string `json:"key,omitempty"`
+	// The name of the header to use as client key when Key is header
+	Header string `json:"header,omitempty"`
+}
+
+// validate checks the Rollout configuration
+func (ro *Rollout) validate() error {
+	if ro.Percentage < 0 || ro.Percentage > 100 {
+		return fmt.Errorf("rollout percentage should be between 0 and 100; got %v", ro.Percentage)
+	}
+	switch ro.Key {
+	case "", rolloutKeyIP, rolloutKeyAPIKey:
+	case rolloutKeyHeader:
+		if ro.Header == "" {
+			return fmt.Errorf("rollout by header requires a header name")
+		}
+	default:
+		return fmt.Errorf("invalid rollout key %q", ro.Key)
+	}
+	return nil
+}
+
+// rolloutBucket returns the rollout bucket the request falls in
+func (v *Validator) rolloutBucket(r *http.Request) string {
+
+	if v.Rollout.Percentage >= 100 {
+		return rolloutBucketEnforced
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(v.rolloutKey(r)))
+	if float64(h.Sum32()%rolloutBuckets) < v.Rollout.Percentage*rolloutBuckets/100 {
+		return rolloutBucketEnforced
+	}
+
+	return rolloutBucketReportOnly
+}
+
+// rolloutKey returns the client key used for determining the rollout bucket
+func (v *Validator) rolloutKey(r *http.Request) string {
+
+	key := ""
+	switch v.Rollout.Key {
+	case rolloutKeyHeader:
+		key = r.Header.Get(v.Rollout.Header)
+	case rolloutKeyAPIKey:
+		key = apiKeyFromRequest(r, v.apiKeySchemes)
+	}
+
+	if key != "" {
+		return key
+	}
+
+	return clientIP(r)
+}
+
+// clientIP returns the client IP as determined by Caddy, falling back to the remote address
+func clientIP(r *http.Request) string {
+	if ip, ok := caddyhttp.GetVar(r.Context(), caddyhttp.ClientIPVarKey).(string); ok && ip != "" {
+		return ip
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// apiKeySecuritySchemes returns the apiKey security schemes in the OpenAPI specification
+func apiKeySecuritySchemes(specification *openapi3.T) []*openapi3.SecurityScheme {
+	schemes := []*openapi3.SecurityScheme{}
+	if specification.Components == nil {
+		return schemes
+	}
+	for _, ref := range specification.Components.SecuritySchemes {
+		if ref != nil && ref.Value != nil && ref.Value.Type == "apiKey" {
+			schemes = append(schemes, ref.Value)
+		}
+	}
+	return schemes
+}
+
+// apiKeyFromRequest returns the first API key found in the request for the provided schemes
+func apiKeyFromRequest(r *http.Request, schemes []*openapi3.SecurityScheme) string {
+	for _, scheme := range schemes {
+		switch scheme.In {
+		case "query":
+			if key := r.URL.Query().Get(scheme.Name); key != "" {
+				return key
+			}
+		case "header":
+			if key := r.Header.Get(scheme.Name); key != "" {
+				return key
+			}
+		case "cookie":
+			if cookie, err := r.Cookie(scheme.Name); err == nil && cookie.Value != "" {
+				return cookie.Value
+			}
+		}
+	}
+	return ""
+}
+
+// reportOnly returns a copy of the modes in which blocking phases are only reported
+func (m enforcementModes) reportOnly() enforcementModes {
+	modes := enforcementModes{}
+	for phase, mode := range m {
+		if mode == EnforceModeBlock {
+			mode = EnforceModeReport
+		}
+		modes[phase] = mode
+	}
+	return modes
+}
+
+// observeRollout records the overall outcome of validating a request in its rollout bucket
+func (v *Validator) observeRollout(replacer *caddy.Replacer, bucket string) {
+
+	result := outcomePassed
+	for _, phase := range phases {
+		value, _ := replacer.GetString(replacerOutcomeKey(phase))
+		switch outcome(value) {
+		case outcomeBlocked:
+			result = outcomeBlocked
+		case outcomeReported:
+			if result != outcomeBlocked {
+				result = outcomeReported
+			}
+		}
+	}
+
+	validatorMetrics.rolloutRequests.WithLabelValues(v.Filepath, bucket, string(result)).Inc()
+}
@@ -0,0 +1,174 @@
+// Copyright 2020 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package openapi
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRolloutValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		rollout Rollout
+		wantErr bool
+	}{
+		{name: "defaults", rollout: Rollout{Percentage: 50}, wantErr: false},
+		{name: "api key", rollout: Rollout{Percentage: 50, Key: "api_key"}, wantErr: false},
+		{name: "header", rollout: Rollout{Percentage: 50, Key: "header", Header: "X-Client-ID"}, wantErr: false},
+		{name: "header without name", rollout: Rollout{Percentage: 50, Key: "header"}, wantErr: true},
+		{name: "unknown key", rollout: Rollout{Percentage: 50, Key: "cookie"}, wantErr: true},
+		{name: "negative percentage", rollout: Rollout{Percentage: -1}, wantErr: true},
+		{name: "percentage too large", rollout: Rollout{Percentage: 100.5}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		err := tt.rollout.validate()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("unexpected result in test %s: got error %v, want error: %t", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestRolloutBucket(t *testing.T) {
+	v, err := createValidator(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v.Rollout = &Rollout{Percentage: 25, Key: "header", Header: "X-Client-ID"}
+
+	enforced := 0
+	for i := 0; i < 1000; i++ {
+		req, err := prepareRequest("GET", "http://localhost:9443/api/pets/1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-Client-ID", fmt.Sprintf("client-%d", i))
+
+		bucket := v.rolloutBucket(req)
+		if bucket == rolloutBucketEnforced {
+			enforced++
+		}
+
+		// The same client should always end up in the same bucket
+		if again := v.rolloutBucket(req); again != bucket {
+			t.Errorf("client-%d ended up in bucket %s and %s", i, bucket, again)
+		}
+	}
+
+	if enforced < 150 || enforced > 350 {
+		t.Errorf("expected roughly 250 out of 1000 clients to be enforced; got %d", enforced)
+	}
+}
+
+func TestRolloutServeHTTP(t *testing.T) {
+	v, err := createValidator(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// None of the requests are enforced; invalid responses are only reported
+	v.Rollout = &Rollout{Percentage: 0}
+
+	req, err := prepareRequest("GET", "http://localhost:9443/api/pets/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := httptest.NewRecorder()
+
+	err = v.ServeHTTP(recorder, req, &mockWrongAPI{})
+	if err != nil {
+		t.Error(err)
+	}
+
+	if status := recorder.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusOK)
+	}
+
+	if got := outcomeOf(req, phaseResponse); got != "reported" {
+		t.Errorf("unexpected response outcome: got %s want reported", got)
+	}
+
+	// All requests are enforced
+	v.Rollout = &Rollout{Percentage: 100}
+
+	req, err = prepareRequest("GET", "http://localhost:9443/api/pets/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorder = httptest.NewRecorder()
+
+	err = v.ServeHTTP(recorder, req, &mockWrongAPI{})
+	if err == nil {
+		t.Error("expected an error while enforcing response validation")
+	}
+
+	if got := outcomeOf(req, phaseResponse); got != "blocked" {
+		t.Errorf("unexpected response outcome: got %s want blocked", got)
+	}
+}
+
+func TestRolloutServeHTTPUnknownServer(t *testing.T) {
+	v, err := createValidator(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// None of the requests are enforced, so servers are only reported
+	v.Rollout = &Rollout{Percentage: 0}
+	n, err := replaceValidator(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name         string
+		url          string
+		wantRoute    string
+		wantResponse string
+	}{
+		{name: "unknown path", url: "http://unknown.example.com/api/petz/1", wantRoute: "reported", wantResponse: "skipped"},
+		{name: "known path", url: "http://unknown.example.com/api/pets/1", wantRoute: "passed", wantResponse: "reported"},
+	}
+
+	for _, tt := range tests {
+		req, err := prepareRequest("GET", tt.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		recorder := httptest.NewRecorder()
+		err = n.ServeHTTP(recorder, req, &mockWrongAPI{})
+		if err != nil {
+			t.Errorf("unexpected error in test %s: %v", tt.name, err)
+		}
+
+		if got := outcomeOf(req, phaseServer); got != "reported" {
+			t.Errorf("unexpected server outcome in test %s: got %s want reported", tt.name, got)
+		}
+		if got := outcomeOf(req, phaseRoute); got != tt.wantRoute {
+			t.Errorf("unexpected route outcome in test %s: got %s want %s", tt.name, got, tt.wantRoute)
+		}
+		if got := outcomeOf(req, phaseResponse); got != tt.wantResponse {
+			t.Errorf("unexpected response outcome in test %s: got %s want %s", tt.name, got, tt.wantResponse)
+		}
+	}
+}
@@ -36,48 +36,116 @@ func (v *Validator) validateRoute(r *http.Request) (*openapi3filter.RequestValid
 		url.Scheme = "https"
 	}
 	r.URL = url
-	route, pathParams, err := v.router.FindRoute(r)
+
+	servers := v.specification.Servers
+	if len(servers) > 0 {
+		server, _, _ := servers.MatchURL(url)
+		if server == nil && isWebSocketUpgrade(r) {
+			// WebSocket servers are declared with a ws:// or wss:// URL
+			url.Scheme = websocketSchemes[url.Scheme]
+			server, _, _ = servers.MatchURL(url)
+		}
+		if server == nil {
+			return nil, &oapiError{
+				Code:    http.StatusNotFound, //http.StatusBadRequest?
+				Message: "Does not match any server",
+				phase:   phaseServer,
+			}
+		}
+	}
+
+	return v.findRoute(r, r, v.router)
+}
+
+// validateRouteIgnoringServers looks up the route for a request that did not match any of
+// the servers in the OpenAPI specification. The base paths of the servers are tried as
+// a prefix of the request path, so that the route can be found for any scheme and host.
+func (v *Validator) validateRouteIgnoringServers(r *http.Request) (*openapi3filter.RequestValidationInput, *oapiError) {
+
+	if v.serverlessRouter == nil {
+		return nil, &oapiError{
+			Code:    http.StatusInternalServerError,
+			Message: "routes can't be looked up without taking the servers into account",
+			phase:   phaseRoute,
+		}
+	}
+
+	// The route is not found when the request path doesn't start with any of the base paths
+	oerr := &oapiError{
+		Code:    http.StatusNotFound,
+		Message: routers.ErrPathNotFound.Error(),
+		phase:   phaseRoute,
+	}
+	var notAllowed *oapiError
+	for _, basePath := range v.serverBasePaths {
+		if !strings.HasPrefix(r.URL.Path, basePath) {
+			continue
+		}
+
+		// Look up the route with a shallow copy of the request, so that the original URL is retained
+		url := *r.URL
+		url.Path = strings.TrimPrefix(url.Path, basePath)
+		lookup := *r
+		lookup.URL = &url
+
+		validationInput, err := v.findRoute(r, &lookup, v.serverlessRouter)
+		if err == nil {
+			return validationInput, nil
+		}
+		oerr = err
+		if oerr.allowed != nil && notAllowed == nil {
+			notAllowed = oerr
+		}
+	}
+
+	// A path that matches with another method takes precedence over a path that doesn't match at all
+	if notAllowed != nil {
+		return nil, notAllowed
+	}
+
+	return nil, oerr
+}
+
+// findRoute finds the route for the lookup request using the provided router
+func (v *Validator) findRoute(r *http.Request, lookup *http.Request, router routers.Router) (*openapi3filter.RequestValidationInput, *oapiError) {
+
+	route, pathParams, err := router.FindRoute(lookup)
+	if err != nil && lookup.Method == http.MethodHead && v.HeadAsGet {
+		// Paths without a HEAD operation are looked up with GET, so that HEAD is validated against it
+		probe := *lookup
+		probe.Method = http.MethodGet
+		if getRoute, getPathParams, getErr := router.FindRoute(&probe); getErr == nil {
+			route, pathParams, err = getRoute, getPathParams, nil
+		}
+	}
 
 	// No route found for the request
 	if err != nil {
 		switch e := err.(type) {
 		case *routers.RouteError:
 			// The requested path doesn't match the server, path or anything else.
-			// TODO: switch between cases based on the e.Reason string? Some are not found, some are invalid method, etc.
-			switch reason := e.Reason; reason {
-			case "Does not match any server":
-				if v.shouldValidateServers() {
-					return nil, &oapiError{
-						Code:    http.StatusNotFound, //http.StatusBadRequest?
-						Message: reason,
-					}
-				}
-			case "Path was not found":
-				return nil, &oapiError{
-					Code:    http.StatusNotFound, //http.StatusBadRequest?
-					Message: reason,
-				}
-			case "Path doesn't support the HTTP method":
+			// The router doesn't tell whether the path matches with another method, so
+			// the path is looked up with the other methods to find out.
+			if routes := v.allowedRoutes(lookup, router); len(routes) > 0 {
 				return nil, &oapiError{
-					Code:    http.StatusMethodNotAllowed, //http.StatusBadRequest?
-					Message: reason,
-				}
-			case "None of the routers matches":
-				return nil, &oapiError{
-					Code:    http.StatusMethodNotAllowed, //http.StatusBadRequest?
-					Message: reason,
-				}
-			default:
-				return nil, &oapiError{
-					Code:    http.StatusNotFound, //http.StatusBadRequest?
-					Message: reason,
+					Code:    http.StatusMethodNotAllowed,
+					Message: fmt.Sprintf("Path doesn't support the HTTP method %s", r.Method),
+					phase:   phaseRoute,
+					header:  http.Header{"Allow": []string{v.allowHeader(routes)}},
+					allowed: routes,
 				}
 			}
+			return nil, &oapiError{
+				Code:    http.StatusNotFound, //http.StatusBadRequest?
+				Message: e.Reason,
+				phase:   phaseRoute,
+			}
 		default:
 			// Fallback for unexpected or unimplemented cases
 			return nil, &oapiError{
 				Code:    http.StatusInternalServerError,
 				Message: fmt.Sprintf("error validating route: %s", err.Error()),
+				phase:   phaseRoute,
 			}
 		}
 	}
@@ -97,3 +165,47 @@ func (v *Validator) validateRoute(r *http.Request) (*openapi3filter.RequestValid
 
 	return validationInput, nil
 }
+
+// methods are the HTTP methods that operations can be defined for, in the order of the specification
+var methods = []string{
+	http.MethodGet,
+	http.MethodPut,
+	http.MethodPost,
+	http.MethodDelete,
+	http.MethodOptions,
+	http.MethodHead,
+	http.MethodPatch,
+	http.MethodTrace,
+}
+
+// allowedRoutes returns the routes for the path of the lookup request by method. HEAD
+// is allowed for paths with a GET operation when HEAD requests are validated against it.
+func (v *Validator) allowedRoutes(lookup *http.Request, router routers.Router) map[string]*routers.Route {
+	routes := map[string]*routers.Route{}
+	for _, method := range methods {
+		if method == lookup.Method {
+			continue
+		}
+		probe := *lookup
+		probe.Method = method
+		if route, _, err := router.FindRoute(&probe); err == nil {
+			routes[method] = route
+		}
+	}
+	if get, ok := routes[http.MethodGet]; ok && v.HeadAsGet && routes[http.MethodHead] == nil && lookup.Method != http.MethodHead {
+		routes[http.MethodHead] = get
+	}
+	return routes
+}
+
+// allowHeader returns the value of the Allow header for the routes. OPTIONS is included
+// when the Validator answers OPTIONS requests itself.
+func (v *Validator) allowHeader(routes map[string]*routers.Route) string {
+	allowed := []string{}
+	for _, method := range methods {
+		if _, ok := routes[method]; ok || (method == http.MethodOptions && v.answersOptions()) {
+			allowed = append(allowed, method)
+		}
+	}
+	return strings.Join(allowed, ", ")
+}
@@ -0,0 +1,105 @@
+// Copyright 2020 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package openapi
+
+import (
+	"fmt"
+	"math/rand"
+
+	"github.com/getkin/kin-openapi/routers"
+)
+
+const (
+	// sampleValidated, sampleNotSampled, sampleDropped and sampleOverflow are the outcomes of sampling a response:
+	// it was validated, it was not sampled, it was sampled but dropped instead of being validated asynchronously,
+	// or it was sampled but too large to be buffered for validation
+	sampleValidated  = "validated"
+	sampleNotSampled = "not_sampled"
+	sampleDropped    = "dropped"
+	sampleOverflow   = "overflow"
+)
+
+// ResponseSampling configures the share of responses that are validated. Responses
+// that are not sampled are streamed to the client directly, without buffering.
+type ResponseSampling struct {
+	// Rate (between 0 and 1) of responses that are validated.
+	// Default is 1, resulting in all responses being validated
+	Rate *float64 `json:"rate,omitempty"`
+	// Rates (between 0 and 1) per operation, overriding the global rate. Operations
+	// are identified by their operationId or by method and path, e.g. "GET /pets/{petId}".
+	// Default is empty
+	Operations map[string]float64 `json:"operations,omitempty"`
+}
+
+// validate checks the ResponseSampling configuration
+func (s *ResponseSampling) validate() error {
+	if s.Rate != nil && (*s.Rate < 0 || *s.Rate > 1) {
+		return fmt.Errorf("response sampling rate should be between 0 and 1; got %v", *s.Rate)
+	}
+	for operation, rate := range s.Operations {
+		if rate < 0 || rate > 1 {
+			return fmt.Errorf("response sampling rate for %q should be between 0 and 1; got %v", operation, rate)
+		}
+	}
+	return nil
+}
+
+// responseSampleRate returns the rate at which responses for the route are validated
+func (v *Validator) responseSampleRate(route *routers.Route) float64 {
+
+	s := v.ResponseSampling
+	if s == nil {
+		return 1
+	}
+
+	if id := route.Operation.OperationID; id != "" {
+		if rate, ok := s.Operations[id]; ok {
+			return rate
+		}
+	}
+
+	if rate, ok := s.Operations[operationKey(route)]; ok {
+		return rate
+	}
+
+	if s.Rate != nil {
+		return *s.Rate
+	}
+
+	return 1
+}
+
+// sampleResponse determines whether a response should be validated given the sample rate
+func sampleResponse(rate float64) bool {
+	if rate >= 1 {
+		return true
+	}
+	return rand.Float64() < rate
+}
+
+// observeResponse records the sampling outcome for the response for an operation and,
+// for validated responses, whether it was invalid. The number of invalid responses
+// is extrapolated to all responses based on the sample rate.
+func (v *Validator) observeResponse(operation string, rate float64, outcome string, invalid bool) {
+
+	validatorMetrics.responses.WithLabelValues(v.Filepath, operation, outcome).Inc()
+
+	if outcome != sampleValidated || !invalid {
+		return
+	}
+
+	validatorMetrics.responseViolations.WithLabelValues(v.Filepath, operation).Inc()
+	validatorMetrics.responseViolationsEstimated.WithLabelValues(v.Filepath, operation).Add(1 / rate)
+}
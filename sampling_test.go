@@ -0,0 +1,116 @@
+// Copyright 2020 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package openapi
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestResponseSampleRate(t *testing.T) {
+	v, err := createValidator(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := prepareRequest("GET", "http://localhost:9443/api/pets/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	input, oerr := v.validateRoute(req)
+	if oerr != nil {
+		t.Fatal(oerr)
+	}
+
+	if rate := v.responseSampleRate(input.Route); rate != 1 {
+		t.Errorf("unexpected default sample rate: got %v want 1", rate)
+	}
+
+	global := 0.1
+	v.ResponseSampling = &ResponseSampling{Rate: &global}
+	if rate := v.responseSampleRate(input.Route); rate != 0.1 {
+		t.Errorf("unexpected global sample rate: got %v want 0.1", rate)
+	}
+
+	v.ResponseSampling.Operations = map[string]float64{"GET /pets/{petId}": 0.5}
+	if rate := v.responseSampleRate(input.Route); rate != 0.5 {
+		t.Errorf("unexpected operation sample rate: got %v want 0.5", rate)
+	}
+
+	// The operationId takes precedence over method and path
+	v.ResponseSampling.Operations["showPetById"] = 0.25
+	if rate := v.responseSampleRate(input.Route); rate != 0.25 {
+		t.Errorf("unexpected operation sample rate: got %v want 0.25", rate)
+	}
+
+	invalid := 1.5
+	v.ResponseSampling = &ResponseSampling{Rate: &invalid}
+	if err := v.Validate(); err == nil {
+		t.Error("validator should fail with a sample rate larger than 1")
+	}
+}
+
+func TestResponseSamplingServeHTTP(t *testing.T) {
+	v, err := createValidator(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// No responses are sampled; the invalid response is passed through
+	none := 0.0
+	v.ResponseSampling = &ResponseSampling{Rate: &none}
+
+	req, err := prepareRequest("GET", "http://localhost:9443/api/pets/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := httptest.NewRecorder()
+
+	err = v.ServeHTTP(recorder, req, &mockWrongAPI{})
+	if err != nil {
+		t.Error(err)
+	}
+
+	if status := recorder.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusOK)
+	}
+
+	if got := outcomeOf(req, phaseResponse); got != "skipped" {
+		t.Errorf("unexpected response outcome: got %s want skipped", got)
+	}
+
+	// All responses for the operation are sampled
+	v.ResponseSampling.Operations = map[string]float64{"showPetById": 1}
+
+	req, err = prepareRequest("GET", "http://localhost:9443/api/pets/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorder = httptest.NewRecorder()
+
+	err = v.ServeHTTP(recorder, req, &mockWrongAPI{})
+	if err == nil {
+		t.Error("expected an error while enforcing response validation")
+	}
+
+	if got := outcomeOf(req, phaseResponse); got != "blocked" {
+		t.Errorf("unexpected response outcome: got %s want blocked", got)
+	}
+}
@@ -0,0 +1,64 @@
+// Copyright 2020 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package openapi
+
+import (
+	"fmt"
+	"strings"
+)
+
+// scopeError is an error for a valid token that wasn't granted all scopes required by a security requirement
+type scopeError struct {
+	required []string
+	missing  []string
+}
+
+func (e *scopeError) Error() string {
+	return fmt.Sprintf("insufficient scope: missing %s", strings.Join(e.missing, ", "))
+}
+
+// grantedScopes returns the scopes granted to a token from the scope claim, which is a
+// space-delimited list as described in RFC 8693, or the scp claim, which is also used as
+// a list of strings by some authorization servers.
+func grantedScopes(claims map[string]interface{}) []string {
+	scopes := []string{}
+	for _, name := range []string{"scope", "scp"} {
+		switch value := claims[name].(type) {
+		case string:
+			scopes = append(scopes, strings.Fields(value)...)
+		case []interface{}:
+			for _, item := range value {
+				if scope, ok := item.(string); ok {
+					scopes = append(scopes, scope)
+				}
+			}
+		}
+	}
+	return scopes
+}
+
+// checkScopes returns a scopeError when one or more of the required scopes were not granted
+func checkScopes(required []string, granted []string) error {
+	missing := []string{}
+	for _, scope := range required {
+		if !contains(granted, scope) {
+			missing = append(missing, scope)
+		}
+	}
+	if len(missing) > 0 {
+		return &scopeError{required: required, missing: missing}
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+// Copyright 2020 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package openapi
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+func TestGrantedScopes(t *testing.T) {
+	tests := []struct {
+		name   string
+		claims map[string]interface{}
+		want   []string
+	}{
+		{name: "scope", claims: map[string]interface{}{"scope": "pets:read  pets:write"}, want: []string{"pets:read", "pets:write"}},
+		{name: "scp list", claims: map[string]interface{}{"scp": []interface{}{"pets:read", "pets:write"}}, want: []string{"pets:read", "pets:write"}},
+		{name: "scp string", claims: map[string]interface{}{"scp": "pets:read"}, want: []string{"pets:read"}},
+		{name: "none", claims: map[string]interface{}{"sub": "alice"}, want: []string{}},
+	}
+
+	for _, tt := range tests {
+		if got := grantedScopes(tt.claims); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("unexpected scopes in test %s: got %v want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestScopesServeHTTP(t *testing.T) {
+
+	key := generateKey(t, "key-1")
+	jwksFile := writeJWKS(t, key)
+
+	claims := jwt.Claims{Subject: "alice", Expiry: jwt.NewNumericDate(time.Now().Add(time.Hour))}
+
+	tests := []struct {
+		name             string
+		authorization    string
+		wantStatus       int
+		wantAuthenticate string
+	}{
+		{name: "granted", authorization: "Bearer " + signToken(t, key, claims, map[string]interface{}{"scope": "pets:read pets:write"}), wantStatus: http.StatusOK},
+		{name: "granted with scp", authorization: "Bearer " + signToken(t, key, claims, map[string]interface{}{"scp": []string{"pets:read"}}), wantStatus: http.StatusOK},
+		{name: "insufficient scope", authorization: "Bearer " + signToken(t, key, claims, map[string]interface{}{"scope": "pets:write"}), wantStatus: http.StatusForbidden, wantAuthenticate: `Bearer error="insufficient_scope", scope="pets:read"`},
+		{name: "invalid token", authorization: "Bearer invalid", wantStatus: http.StatusUnauthorized, wantAuthenticate: `Bearer error="invalid_token"`},
+		{name: "no token", wantStatus: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		v, err := createValidator(t)
+		if err != nil {
+			t.Fatal(err)
+		}
+		v.JWT = &JWT{JWKSFile: jwksFile}
+		n, err := replaceValidator(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n.specification.Components.SecuritySchemes = openapi3.SecuritySchemes{
+			"OAuth2": &openapi3.SecuritySchemeRef{Value: &openapi3.SecurityScheme{Type: "oauth2"}},
+		}
+		n.specification.Security = openapi3.SecurityRequirements{{"OAuth2": []string{"pets:read"}}}
+
+		req, err := prepareRequest("GET", "http://localhost:9443/api/pets/1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.authorization != "" {
+			req.Header.Set("Authorization", tt.authorization)
+		}
+
+		recorder := httptest.NewRecorder()
+		n.ServeHTTP(recorder, req, &mockAPI{})
+
+		if status := recorder.Code; status != tt.wantStatus {
+			t.Errorf("handler returned wrong status code in test %s: got %v want %v", tt.name, status, tt.wantStatus)
+		}
+		if authenticate := recorder.Header().Get("WWW-Authenticate"); authenticate != tt.wantAuthenticate {
+			t.Errorf("unexpected WWW-Authenticate header in test %s: got %q want %q", tt.name, authenticate, tt.wantAuthenticate)
+		}
+	}
+}
@@ -0,0 +1,280 @@
+// Copyright 2020 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package openapi
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/certmagic"
+	"github.com/getkin/kin-openapi/openapi3"
+)
+
+func init() {
+	caddy.RegisterModule(BasicSecurity{})
+	caddy.RegisterModule(BearerSecurity{})
+	caddy.RegisterModule(APIKeySecurity{})
+	caddy.RegisterModule(JWTSecurity{})
+}
+
+// SecuritySchemeValidator is implemented by modules in the http.handlers.openapi_validator.security
+// namespace. These modules validate the credentials of requests for a security scheme in the
+// specification that they're bound to.
+type SecuritySchemeValidator interface {
+	// ValidateSecurityScheme validates the credentials in the request for the security scheme
+	// and returns the identity that they belong to. An error is returned when the credentials
+	// are missing or not accepted.
+	ValidateSecurityScheme(input *SecurityInput) (*Identity, error)
+}
+
+// SecurityInput is the input for validating the credentials of a request for a security scheme
+type SecurityInput struct {
+	// The name of the security scheme in the specification.
+	Name string
+	// The security scheme.
+	Scheme *openapi3.SecurityScheme
+	// The scopes listed for the security scheme in the security requirement of the operation.
+	Scopes []string
+	// The request.
+	Request *http.Request
+	// The maximum size in bytes of the request body for the operation, or 0 when it isn't limited.
+	MaxBodySize int64
+}
+
+// Identity is the identity that the credentials of a request belong to. Its ID is available as the
+// {http.auth.user.id} placeholder and the metadata as {http.auth.user.*} placeholders.
+type Identity struct {
+	ID       string
+	Metadata map[string]string
+}
+
+// setIdentity sets the identity as placeholders, like the Caddy authentication handler does
+func setIdentity(r *http.Request, identity *Identity) {
+	if identity == nil {
+		return
+	}
+	setPlaceholder(r, ReplacerHTTPAuthUserID, identity.ID)
+	for name, value := range identity.Metadata {
+		setPlaceholder(r, "http.auth.user."+name, value)
+	}
+}
+
+// identityFromClaims returns the identity for the claims of a token, which is the subject of a
+// JWT or the username or client ID of an introspected token
+func identityFromClaims(claims map[string]interface{}) *Identity {
+	for _, name := range []string{"sub", "username", "client_id"} {
+		if value, ok := claims[name]; ok {
+			return &Identity{ID: claimString(value)}
+		}
+	}
+	return &Identity{}
+}
+
+// provisionSecurityValidators loads the modules for the security schemes they're bound to
+func (v *Validator) provisionSecurityValidators(ctx caddy.Context) error {
+
+	v.securityValidators = map[string]SecuritySchemeValidator{}
+	if v.SecurityRaw == nil {
+		return nil
+	}
+
+	var schemes openapi3.SecuritySchemes
+	if components := v.specification.Components; components != nil {
+		schemes = components.SecuritySchemes
+	}
+	for name := range v.SecurityRaw {
+		if _, ok := schemes[name]; !ok {
+			return fmt.Errorf("security scheme %q is not defined in the specification", name)
+		}
+	}
+
+	modules, err := ctx.LoadModule(v, "SecurityRaw")
+	if err != nil {
+		return fmt.Errorf("loading security scheme validators: %v", err)
+	}
+	for name, module := range modules.(map[string]interface{}) {
+		v.securityValidators[name] = module.(SecuritySchemeValidator)
+	}
+
+	return nil
+}
+
+// BasicSecurity validates HTTP basic authentication credentials against accounts with
+// bcrypt hashed passwords, configured like basic_auth.
+type BasicSecurity struct {
+	BasicAuth
+
+	authenticator *basicAuthenticator
+}
+
+// CaddyModule returns the Caddy module information.
+func (BasicSecurity) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.openapi_validator.security.basic",
+		New: func() caddy.Module { return new(BasicSecurity) },
+	}
+}
+
+// Provision sets up the BasicSecurity module.
+func (b *BasicSecurity) Provision(ctx caddy.Context) error {
+	if err := b.BasicAuth.validate(); err != nil {
+		return err
+	}
+	authenticator, err := newBasicAuthenticator(&b.BasicAuth)
+	if err != nil {
+		return err
+	}
+	b.authenticator = authenticator
+	return nil
+}
+
+// ValidateSecurityScheme validates the basic authentication credentials of the request.
+func (b *BasicSecurity) ValidateSecurityScheme(input *SecurityInput) (*Identity, error) {
+	username, err := b.authenticator.authenticate(input.Request)
+	if err != nil {
+		return nil, err
+	}
+	return &Identity{ID: username}, nil
+}
+
+// BearerSecurity validates opaque bearer tokens using token introspection, configured
+// like an entry of introspection.
+type BearerSecurity struct {
+	Introspection
+
+	introspector *introspector
+}
+
+// CaddyModule returns the Caddy module information.
+func (BearerSecurity) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.openapi_validator.security.bearer",
+		New: func() caddy.Module { return new(BearerSecurity) },
+	}
+}
+
+// Provision sets up the BearerSecurity module.
+func (b *BearerSecurity) Provision(ctx caddy.Context) error {
+	if err := b.Introspection.validate(); err != nil {
+		return err
+	}
+	b.introspector = newIntrospector(&b.Introspection)
+	return nil
+}
+
+// ValidateSecurityScheme introspects the bearer token of the request and checks its scopes.
+func (b *BearerSecurity) ValidateSecurityScheme(input *SecurityInput) (*Identity, error) {
+	return validateBearerToken(input, b.introspector, ReplacerOpenAPIValidatorIntrospection)
+}
+
+// APIKeySecurity validates the keys for apiKey security schemes against a key store,
+// configured like api_keys.
+type APIKeySecurity struct {
+	APIKeys
+
+	store apiKeyStore
+}
+
+// CaddyModule returns the Caddy module information.
+func (APIKeySecurity) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.openapi_validator.security.api_key",
+		New: func() caddy.Module { return new(APIKeySecurity) },
+	}
+}
+
+// Provision sets up the APIKeySecurity module.
+func (a *APIKeySecurity) Provision(ctx caddy.Context) error {
+	if err := a.APIKeys.validate(); err != nil {
+		return err
+	}
+	var storage certmagic.Storage
+	if a.StoragePrefix != "" {
+		storage = ctx.Storage()
+	}
+	store, err := newAPIKeyStore(&a.APIKeys, storage, ctx.Logger())
+	if err != nil {
+		return err
+	}
+	a.store = store
+	return nil
+}
+
+// ValidateSecurityScheme looks up the API key of the request and checks its scopes.
+func (a *APIKeySecurity) ValidateSecurityScheme(input *SecurityInput) (*Identity, error) {
+	key, err := apiKey(input.Request, input.Scheme)
+	if err != nil {
+		return nil, err
+	}
+	client, err := authorizeAPIKey(input.Request.Context(), a.store, key, input.Scopes)
+	if err != nil {
+		return nil, err
+	}
+	return &Identity{ID: client.Client}, nil
+}
+
+// JWTSecurity validates JSON Web Tokens against a JSON Web Key Set, configured like jwt.
+type JWTSecurity struct {
+	JWT
+
+	verifier *jwtVerifier
+}
+
+// CaddyModule returns the Caddy module information.
+func (JWTSecurity) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.openapi_validator.security.jwt",
+		New: func() caddy.Module { return new(JWTSecurity) },
+	}
+}
+
+// Provision sets up the JWTSecurity module.
+func (j *JWTSecurity) Provision(ctx caddy.Context) error {
+	if err := j.JWT.validate(); err != nil {
+		return err
+	}
+	j.verifier = newJWTVerifier(&j.JWT, ctx.Logger())
+	return nil
+}
+
+// ValidateSecurityScheme verifies the bearer token of the request and checks its scopes.
+func (j *JWTSecurity) ValidateSecurityScheme(input *SecurityInput) (*Identity, error) {
+	return validateBearerToken(input, j.verifier, ReplacerOpenAPIValidatorJWTClaims)
+}
+
+// validateBearerToken verifies the bearer token of the request with the verifier and checks its scopes
+func validateBearerToken(input *SecurityInput, verifier tokenVerifier, prefix string) (*Identity, error) {
+	token, ok := bearerToken(input.Request)
+	if !ok {
+		return nil, fmt.Errorf("no bearer token provided for security scheme %q", input.Name)
+	}
+	claims, err := authorizeToken(input.Request.Context(), input.Request, verifier, prefix, token, input.Scopes)
+	if err != nil {
+		return nil, err
+	}
+	return identityFromClaims(claims), nil
+}
+
+var (
+	_ SecuritySchemeValidator = (*BasicSecurity)(nil)
+	_ SecuritySchemeValidator = (*BearerSecurity)(nil)
+	_ SecuritySchemeValidator = (*APIKeySecurity)(nil)
+	_ SecuritySchemeValidator = (*JWTSecurity)(nil)
+	_ caddy.Provisioner       = (*BasicSecurity)(nil)
+	_ caddy.Provisioner       = (*BearerSecurity)(nil)
+	_ caddy.Provisioner       = (*APIKeySecurity)(nil)
+	_ caddy.Provisioner       = (*JWTSecurity)(nil)
+)
@@ -0,0 +1,323 @@
+// Copyright 2020 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package openapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+)
+
+const (
+	mediaTypeEventStream = "text/event-stream"
+
+	// extensionSSEEvents is the OpenAPI extension on a text/event-stream media type
+	// that declares the schema of the data of each event type
+	extensionSSEEvents = "x-sse-events"
+
+	defaultEventType = "message"
+	maxEventSize     = 1 << 20
+)
+
+// isEventStream returns whether the response headers indicate a stream of Server-Sent Events
+func isEventStream(header http.Header) bool {
+	mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	return err == nil && mediaType == mediaTypeEventStream
+}
+
+// eventSchemas maps the text/event-stream media types in the specification
+// to the schemas of the data of their event types
+type eventSchemas map[*openapi3.MediaType]map[string]*openapi3.Schema
+
+// eventSchemasOf collects the event schemas declared using the x-sse-events extension.
+// The schema for an event type is either an inline schema or a reference to a schema in
+// the components of the specification.
+func eventSchemasOf(specification *openapi3.T) (eventSchemas, error) {
+
+	result := eventSchemas{}
+	for path, pathItem := range specification.Paths {
+		for method, operation := range pathItem.Operations() {
+			for status, response := range operation.Responses {
+				if response.Value == nil {
+					continue
+				}
+				for contentType, mediaType := range response.Value.Content {
+					value, ok := mediaType.Extensions[extensionSSEEvents]
+					if !ok {
+						continue
+					}
+					schemas, err := parseEventSchemas(specification, value)
+					if err != nil {
+						return nil, fmt.Errorf("invalid %s for %s %s response %s (%s): %w", extensionSSEEvents, method, path, status, contentType, err)
+					}
+					result[mediaType] = schemas
+				}
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// parseEventSchemas parses the value of an x-sse-events extension. The schemas are resolved
+// like the schemas in the components of the specification, including nested references.
+func parseEventSchemas(specification *openapi3.T, value interface{}) (map[string]*openapi3.Schema, error) {
+
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+
+	refs := map[string]*openapi3.SchemaRef{}
+	if err := json.Unmarshal(data, &refs); err != nil {
+		return nil, err
+	}
+
+	// The event schemas are resolved as schemas in the components of a document that has
+	// the schemas of the specification too, using names that can't be used for components
+	components := openapi3.Schemas{}
+	if specification.Components != nil {
+		for name, schema := range specification.Components.Schemas {
+			components[name] = schema
+		}
+	}
+	for eventType, ref := range refs {
+		if ref == nil {
+			return nil, fmt.Errorf("schema for event type %q should be an object", eventType)
+		}
+		components[eventSchemaName(eventType)] = ref
+	}
+	document := &openapi3.T{OpenAPI: specification.OpenAPI, Components: &openapi3.Components{Schemas: components}}
+	if err := openapi3.NewLoader().ResolveRefsIn(document, nil); err != nil {
+		return nil, fmt.Errorf("can't resolve schemas: %w", err)
+	}
+
+	schemas := map[string]*openapi3.Schema{}
+	for eventType, ref := range refs {
+		if ref.Value == nil {
+			return nil, fmt.Errorf("can't resolve schema %q for event type %q", ref.Ref, eventType)
+		}
+		schemas[eventType] = ref.Value
+	}
+
+	return schemas, nil
+}
+
+// eventSchemaName returns the name that the schema for the event type is resolved by
+func eventSchemaName(eventType string) string {
+	return extensionSSEEvents + " " + eventType
+}
+
+// eventSchemasFor returns the event schemas for the response, or nil when there are none
+func (v *Validator) eventSchemasFor(input *openapi3filter.RequestValidationInput, status int, header http.Header) map[string]*openapi3.Schema {
+
+	responses := input.Route.Operation.Responses
+	responseRef := responses.Get(status)
+	if responseRef == nil {
+		responseRef = responses.Default()
+	}
+	if responseRef == nil || responseRef.Value == nil {
+		return nil
+	}
+
+	mediaType := responseRef.Value.Content.Get(header.Get("Content-Type"))
+	if mediaType == nil {
+		return nil
+	}
+
+	return v.eventSchemas[mediaType]
+}
+
+// eventStreamValidator parses a stream of Server-Sent Events written to it and validates
+// the data of each event against the schema for its event type. Events are validated as
+// soon as they're complete; violations are passed to report.
+type eventStreamValidator struct {
+	schemas map[string]*openapi3.Schema
+	report  func(oerr *oapiError)
+
+	line         bytes.Buffer
+	lineTooLarge bool
+	lastCR       bool
+
+	eventType string
+	data      bytes.Buffer
+	hasData   bool
+	tooLarge  bool
+
+	events     int
+	violations int
+	first      *oapiError
+}
+
+// newEventStreamValidator returns a new eventStreamValidator
+func newEventStreamValidator(schemas map[string]*openapi3.Schema, report func(oerr *oapiError)) *eventStreamValidator {
+	return &eventStreamValidator{
+		schemas: schemas,
+		report:  report,
+	}
+}
+
+// Write parses the lines in p. Lines are terminated by a CRLF, LF or CR.
+func (e *eventStreamValidator) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		if e.lastCR && p[0] == '\n' {
+			p = p[1:]
+			e.lastCR = false
+			continue
+		}
+		e.lastCR = false
+		i := bytes.IndexAny(p, "\r\n")
+		if i < 0 {
+			e.appendLine(p)
+			break
+		}
+		e.appendLine(p[:i])
+		e.lastCR = p[i] == '\r'
+		e.processLine()
+		p = p[i+1:]
+	}
+	return n, nil
+}
+
+// appendLine adds data to the current line, unless it grows too large
+func (e *eventStreamValidator) appendLine(p []byte) {
+	if e.lineTooLarge || e.line.Len()+len(p) > maxEventSize {
+		e.lineTooLarge = true
+		return
+	}
+	e.line.Write(p)
+}
+
+// processLine processes a complete line
+func (e *eventStreamValidator) processLine() {
+
+	line := e.line.Bytes()
+	tooLarge := e.lineTooLarge
+	defer func() {
+		e.line.Reset()
+		e.lineTooLarge = false
+	}()
+
+	switch {
+	case tooLarge:
+		e.tooLarge = true
+		return
+	case len(line) == 0:
+		e.dispatch()
+		return
+	case line[0] == ':':
+		// A comment
+		return
+	}
+
+	field, value := line, []byte{}
+	if i := bytes.IndexByte(line, ':'); i >= 0 {
+		field, value = line[:i], bytes.TrimPrefix(line[i+1:], []byte(" "))
+	}
+
+	switch string(field) {
+	case "event":
+		e.eventType = string(value)
+	case "data":
+		if e.data.Len()+len(value)+1 > maxEventSize {
+			e.tooLarge = true
+			return
+		}
+		if e.hasData {
+			e.data.WriteByte('\n')
+		}
+		e.data.Write(value)
+		e.hasData = true
+	}
+}
+
+// dispatch validates the event that was completed by a blank line
+func (e *eventStreamValidator) dispatch() {
+
+	defer func() {
+		e.eventType = ""
+		e.data.Reset()
+		e.hasData = false
+		e.tooLarge = false
+	}()
+
+	if !e.hasData && !e.tooLarge {
+		return
+	}
+
+	e.events++
+	eventType := e.eventType
+	if eventType == "" {
+		eventType = defaultEventType
+	}
+
+	if err := e.validate(eventType); err != nil {
+		e.violations++
+		oerr := &oapiError{
+			Code:     http.StatusInternalServerError,
+			Message:  fmt.Sprintf("event %d (%s) has an error: %s", e.events, eventType, err),
+			Internal: err,
+			phase:    phaseResponse,
+		}
+		if e.first == nil {
+			e.first = oerr
+		}
+		e.report(oerr)
+	}
+}
+
+// validate validates the data of the current event against the schema for the event type
+func (e *eventStreamValidator) validate(eventType string) error {
+
+	if e.tooLarge {
+		return fmt.Errorf("event exceeds the maximum size of %d bytes", maxEventSize)
+	}
+
+	schema, ok := e.schemas[eventType]
+	if !ok {
+		return fmt.Errorf("event type %q is not declared", eventType)
+	}
+	if schema == nil {
+		return nil
+	}
+
+	var value interface{}
+	if schema.Type == openapi3.TypeString {
+		value = e.data.String()
+	} else if err := json.Unmarshal(e.data.Bytes(), &value); err != nil {
+		return fmt.Errorf("data is not valid JSON: %w", err)
+	}
+
+	return schemaViolation("", schema.VisitJSON(value, openapi3.VisitAsResponse()))
+}
+
+// result returns an error summarizing the violations, or nil when all events were valid
+func (e *eventStreamValidator) result() *oapiError {
+	if e.first == nil {
+		return nil
+	}
+	return &oapiError{
+		Code:     e.first.Code,
+		Message:  fmt.Sprintf("%d of %d events don't match their schema; the first: %s", e.violations, e.events, e.first.Message),
+		Internal: e.first.Internal,
+		phase:    phaseResponse,
+	}
+}
@@ -0,0 +1,224 @@
+// Copyright 2020 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package openapi
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/getkin/kin-openapi/openapi3"
+)
+
+func TestEventStreamValidator(t *testing.T) {
+	pet := openapi3.NewObjectSchema().WithProperty("name", openapi3.NewStringSchema())
+	pet.Required = []string{"name"}
+	schemas := map[string]*openapi3.Schema{
+		"message": openapi3.NewStringSchema(),
+		"pet":     pet,
+	}
+
+	reported := []string{}
+	e := newEventStreamValidator(schemas, func(oerr *oapiError) {
+		reported = append(reported, fmt.Sprint(oerr.Message))
+	})
+
+	stream := ": a comment\r\n" +
+		"data: hello\r\n\r\n" +
+		"event: pet\n" +
+		"data: {\"name\":\n" +
+		"data: \"Pet 1\"}\n\n" +
+		"event: pet\rdata: {\"id\": 1}\r\r" +
+		"event: unknown\ndata: {}\n\n" +
+		"event: pet\ndata: {\"name\": \"incomplete\"}\n"
+
+	// Write the stream in small chunks, to make sure lines are split up
+	for i := 0; i < len(stream); i += 3 {
+		end := i + 3
+		if end > len(stream) {
+			end = len(stream)
+		}
+		e.Write([]byte(stream[i:end]))
+	}
+
+	if e.events != 4 {
+		t.Errorf("unexpected number of events: got %d want 4", e.events)
+	}
+
+	want := []string{
+		`event 3 (pet) has an error: doesn't match schema at "/name": property "name" is missing`,
+		`event 4 (unknown) has an error: event type "unknown" is not declared`,
+	}
+	if strings.Join(reported, "\n") != strings.Join(want, "\n") {
+		t.Errorf("unexpected violations: got %q want %q", reported, want)
+	}
+
+	if oerr := e.result(); oerr == nil || !strings.HasPrefix(fmt.Sprint(oerr.Message), "2 of 4 events") {
+		t.Errorf("unexpected result: %v", oerr)
+	}
+}
+
+func TestEventStreamValidatorEmptyData(t *testing.T) {
+	message := openapi3.NewStringSchema().WithMinLength(1)
+	schemas := map[string]*openapi3.Schema{"message": message}
+
+	reported := []string{}
+	e := newEventStreamValidator(schemas, func(oerr *oapiError) {
+		reported = append(reported, fmt.Sprint(oerr.Message))
+	})
+
+	// An event with an empty data field is dispatched; an event without data fields isn't
+	e.Write([]byte("event: message\ndata:\n\nevent: message\n\n"))
+
+	if e.events != 1 {
+		t.Errorf("unexpected number of events: got %d want 1", e.events)
+	}
+	if len(reported) != 1 || !strings.HasPrefix(reported[0], "event 1 (message) has an error") {
+		t.Errorf("unexpected violations: %q", reported)
+	}
+}
+
+// eventStreamAPI streams Server-Sent Events
+type eventStreamAPI struct {
+	client   *httptest.ResponseRecorder
+	streamed bool
+}
+
+// ServeHTTP writes two events and checks that the first one has reached the client before writing the second one
+func (m *eventStreamAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) error {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("event: pet\ndata: {\"id\": 1, \"name\": \"Pet 1\"}\n\n"))
+	m.streamed = strings.Contains(m.client.Body.String(), "Pet 1")
+	w.Write([]byte("event: pet\ndata: {\"id\": 2}\n\n"))
+	return nil
+}
+
+func TestEventStreamServeHTTP(t *testing.T) {
+	v, err := createValidator(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := replaceValidator(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The example specification doesn't define an event stream
+	mediaType := openapi3.NewMediaType()
+	mediaType.Extensions = map[string]interface{}{
+		"x-sse-events": map[string]interface{}{
+			"pet": map[string]interface{}{"$ref": "#/components/schemas/Pet"},
+		},
+	}
+	n.specification.Paths.Find("/pets/{petId}").Get.Responses.Get(200).Value.Content["text/event-stream"] = mediaType
+	n.eventSchemas, err = eventSchemasOf(n.specification)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := prepareRequest("GET", "http://localhost:9443/api/pets/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := httptest.NewRecorder()
+	api := &eventStreamAPI{client: recorder}
+	err = n.ServeHTTP(recorder, req, api)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if !api.streamed {
+		t.Error("expected the first event to be streamed to the client")
+	}
+
+	if status := recorder.Code; status != http.StatusOK || !strings.Contains(recorder.Body.String(), `{"id": 2}`) {
+		t.Errorf("unexpected response: %d %q", status, recorder.Body.String())
+	}
+
+	if got := outcomeOf(req, phaseResponse); got != "reported" {
+		t.Errorf("unexpected response outcome: got %s want reported", got)
+	}
+
+	replacer := req.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	if got, _ := replacer.GetString(ReplacerOpenAPIValidatorResponseBuffer); got != "stream" {
+		t.Errorf("unexpected response buffer: got %s want stream", got)
+	}
+}
+
+func TestParseEventSchemas(t *testing.T) {
+	v, err := createValidator(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := replaceValidator(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nested := map[string]interface{}{
+		"adopted": map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"pet": map[string]interface{}{"$ref": "#/components/schemas/Pet"},
+			},
+		},
+	}
+	schemas, err := parseEventSchemas(n.specification, nested)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := newEventStreamValidator(schemas, func(oerr *oapiError) {})
+	e.data.WriteString(`{"pet": {"id": 1, "name": "Pet 1"}}`)
+	if err := e.validate("adopted"); err != nil {
+		t.Errorf("unexpected error for a valid event: %v", err)
+	}
+	e.data.Reset()
+	e.data.WriteString(`{"pet": {"id": 1}}`)
+	if err := e.validate("adopted"); err == nil {
+		t.Error("expected an error for an event with an invalid nested schema")
+	}
+
+	tests := []struct {
+		name          string
+		specification *openapi3.T
+		value         interface{}
+	}{
+		{name: "unknown nested reference", specification: n.specification, value: map[string]interface{}{
+			"adopted": map[string]interface{}{
+				"type":       "object",
+				"properties": map[string]interface{}{"pet": map[string]interface{}{"$ref": "#/components/schemas/Unknown"}},
+			},
+		}},
+		{name: "unknown reference", specification: n.specification, value: map[string]interface{}{
+			"pet": map[string]interface{}{"$ref": "#/components/schemas/Unknown"},
+		}},
+		{name: "no components", specification: &openapi3.T{OpenAPI: "3.0.0"}, value: map[string]interface{}{
+			"pet": map[string]interface{}{"$ref": "#/components/schemas/Pet"},
+		}},
+		{name: "null schema", specification: n.specification, value: map[string]interface{}{"pet": nil}},
+	}
+
+	for _, tt := range tests {
+		if _, err := parseEventSchemas(tt.specification, tt.value); err == nil {
+			t.Errorf("expected an error in test %s", tt.name)
+		}
+	}
+}
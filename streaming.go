@@ -0,0 +1,508 @@
+// Copyright 2020 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package openapi
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+)
+
+const (
+	defaultStreamingMinSize = 1 << 20
+	defaultMaxSpoolSize     = 1 << 30
+)
+
+// RequestStreaming configures streaming validation of large JSON request bodies.
+// Instead of reading the entire body into memory, the JSON token stream is validated
+// against the schema while the body is written to a temporary file. Validation stops
+// at the first violation. When the body is valid, the next handler reads the original
+// bytes from the temporary file.
+type RequestStreaming struct {
+	// Operations to validate request bodies for while streaming, identified by their
+	// operationId or by method and path, e.g. "POST /pets".
+	// Default is empty, resulting in all operations being validated while streaming
+	Operations []string `json:"operations,omitempty"`
+	// Minimum size in bytes of a request body to be validated while streaming. Bodies
+	// of unknown size are always validated while streaming.
+	// Default is 1MiB
+	MinSize int64 `json:"min_size,omitempty"`
+	// Directory to write request bodies to.
+	// Default is the default directory for temporary files
+	SpoolDir string `json:"spool_dir,omitempty"`
+	// Maximum size in bytes of a request body that is written to the spool directory.
+	// Larger bodies are rejected with 413 Request Entity Too Large.
+	// Default is 1GiB
+	MaxSpoolSize int64 `json:"max_spool_size,omitempty"`
+}
+
+// validate checks the RequestStreaming configuration
+func (s *RequestStreaming) validate() error {
+	if s.MinSize < 0 {
+		return fmt.Errorf("minimum size of streamed request bodies can't be negative")
+	}
+	if s.MaxSpoolSize < 0 {
+		return fmt.Errorf("maximum size of spooled request bodies can't be negative")
+	}
+	return nil
+}
+
+// maxSpoolSize returns the maximum size of a request body that is written to a temporary file
+func (v *Validator) maxSpoolSize() int64 {
+	if v.RequestStreaming == nil || v.RequestStreaming.MaxSpoolSize == 0 {
+		return defaultMaxSpoolSize
+	}
+	return v.RequestStreaming.MaxSpoolSize
+}
+
+// streamingSchema returns the schema to validate the request body against while streaming,
+// or nil when the request body should be validated by reading it into memory.
+func (v *Validator) streamingSchema(r *http.Request, input *openapi3filter.RequestValidationInput) *openapi3.Schema {
+
+	s := v.RequestStreaming
+	if s == nil || r.Body == nil || r.Body == http.NoBody {
+		return nil
+	}
+
+	route := input.Route
+	if len(s.Operations) > 0 {
+		found := false
+		for _, operation := range s.Operations {
+			if operation == route.Operation.OperationID || operation == operationKey(route) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil
+		}
+	}
+
+	minSize := s.MinSize
+	if minSize == 0 {
+		minSize = defaultStreamingMinSize
+	}
+	if r.ContentLength >= 0 && r.ContentLength < minSize {
+		return nil
+	}
+
+	requestBody := route.Operation.RequestBody
+	if requestBody == nil || requestBody.Value == nil {
+		return nil
+	}
+
+	contentType := r.Header.Get("Content-Type")
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil || (mediaType != "application/json" && !strings.HasSuffix(mediaType, "+json")) {
+		return nil
+	}
+
+	content := requestBody.Value.Content.Get(contentType)
+	if content == nil || content.Schema == nil {
+		return nil
+	}
+
+	return content.Schema.Value
+}
+
+// validateJSON returns a function for validating a JSON request body against the schema
+func validateJSON(schema *openapi3.Schema) func(r io.Reader) error {
+	return func(r io.Reader) error {
+		return validateJSONStream(r, schema)
+	}
+}
+
+// validateRequestStream validates an HTTP request according to an OpenAPI spec, validating
+// the request body using validateBody while streaming it to a temporary file. When the body
+// is invalid and blocks is set, validation stops early and the rest of the body isn't read.
+// Otherwise the request body is replaced by the temporary file, which is removed by the
+// returned function.
+func (v *Validator) validateRequestStream(rw http.ResponseWriter, r *http.Request, validationInput *openapi3filter.RequestValidationInput, validateBody func(r io.Reader) error, blocks bool) (func(), *oapiError) {
+
+	cleanup := func() {}
+
+	// The parameters are validated as usual; the body is validated while streaming
+	options := openapi3filter.Options{}
+	if validationInput.Options != nil {
+		options = *validationInput.Options
+	}
+	options.ExcludeRequestBody = true
+	parametersInput := *validationInput
+	parametersInput.Options = &options
+
+	parametersErr := v.validateRequest(rw, r, &parametersInput)
+	if parametersErr != nil && blocks {
+		return cleanup, parametersErr
+	}
+
+	spoolDir := ""
+	if v.RequestStreaming != nil {
+		spoolDir = v.RequestStreaming.SpoolDir
+	}
+	file, err := os.CreateTemp(spoolDir, "openapi-validator-request-*")
+	if err != nil {
+		return cleanup, &oapiError{
+			Code:     http.StatusInternalServerError,
+			Message:  fmt.Sprintf("error spooling request body: %s", err),
+			Internal: err,
+			phase:    phaseRequest,
+		}
+	}
+	cleanup = func() {
+		file.Close()
+		os.Remove(file.Name())
+	}
+
+	// Compressed bodies are validated while decoding them; the original body is spooled
+	spool := &spoolWriter{file: file, max: v.maxSpoolSize()}
+	var body io.Reader = io.TeeReader(r.Body, spool)
+	if encodings := contentEncodings(r.Header); len(encodings) > 0 {
+		decoder, err := newDecoder(encodings, body, v.maxDecompressedSize())
+		if err != nil {
+			return cleanup, decodingError(err)
+		}
+		defer decoder.Close()
+		body = decoder
+	}
+
+	serr := validateBody(body)
+	if serr == errEmptyJSONStream {
+		serr = nil
+		if validationInput.Route.Operation.RequestBody.Value.Required {
+			serr = errors.New("value is required but missing")
+		}
+	}
+
+	if oerr := requestTooLarge(serr); oerr != nil {
+		return cleanup, oerr
+	}
+	if spool.full() {
+		return cleanup, v.spoolTooLarge(r, spool, parametersErr, blocks)
+	}
+	if errors.Is(serr, errDecompressedTooLarge) {
+		return cleanup, decodingError(serr)
+	}
+
+	oerr := parametersErr
+	if serr != nil && oerr == nil {
+		oerr = &oapiError{
+			Code:     http.StatusBadRequest,
+			Message:  fmt.Sprintf("request body has an error: %s", serr),
+			Internal: serr,
+			phase:    phaseRequest,
+		}
+		if blocks {
+			return cleanup, oerr
+		}
+	}
+
+	// Copy what's left of the body, so that the next handler receives all of it
+	_, err = io.Copy(spool, r.Body)
+	if oerr := requestTooLarge(err); oerr != nil {
+		return cleanup, oerr
+	}
+	if spool.full() {
+		return cleanup, v.spoolTooLarge(r, spool, oerr, blocks)
+	}
+	if err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		return cleanup, &oapiError{
+			Code:     http.StatusInternalServerError,
+			Message:  fmt.Sprintf("error spooling request body: %s", err),
+			Internal: err,
+			phase:    phaseRequest,
+		}
+	}
+
+	r.Body.Close()
+	r.Body = io.NopCloser(file)
+
+	return cleanup, oerr
+}
+
+// errSpoolFull is returned when a request body exceeds the maximum size of the temporary file it's written to
+var errSpoolFull = errors.New("request body exceeds the maximum spool size")
+
+// spoolWriter writes a request body to a temporary file, up to a maximum size. The write
+// that exceeds the maximum is completed, so that no bytes that were read are lost.
+type spoolWriter struct {
+	file *os.File
+	max  int64
+	n    int64
+}
+
+func (s *spoolWriter) Write(p []byte) (int, error) {
+	n, err := s.file.Write(p)
+	s.n += int64(n)
+	if err == nil && s.full() {
+		err = errSpoolFull
+	}
+	return n, err
+}
+
+// full returns whether more than the maximum size has been written
+func (s *spoolWriter) full() bool {
+	return s.n > s.max
+}
+
+// spoolTooLarge handles a request body that exceeds the maximum spool size. Its body isn't validated any
+// further; unless blocks is set, the next handler receives the spooled bytes followed by the rest of the
+// body. An error that was found before the spool got full takes precedence.
+func (v *Validator) spoolTooLarge(r *http.Request, spool *spoolWriter, oerr *oapiError, blocks bool) *oapiError {
+
+	if oerr == nil {
+		oerr = &oapiError{
+			Code:     http.StatusRequestEntityTooLarge,
+			Message:  fmt.Sprintf("request body exceeds the maximum spool size of %d bytes", spool.max),
+			Internal: errSpoolFull,
+			phase:    phaseRequest,
+		}
+	}
+	if blocks {
+		return oerr
+	}
+
+	if _, err := spool.file.Seek(0, io.SeekStart); err != nil {
+		return &oapiError{
+			Code:     http.StatusInternalServerError,
+			Message:  fmt.Sprintf("error spooling request body: %s", err),
+			Internal: err,
+			phase:    phaseRequest,
+		}
+	}
+	r.Body = readCloser{Reader: io.MultiReader(spool.file, r.Body), Closer: r.Body}
+
+	return oerr
+}
+
+// streamViolation is a violation of a schema found while validating a JSON stream
+type streamViolation struct {
+	pointer string
+	reason  string
+}
+
+func (e *streamViolation) Error() string {
+	pointer := e.pointer
+	if pointer == "" {
+		pointer = "/"
+	}
+	return fmt.Sprintf("doesn't match schema at %q: %s", pointer, e.reason)
+}
+
+// jsonStreamValidator validates a stream of JSON tokens against a schema.
+// Objects and arrays are walked token by token; scalar values and values with
+// schemas that combine other schemas (allOf, anyOf, oneOf and not) are decoded
+// and validated as a whole. Keywords that require remembering all values, like
+// uniqueItems, are not checked.
+type jsonStreamValidator struct {
+	decoder *json.Decoder
+}
+
+// errEmptyJSONStream is returned when a JSON stream doesn't contain a value
+var errEmptyJSONStream = errors.New("empty JSON stream")
+
+// validateJSONStream validates the JSON value read from r against the schema. It returns
+// errEmptyJSONStream when r is empty and stops reading at the first violation.
+func validateJSONStream(r io.Reader, schema *openapi3.Schema) error {
+	s := &jsonStreamValidator{decoder: json.NewDecoder(r)}
+	if !s.decoder.More() {
+		if _, err := s.decoder.Token(); err == io.EOF {
+			return errEmptyJSONStream
+		} else if err != nil {
+			return err
+		}
+		return errors.New("invalid JSON value")
+	}
+	if err := s.value(schema, ""); err == io.EOF {
+		// The stream ended in the middle of the value
+		return io.ErrUnexpectedEOF
+	} else if err != nil {
+		return err
+	}
+	if _, err := s.decoder.Token(); err != io.EOF {
+		return errors.New("unexpected data after the JSON value")
+	}
+	return nil
+}
+
+// value validates the next JSON value
+func (s *jsonStreamValidator) value(schema *openapi3.Schema, pointer string) error {
+
+	if schema == nil || !streamable(schema) {
+		var value interface{}
+		if err := s.decoder.Decode(&value); err != nil {
+			return err
+		}
+		if schema == nil {
+			return nil
+		}
+		return schemaViolation(pointer, schema.VisitJSON(value, openapi3.VisitAsRequest()))
+	}
+
+	token, err := s.decoder.Token()
+	if err != nil {
+		return err
+	}
+
+	switch token {
+	case json.Delim('{'):
+		if schema.Type != "" && schema.Type != openapi3.TypeObject {
+			return &streamViolation{pointer: pointer, reason: expectedType(schema)}
+		}
+		return s.object(schema, pointer)
+	case json.Delim('['):
+		if schema.Type != "" && schema.Type != openapi3.TypeArray {
+			return &streamViolation{pointer: pointer, reason: expectedType(schema)}
+		}
+		return s.array(schema, pointer)
+	default:
+		return schemaViolation(pointer, schema.VisitJSON(token, openapi3.VisitAsRequest()))
+	}
+}
+
+// object validates the members of a JSON object, after its opening token has been read
+func (s *jsonStreamValidator) object(schema *openapi3.Schema, pointer string) error {
+
+	required := map[string]bool{}
+	for _, name := range schema.Required {
+		required[name] = true
+	}
+
+	count := uint64(0)
+	for s.decoder.More() {
+		token, err := s.decoder.Token()
+		if err != nil {
+			return err
+		}
+		name, _ := token.(string)
+		delete(required, name)
+
+		count++
+		if max := schema.MaxProps; max != nil && count > *max {
+			return &streamViolation{pointer: pointer, reason: fmt.Sprintf("maximum number of properties is %d", *max)}
+		}
+
+		var propertySchema *openapi3.Schema
+		if ref, ok := schema.Properties[name]; ok {
+			propertySchema = ref.Value
+			if propertySchema.ReadOnly {
+				return &streamViolation{pointer: pointer, reason: fmt.Sprintf("readOnly property %q in request", name)}
+			}
+		} else if has := schema.AdditionalProperties.Has; has != nil && !*has {
+			return &streamViolation{pointer: pointer, reason: fmt.Sprintf("property %q is unsupported", name)}
+		} else if ref := schema.AdditionalProperties.Schema; ref != nil {
+			propertySchema = ref.Value
+		}
+
+		if err := s.value(propertySchema, pointer+"/"+escapePointer(name)); err != nil {
+			return err
+		}
+	}
+
+	if _, err := s.decoder.Token(); err != nil {
+		return err
+	}
+
+	if count < schema.MinProps {
+		return &streamViolation{pointer: pointer, reason: fmt.Sprintf("there must be at least %d properties", schema.MinProps)}
+	}
+
+	for _, name := range schema.Required {
+		if required[name] {
+			return &streamViolation{pointer: pointer + "/" + escapePointer(name), reason: fmt.Sprintf("property %q is missing", name)}
+		}
+	}
+
+	return nil
+}
+
+// array validates the items of a JSON array, after its opening token has been read
+func (s *jsonStreamValidator) array(schema *openapi3.Schema, pointer string) error {
+
+	var items *openapi3.Schema
+	if schema.Items != nil {
+		items = schema.Items.Value
+	}
+
+	count := uint64(0)
+	for s.decoder.More() {
+		if max := schema.MaxItems; max != nil && count >= *max {
+			return &streamViolation{pointer: pointer, reason: fmt.Sprintf("maximum number of items is %d", *max)}
+		}
+		if err := s.value(items, pointer+"/"+strconv.FormatUint(count, 10)); err != nil {
+			return err
+		}
+		count++
+	}
+
+	if _, err := s.decoder.Token(); err != nil {
+		return err
+	}
+
+	if count < schema.MinItems {
+		return &streamViolation{pointer: pointer, reason: fmt.Sprintf("minimum number of items is %d", schema.MinItems)}
+	}
+
+	return nil
+}
+
+// streamable returns whether values for the schema can be walked token by token
+func streamable(schema *openapi3.Schema) bool {
+	if len(schema.AllOf) > 0 || len(schema.AnyOf) > 0 || len(schema.OneOf) > 0 || schema.Not != nil {
+		return false
+	}
+	return schema.Type == openapi3.TypeObject || schema.Type == openapi3.TypeArray
+}
+
+// expectedType returns the reason for a value not being of the type of the schema
+func expectedType(schema *openapi3.Schema) string {
+	a := "a"
+	switch schema.Type {
+	case openapi3.TypeArray, openapi3.TypeObject, openapi3.TypeInteger:
+		a = "an"
+	}
+	return fmt.Sprintf("value must be %s %s", a, schema.Type)
+}
+
+// schemaViolation turns an error returned by validating a (decoded) value into a streamViolation
+func schemaViolation(pointer string, err error) error {
+	if err == nil {
+		return nil
+	}
+	var serr *openapi3.SchemaError
+	if !errors.As(err, &serr) {
+		return &streamViolation{pointer: pointer, reason: err.Error()}
+	}
+	for _, key := range serr.JSONPointer() {
+		pointer += "/" + escapePointer(key)
+	}
+	return &streamViolation{pointer: pointer, reason: serr.Reason}
+}
+
+// escapePointer escapes a key for use in a JSON pointer
+func escapePointer(key string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(key)
+}
@@ -0,0 +1,165 @@
+// Copyright 2020 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package openapi
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/getkin/kin-openapi/openapi3"
+)
+
+// bodyAPI records the request body it receives
+type bodyAPI struct {
+	body string
+}
+
+// ServeHTTP reads the request body
+func (m *bodyAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) error {
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	m.body = string(data)
+	w.WriteHeader(http.StatusCreated)
+	return nil
+}
+
+func TestValidateJSONStream(t *testing.T) {
+	v, err := createValidator(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pets := v.specification.Components.Schemas["Pets"].Value
+
+	tests := []struct {
+		name    string
+		body    string
+		wantErr string
+	}{
+		{name: "valid", body: `[{"id": 1, "name": "Pet 1"}, {"id": 2, "name": "Pet 2", "tag": "dog"}]`},
+		{name: "empty array", body: `[]`},
+		{name: "missing property", body: `[{"id": 1, "name": "Pet 1"}, {"id": 2}]`, wantErr: `doesn't match schema at "/1/name": property "name" is missing`},
+		{name: "wrong type", body: `[{"id": "one", "name": "Pet 1"}]`, wantErr: `doesn't match schema at "/0/id": value must be an integer`},
+		{name: "not an array", body: `{"id": 1}`, wantErr: `doesn't match schema at "/": value must be an array`},
+		{name: "truncated", body: `[{"id": 1, "name": "Pet 1"}`, wantErr: "unexpected end of JSON input"},
+		{name: "trailing data", body: `[] []`, wantErr: "unexpected data after the JSON value"},
+		{name: "empty", body: ``, wantErr: "empty JSON stream"},
+	}
+
+	for _, tt := range tests {
+		err := validateJSONStream(strings.NewReader(tt.body), pets)
+		if tt.wantErr == "" && err != nil {
+			t.Errorf("unexpected error in test %s: %s", tt.name, err)
+		}
+		if tt.wantErr != "" && (err == nil || err.Error() != tt.wantErr) {
+			t.Errorf("unexpected error in test %s: got %v want %s", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestValidateJSONStreamFailsEarly(t *testing.T) {
+	v, err := createValidator(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pets := v.specification.Components.Schemas["Pets"].Value
+
+	// Reading beyond the first (invalid) item results in an error from the reader instead of a violation
+	body := io.MultiReader(strings.NewReader(`[{"id": 1}`), iotestErrReader{})
+	err = validateJSONStream(body, pets)
+
+	var violation *streamViolation
+	if !errors.As(err, &violation) {
+		t.Errorf("expected a violation for the first item: got %v", err)
+	}
+}
+
+// iotestErrReader fails every read
+type iotestErrReader struct{}
+
+func (iotestErrReader) Read([]byte) (int, error) {
+	return 0, errors.New("read beyond the first violation")
+}
+
+func TestRequestStreamingServeHTTP(t *testing.T) {
+	tests := []struct {
+		name         string
+		mode         EnforceMode
+		maxSpoolSize int64
+		body         string
+		wantStatus   int
+		wantOutcome  string
+		wantErr      bool
+		wantBody     bool
+	}{
+		{name: "valid", mode: EnforceModeBlock, body: `[{"id": 1, "name": "Pet 1"}]  `, wantStatus: http.StatusCreated, wantOutcome: "passed", wantBody: true},
+		{name: "invalid", mode: EnforceModeBlock, body: `[{"id": 1}, {"id": 2, "name": "Pet 2"}]`, wantStatus: http.StatusBadRequest, wantOutcome: "blocked", wantErr: true},
+		{name: "reported", mode: EnforceModeReport, body: `[{"id": 1}, {"id": 2, "name": "Pet 2"}]`, wantStatus: http.StatusCreated, wantOutcome: "reported", wantBody: true},
+		// Bodies larger than the spool aren't validated any further
+		{name: "spool full", mode: EnforceModeBlock, maxSpoolSize: 8, body: `[{"id": 1, "name": "Pet 1"}]`, wantStatus: http.StatusRequestEntityTooLarge, wantOutcome: "blocked", wantErr: true},
+		{name: "spool full reported", mode: EnforceModeReport, maxSpoolSize: 8, body: `[{"id": 1, "name": "Pet 1"}]`, wantStatus: http.StatusCreated, wantOutcome: "reported", wantBody: true},
+	}
+
+	for _, tt := range tests {
+		v, err := createValidator(t)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		v.Enforcement = &Enforcement{Request: tt.mode, Response: EnforceModeOff}
+		v.RequestStreaming = &RequestStreaming{Operations: []string{"createPets"}, SpoolDir: t.TempDir(), MaxSpoolSize: tt.maxSpoolSize}
+		n, err := replaceValidator(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The example specification doesn't define a request body for creating pets
+		n.specification.Paths.Find("/pets").Post.RequestBody = &openapi3.RequestBodyRef{
+			Value: openapi3.NewRequestBody().WithRequired(true).WithJSONSchemaRef(n.specification.Components.Schemas["Pets"]),
+		}
+
+		req, err := prepareRequest("POST", "http://localhost:9443/api/pets")
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Body = io.NopCloser(strings.NewReader(tt.body))
+		req.ContentLength = -1
+
+		recorder := httptest.NewRecorder()
+		api := &bodyAPI{}
+		err = n.ServeHTTP(recorder, req, api)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("unexpected error in test %s: %v", tt.name, err)
+		}
+
+		if status := recorder.Code; status != tt.wantStatus {
+			t.Errorf("handler returned wrong status code in test %s: got %v want %v", tt.name, status, tt.wantStatus)
+		}
+
+		if got := outcomeOf(req, phaseRequest); got != tt.wantOutcome {
+			t.Errorf("unexpected request outcome in test %s: got %s want %s", tt.name, got, tt.wantOutcome)
+		}
+
+		if tt.wantBody && api.body != tt.body {
+			t.Errorf("unexpected body passed on in test %s: got %q want %q", tt.name, api.body, tt.body)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright 2020 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package openapi
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/getkin/kin-openapi/openapi3"
+)
+
+// tokenVerifier verifies bearer tokens and returns their claims
+type tokenVerifier interface {
+	verify(ctx context.Context, token string) (map[string]interface{}, error)
+}
+
+// bearerToken returns the bearer token from the Authorization header
+func bearerToken(r *http.Request) (string, bool) {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return "", false
+	}
+	return strings.TrimPrefix(header, "Bearer "), true
+}
+
+// tokenVerifierFor returns the tokenVerifier for the bearer tokens of the security scheme and the
+// prefix of the placeholders for their claims. Introspection configured for the scheme takes
+// precedence. It returns nil when tokens for the scheme are not verified.
+func (v *Validator) tokenVerifierFor(ctx context.Context, name string, scheme *openapi3.SecurityScheme) (tokenVerifier, string, error) {
+
+	if introspector, ok := v.introspectors[name]; ok {
+		return introspector, ReplacerOpenAPIValidatorIntrospection, nil
+	}
+
+	switch {
+	case scheme.Type == "http" && v.jwt != nil && isJWTScheme(scheme), scheme.Type == "oauth2" && v.jwt != nil:
+		return v.jwt, ReplacerOpenAPIValidatorJWTClaims, nil
+	case scheme.Type == "openIdConnect" && v.oidc != nil:
+		verifier, err := v.oidc.verifier(ctx, scheme.OpenIdConnectUrl)
+		if err != nil {
+			return nil, "", err
+		}
+		return verifier, ReplacerOpenAPIValidatorJWTClaims, nil
+	}
+
+	return nil, "", nil
+}
+
+// authorizeToken verifies the token and checks that it was granted the required scopes. The
+// claims of the token are returned and set as placeholders with the prefix when it's authorized.
+func authorizeToken(ctx context.Context, r *http.Request, verifier tokenVerifier, prefix string, token string, required []string) (map[string]interface{}, error) {
+
+	claims, err := verifier.verify(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkScopes(required, grantedScopes(claims)); err != nil {
+		return nil, err
+	}
+
+	setClaims(r, prefix, claims)
+
+	return claims, nil
+}
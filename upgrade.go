@@ -0,0 +1,50 @@
+// Copyright 2020 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package openapi
+
+import (
+	"net/http"
+	"strings"
+)
+
+// websocketSchemes maps the scheme of a request to the scheme of a WebSocket server URL
+var websocketSchemes = map[string]string{
+	"http":  "ws",
+	"https": "wss",
+}
+
+// isUpgradeRequest returns whether the request asks to upgrade the connection to another
+// protocol, like WebSocket. The response to such a request is not validated, because the
+// connection is handed over to the protocol after the handshake.
+func isUpgradeRequest(r *http.Request) bool {
+	return r.Header.Get("Upgrade") != "" && headerContainsToken(r.Header, "Connection", "upgrade")
+}
+
+// isWebSocketUpgrade returns whether the request asks to upgrade the connection to WebSocket
+func isWebSocketUpgrade(r *http.Request) bool {
+	return isUpgradeRequest(r) && strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+}
+
+// headerContainsToken returns whether one of the comma separated values of the header is the token
+func headerContainsToken(header http.Header, name, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
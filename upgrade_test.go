@@ -0,0 +1,155 @@
+// Copyright 2020 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package openapi
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestIsUpgradeRequest(t *testing.T) {
+	tests := []struct {
+		name          string
+		connection    string
+		upgrade       string
+		wantUpgrade   bool
+		wantWebSocket bool
+	}{
+		{name: "websocket", connection: "Upgrade", upgrade: "websocket", wantUpgrade: true, wantWebSocket: true},
+		{name: "token list", connection: "keep-alive, upgrade", upgrade: "WebSocket", wantUpgrade: true, wantWebSocket: true},
+		{name: "h2c", connection: "Upgrade, HTTP2-Settings", upgrade: "h2c", wantUpgrade: true},
+		{name: "no connection token", connection: "keep-alive", upgrade: "websocket"},
+		{name: "no upgrade", connection: "upgrade"},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "http://localhost:9443/api/pets/1", nil)
+		req.Header.Set("Connection", tt.connection)
+		req.Header.Set("Upgrade", tt.upgrade)
+		if got := isUpgradeRequest(req); got != tt.wantUpgrade {
+			t.Errorf("unexpected upgrade in test %s: got %t want %t", tt.name, got, tt.wantUpgrade)
+		}
+		if got := isWebSocketUpgrade(req); got != tt.wantWebSocket {
+			t.Errorf("unexpected websocket upgrade in test %s: got %t want %t", tt.name, got, tt.wantWebSocket)
+		}
+	}
+}
+
+// hijackAPI switches protocols and echoes a line over the hijacked connection
+type hijackAPI struct{}
+
+// ServeHTTP hijacks the connection
+func (m *hijackAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) error {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		return fmt.Errorf("response writer can't be hijacked")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n")
+	rw.Flush()
+	line, err := rw.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	rw.WriteString("echo: " + line)
+	return rw.Flush()
+}
+
+func TestUpgradeServeHTTP(t *testing.T) {
+	var n *Validator
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		replacer := caddy.NewReplacer()
+		r = r.WithContext(context.WithValue(r.Context(), caddy.ReplacerCtxKey, replacer))
+		if err := n.ServeHTTP(w, r, &hijackAPI{}); err != nil {
+			t.Error(err)
+		}
+	}))
+
+	v, err := createValidator(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v.AdditionalServers = []string{fmt.Sprintf("ws://%s/api", server.Listener.Addr())}
+	n, err = replaceValidator(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server.Start()
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	fmt.Fprintf(conn, "GET /api/pets/1 HTTP/1.1\r\nHost: %s\r\nConnection: Upgrade\r\nUpgrade: websocket\r\nAccept: application/json\r\n\r\n", server.Listener.Addr())
+
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("unexpected status: got %d want %d", response.StatusCode, http.StatusSwitchingProtocols)
+	}
+
+	fmt.Fprint(conn, "hello\n")
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != "echo: hello\n" {
+		t.Errorf("unexpected message over the hijacked connection: %q", line)
+	}
+}
+
+func TestUpgradeHandshakeValidation(t *testing.T) {
+	v, err := createValidator(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The handshake is validated like any other request
+	req, err := prepareRequest("GET", "http://localhost:9443/api/petz/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+
+	recorder := httptest.NewRecorder()
+	err = v.ServeHTTP(recorder, req, &hijackAPI{})
+	if err == nil {
+		t.Error("expected the handshake for an unknown route to be blocked")
+	}
+
+	if status := recorder.Code; status != http.StatusNotFound {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusNotFound)
+	}
+}
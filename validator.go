@@ -16,16 +16,19 @@ package openapi
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
-	"strings"
 
 	"github.com/oxtoacart/bpool"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyevents"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/caddyserver/certmagic"
 	"github.com/getkin/kin-openapi/openapi3"
 	"github.com/getkin/kin-openapi/openapi3filter"
 	"github.com/getkin/kin-openapi/routers"
@@ -81,15 +84,113 @@ type Validator struct {
 	// requests and responses will be filtered and an (appropriate) status is returned
 	// Default is true
 	Enforce *bool `json:"enforce,omitempty"`
+	// Enforce modes (block, report or off) per validation phase: route, server,
+	// security, request and response. Overrides Enforce and the Validate*
+	// properties for the phases that have a mode configured.
+	// Default is empty, resulting in modes derived from Enforce and Validate*
+	Enforcement *Enforcement `json:"enforcement,omitempty"`
+	// Gradual rollout of enforcement. When configured, validation is only
+	// enforced for a share of the requests; the others are only reported.
+	// Default is nil, resulting in enforcement for all requests
+	Rollout *Rollout `json:"rollout,omitempty"`
+	// Circuit breaker that switches response validation for an operation to
+	// report-only when the ratio of invalid responses spikes.
+	// Default is nil, resulting in no circuit breaker
+	Breaker *Breaker `json:"breaker,omitempty"`
+	// Sampling of response validation, globally and per operation. Responses
+	// that are not sampled are passed through without buffering.
+	// Default is nil, resulting in all responses being validated
+	ResponseSampling *ResponseSampling `json:"response_sampling,omitempty"`
+	// Asynchronous validation of responses in report mode. Responses are
+	// streamed to the client and validated in the background.
+	// Default is nil, resulting in responses being validated before they're returned
+	AsyncResponses *AsyncResponses `json:"async_responses,omitempty"`
+	// Limits for buffering responses for validation. Responses that are larger
+	// than the limit are streamed without being validated or spilled to disk.
+	// Default is nil, resulting in responses being buffered in memory completely
+	ResponseBuffering *ResponseBuffering `json:"response_buffering,omitempty"`
+	// Validation of large JSON request bodies while streaming them, instead of
+	// reading them into memory completely.
+	// Default is nil, resulting in request bodies being read into memory
+	RequestStreaming *RequestStreaming `json:"request_streaming,omitempty"`
+	// The maximum size in bytes of request bodies, for operations without a limit
+	// set using the x-max-body-size extension or the maxLength of a string schema.
+	// Default is 0, resulting in no limit
+	MaxRequestBodySize int64 `json:"max_request_body_size,omitempty"`
+	// The maximum number of errors reported for the lines of a newline
+	// delimited JSON (NDJSON) request or response body.
+	// Default is 10
+	MaxLineErrors int `json:"max_line_errors,omitempty"`
+	// The maximum size in bytes of a compressed request or response body after
+	// decoding it for validation. Larger request bodies are rejected; the body of
+	// larger responses is not validated.
+	// Default is 16MiB
+	MaxDecompressedSize int64 `json:"max_decompressed_size,omitempty"`
+	// Answering OPTIONS requests for paths in the specification that don't have an
+	// OPTIONS operation. The Allow header lists the methods of the operations for the path.
+	// Default is false, resulting in OPTIONS requests being handled like other requests
+	AnswerOptions bool `json:"answer_options,omitempty"`
+	// Answering CORS preflight requests based on the operations in the specification.
+	// Also sets the CORS headers for cross-origin requests and implies AnswerOptions.
+	// Default is nil, resulting in no CORS handling
+	CORS *CORS `json:"cors,omitempty"`
+	// Validating HEAD requests for paths without a HEAD operation against the GET
+	// operation. The response headers and status are validated; the body is not.
+	// Default is false, resulting in HEAD requests requiring a HEAD operation
+	HeadAsGet bool `json:"head_as_get,omitempty"`
+	// Verification of JSON Web Tokens for http security schemes with the bearer scheme
+	// against a JSON Web Key Set.
+	// Default is nil, resulting in any bearer token being accepted
+	JWT *JWT `json:"jwt,omitempty"`
+	// Verification of tokens for openIdConnect security schemes, using the
+	// discovery document at the openIdConnectUrl of the scheme.
+	// Default is nil, resulting in openIdConnect schemes not being checked
+	OpenIDConnect *OpenIDConnect `json:"openid_connect,omitempty"`
+	// OAuth 2.0 token introspection (RFC 7662) by security scheme name, for
+	// opaque bearer tokens. Takes precedence over jwt and openid_connect.
+	// Default is empty, resulting in no introspection
+	Introspection map[string]*Introspection `json:"introspection,omitempty"`
+	// Checking the credentials for http security schemes with the basic scheme against
+	// accounts with bcrypt hashed passwords.
+	// Default is nil, resulting in any credentials being accepted
+	BasicAuth *BasicAuth `json:"basic_auth,omitempty"`
+	// Checking the keys for apiKey security schemes against a key store that
+	// maps them to a client identity and the scopes they're allowed.
+	// Default is nil, resulting in any non-empty key being accepted
+	APIKeys *APIKeys `json:"api_keys,omitempty"`
+	// Constraints on the client certificates for mutualTLS security schemes by
+	// security scheme name. Client certificates should be verified by the TLS server.
+	// Default is empty, resulting in any verified client certificate being accepted
+	MutualTLS map[string]*MutualTLS `json:"mutual_tls,omitempty"`
+	// Modules in the http.handlers.openapi_validator.security namespace by the name of
+	// the security scheme they validate. They take precedence over the checks above.
+	// Default is empty, resulting in the checks above being used for all security schemes
+	SecurityRaw map[string]json.RawMessage `json:"security,omitempty" caddy:"namespace=http.handlers.openapi_validator.security inline_key=validator"`
 	// To log or not to log
 	// Default is true
 	Log *bool `json:"log,omitempty"`
 
-	specification *openapi3.T
-	options       *validatorOptions
-	router        routers.Router
-	logger        *zap.Logger
-	bufferPool    *bpool.BufferPool
+	specification      *openapi3.T
+	options            *validatorOptions
+	modes              enforcementModes
+	router             routers.Router
+	serverlessRouter   routers.Router
+	serverBasePaths    []string
+	apiKeySchemes      []*openapi3.SecurityScheme
+	eventSchemas       eventSchemas
+	jwt                *jwtVerifier
+	oidc               *oidcProviders
+	introspectors      map[string]*introspector
+	basicAuth          *basicAuthenticator
+	apiKeys            apiKeyStore
+	storage            certmagic.Storage
+	securityValidators map[string]SecuritySchemeValidator
+	breakers           *breakers
+	async              *asyncValidator
+	ctx                caddy.Context
+	events             *caddyevents.App
+	logger             *zap.Logger
+	bufferPool         *bpool.BufferPool
 }
 
 // CaddyModule returns the Caddy module information.
@@ -103,28 +204,142 @@ func (Validator) CaddyModule() caddy.ModuleInfo {
 // Provision sets up the OpenAPI Validator responder.
 func (v *Validator) Provision(ctx caddy.Context) error {
 
+	v.ctx = ctx
 	v.logger = ctx.Logger(v)
+	v.storage = ctx.Storage()
 	defer v.logger.Sync()
 
 	v.bufferPool = bpool.NewBufferPool(64)
 
+	validatorMetrics.init.Do(initValidatorMetrics)
+
 	err := v.prepareOpenAPISpecification()
 	if err != nil {
 		return err
 	}
 
+	if err := v.provisionSecurityValidators(ctx); err != nil {
+		return err
+	}
+
+	if v.Rollout != nil {
+		validatorMetrics.rolloutPercentage.WithLabelValues(v.Filepath).Set(v.Rollout.Percentage)
+	}
+
+	if v.Breaker != nil {
+		eventsAppIface, err := ctx.App("events")
+		if err != nil {
+			return fmt.Errorf("getting events app: %v", err)
+		}
+		v.events = eventsAppIface.(*caddyevents.App)
+		v.breakers = newBreakers(v.Breaker)
+		v.breakers.onChange = v.breakerChanged
+	}
+
+	if v.AsyncResponses != nil {
+		v.async = newAsyncValidator(v.AsyncResponses)
+		v.async.validate = v.validateAsync
+		v.async.drop = v.dropAsync
+		v.async.start()
+	}
+
 	return nil
 }
 
 // Validate validates the configuration of the Validator
 func (v *Validator) Validate() error {
 
-	shouldValidateRoutes := v.ValidateRoutes == nil || *v.ValidateRoutes
-	shouldValidateRequests := v.ValidateRequests == nil || *v.ValidateRequests
-	shouldValidateResponses := v.ValidateResponses == nil || *v.ValidateResponses
+	modes, err := v.resolveEnforcementModes()
+	if err != nil {
+		return err
+	}
+
+	if (modes.validates(phaseSecurity) || modes.validates(phaseRequest) || modes.validates(phaseResponse)) && !modes.validates(phaseRoute) {
+		return fmt.Errorf("route validation can't be disabled when validation of security, requests or responses is enabled")
+	}
+
+	if v.Rollout != nil {
+		if err := v.Rollout.validate(); err != nil {
+			return err
+		}
+	}
+
+	if v.Breaker != nil {
+		if err := v.Breaker.validate(); err != nil {
+			return err
+		}
+	}
+
+	if v.ResponseSampling != nil {
+		if err := v.ResponseSampling.validate(); err != nil {
+			return err
+		}
+	}
 
-	if (shouldValidateRequests || shouldValidateResponses) && !shouldValidateRoutes {
-		return fmt.Errorf("route validation can't be disabled when validation of requests or responses is enabled")
+	if v.AsyncResponses != nil {
+		if err := v.AsyncResponses.validate(); err != nil {
+			return err
+		}
+	}
+
+	if v.ResponseBuffering != nil {
+		if err := v.ResponseBuffering.validate(); err != nil {
+			return err
+		}
+	}
+
+	if v.RequestStreaming != nil {
+		if err := v.RequestStreaming.validate(); err != nil {
+			return err
+		}
+	}
+
+	if v.CORS != nil {
+		if err := v.CORS.validate(); err != nil {
+			return err
+		}
+	}
+
+	if v.JWT != nil {
+		if err := v.JWT.validate(); err != nil {
+			return err
+		}
+	}
+
+	if v.OpenIDConnect != nil {
+		if err := v.OpenIDConnect.validate(); err != nil {
+			return err
+		}
+	}
+
+	for name, introspection := range v.Introspection {
+		if err := introspection.validate(); err != nil {
+			return fmt.Errorf("security scheme %q: %w", name, err)
+		}
+	}
+
+	if v.BasicAuth != nil {
+		if err := v.BasicAuth.validate(); err != nil {
+			return err
+		}
+	}
+
+	if v.APIKeys != nil {
+		if err := v.APIKeys.validate(); err != nil {
+			return err
+		}
+	}
+
+	if v.MaxRequestBodySize < 0 {
+		return fmt.Errorf("maximum request body size can't be negative")
+	}
+
+	if v.MaxLineErrors < 0 {
+		return fmt.Errorf("maximum number of line errors can't be negative")
+	}
+
+	if v.MaxDecompressedSize < 0 {
+		return fmt.Errorf("maximum decompressed size can't be negative")
 	}
 
 	// TODO: add functionality (and configuration) for validation of the provided specification
@@ -141,55 +356,173 @@ func (v *Validator) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddy
 	replacer := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
 	replacer.Set(ReplacerOpenAPIValidatorErrorMessage, "")
 	replacer.Set(ReplacerOpenAPIValidatorStatusCode, -1)
+	resetOutcomes(replacer)
+
+	modes := v.modes
+
+	if v.Rollout != nil {
+		bucket := v.rolloutBucket(r)
+		replacer.Set(ReplacerOpenAPIValidatorRolloutBucket, bucket)
+		if bucket == rolloutBucketReportOnly {
+			modes = modes.reportOnly()
+		}
+		defer v.observeRollout(replacer, bucket)
+	}
 
-	if v.ValidateRoutes == nil || *v.ValidateRoutes {
+	if v.CORS != nil && !isPreflight(r) {
+		// CORS headers are set before validating, so that clients can read errors too
+		v.CORS.setHeaders(w, r)
+	}
+
+	if modes.validates(phaseRoute) {
 		requestValidationInput, oerr = v.validateRoute(r)
+		if oerr != nil && oerr.phase == phaseServer {
+			if v.handleError(w, replacer, modes, oerr) {
+				return oerr
+			}
+			// The server is only reported; look up the route without taking the servers into account
+			requestValidationInput, oerr = v.validateRouteIgnoringServers(r)
+		} else if modes.validates(phaseServer) {
+			setOutcome(replacer, phaseServer, outcomePassed)
+		}
+		if oerr != nil && oerr.allowed != nil && r.Method == http.MethodOptions && v.answersOptions() {
+			// The path has no OPTIONS operation, so OPTIONS is answered with the methods of its operations
+			setOutcome(replacer, phaseRoute, outcomePassed)
+			v.serveOptions(w, r, oerr.allowed)
+			return nil
+		}
 		if oerr != nil {
-			v.logError(oerr)
+			if v.handleError(w, replacer, modes, oerr) {
+				return oerr
+			}
+		} else {
+			setOutcome(replacer, phaseRoute, outcomePassed)
+		}
+	}
 
-			// TODO: we should generate an error response here based on some of the returned data? in what format? (configured or via accept headers?)
-			replacer.Set(ReplacerOpenAPIValidatorErrorMessage, oerr.Error())
-			replacer.Set(ReplacerOpenAPIValidatorStatusCode, oerr.Code)
+	// Without a route there's nothing to validate the request and response against
+	if requestValidationInput == nil {
+		return next.ServeHTTP(w, r)
+	}
 
-			if v.shouldEnforce() {
-				w.Header().Set("Content-Type", "application/json") // TODO: set the proper type, based on Accept header?
-				w.WriteHeader(oerr.Code)                           // TODO: find out if this is required; it seems it is.
+	if modes.validates(phaseSecurity) {
+		oerr := v.validateSecurity(r, requestValidationInput)
+		if oerr != nil {
+			if v.handleError(w, replacer, modes, oerr) {
 				return oerr
 			}
+		} else {
+			setOutcome(replacer, phaseSecurity, outcomePassed)
 		}
 	}
 
-	if v.ValidateRequests == nil || *v.ValidateRequests {
-		oerr := v.validateRequest(w, r, requestValidationInput)
+	if modes.validates(phaseRequest) {
+		// Requests with unsupported media types and requests that are too large are rejected before reading their body
+		exceeded := func() *oapiError { return nil }
+		oerr := v.validateContentNegotiation(r, requestValidationInput)
+		if oerr == nil {
+			exceeded, oerr = v.limitRequestBody(w, r, requestValidationInput, modes.blocks(phaseRequest))
+		}
+		if oerr == nil {
+			var validateBody func(io.Reader) error
+			if schema := v.streamingSchema(r, requestValidationInput); schema != nil {
+				validateBody = validateJSON(schema)
+			} else if schema := requestLineSchema(r, requestValidationInput); schema != nil {
+				validateBody = v.validateLines(schema)
+			}
+			if validateBody != nil {
+				var cleanup func()
+				cleanup, oerr = v.validateRequestStream(w, r, requestValidationInput, validateBody, modes.blocks(phaseRequest))
+				defer cleanup()
+			} else {
+				oerr = v.validateRequest(w, r, requestValidationInput)
+			}
+			if tooLarge := exceeded(); tooLarge != nil {
+				oerr = tooLarge
+			}
+		}
 		if oerr != nil {
-			v.logError(oerr)
-
-			// TODO: we should generate an error response here based on some of the returned data? in what format? (configured or via accept headers?)
-			replacer.Set(ReplacerOpenAPIValidatorErrorMessage, oerr.Error())
-			replacer.Set(ReplacerOpenAPIValidatorStatusCode, oerr.Code)
-
-			if v.shouldEnforce() {
-				w.Header().Set("Content-Type", "application/json")
-				w.WriteHeader(oerr.Code)
+			if v.handleError(w, replacer, modes, oerr) {
 				return oerr
 			}
+		} else {
+			setOutcome(replacer, phaseRequest, outcomePassed)
 		}
 	}
 
 	// In case we shouldn't validate responses, we're going to execute the next handler and return early (less overhead)
-	if v.ValidateResponses != nil && !*v.ValidateResponses {
+	if !modes.validates(phaseResponse) {
+		return next.ServeHTTP(w, r)
+	}
+
+	// The connection of upgrade requests is handed over to another protocol, like WebSocket, after
+	// the handshake, so the response is passed through directly to allow hijacking the connection.
+	if isUpgradeRequest(r) {
+		v.logger.Debug(fmt.Sprintf("not validating response to %s upgrade request", r.Header.Get("Upgrade")))
 		return next.ServeHTTP(w, r)
 	}
 
-	// In case we should validate responses, we need to record the response and read that before returning the response
-	buffer := v.bufferPool.Get()
-	defer v.bufferPool.Put(buffer)
+	operation := operationKey(requestValidationInput.Route)
+	if v.breakers != nil && modes.blocks(phaseResponse) && v.breakers.open(operation) {
+		// The breaker for the operation is open; responses are only reported until the cool-down has passed
+		modes = modes.with(phaseResponse, EnforceModeReport)
+	}
+
+	rate := v.responseSampleRate(requestValidationInput.Route)
+	if !sampleResponse(rate) {
+		// The response is not sampled; it's streamed to the client directly
+		v.observeResponse(operation, rate, sampleNotSampled, false)
+		return next.ServeHTTP(w, r)
+	}
 
+	if v.async != nil && !modes.blocks(phaseResponse) && v.async.handles(requestValidationInput) {
+		// The response is only reported, so it can be validated after it has been returned
+		setOutcome(replacer, phaseResponse, outcomeDeferred)
+		return v.serveAsync(w, r, next, requestValidationInput, operation, rate)
+	}
+
+	// In case we should validate responses, we need to record the response and read that before returning the response.
+	// Responses of which the body isn't validated are streamed directly, unless their status or headers are invalid.
+	// Streams of Server-Sent Events and newline delimited JSON are never buffered; they're validated while they're streamed.
+	var headerErr *oapiError
+	var recorder *responseRecorder
+	var tapped streamValidator
+	bypassed, streamed := false, false
 	shouldBuffer := func(status int, header http.Header) bool {
-		// TODO: add logic for performing buffering vs. not doing it; what is logical to do?
-		return true
+		if isEventStream(header) {
+			streamed = true
+			headerErr = v.validateResponse(r.Context(), status, header, http.NoBody, 0, requestValidationInput)
+			if schemas := v.eventSchemasFor(requestValidationInput, status, header); schemas != nil {
+				tapped = decodingTap(header, newEventStreamValidator(schemas, func(oerr *oapiError) { v.logError(oerr) }))
+				recorder.Tap(tapped)
+			}
+			return false
+		}
+		if schema := responseLineSchema(requestValidationInput, status, header); schema != nil {
+			// Newline delimited JSON is validated line by line while it's streamed
+			streamed = true
+			headerErr = v.validateResponse(r.Context(), status, header, http.NoBody, 0, requestValidationInput)
+			tapped = decodingTap(header, newLineValidator(schema, openapi3.VisitAsResponse(), v.maxLineErrors(), func(err error) { v.logError(fmt.Errorf("response body has an error: %w", err)) }))
+			recorder.Tap(tapped)
+			return false
+		}
+		if responseBodyValidated(requestValidationInput, status, header) {
+			// Responses that are known to be too large are streamed without being validated
+			return !v.responseTooLarge(header)
+		}
+		bypassed = true
+		headerErr = v.validateResponse(r.Context(), status, header, http.NoBody, -1, requestValidationInput)
+		return headerErr != nil && modes.blocks(phaseResponse)
 	}
-	recorder := caddyhttp.NewResponseRecorder(w, buffer, shouldBuffer)
+	recorder = v.newRecorder(w, shouldBuffer)
+	defer v.bufferPool.Put(recorder.buf)
+	defer recorder.Close()
+	defer func() {
+		// Make sure streams are no longer decoded when handling the response fails
+		if tapped != nil {
+			tapped.result()
+		}
+	}()
 
 	// Continue down the handler stack, recording the response, so that we can work with it afterwards
 	err := next.ServeHTTP(recorder, r)
@@ -197,29 +530,72 @@ func (v *Validator) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddy
 		return err
 	}
 
-	// TODO: handle the case that the response is empty (i.e. 404, 204, etc)?
+	if streamed {
+		// The response has been streamed already, so violations can only be reported
+		modes = modes.with(phaseResponse, EnforceModeReport)
+	}
 
-	if !recorder.Buffered() {
-		// TODO: do we need to do something with this?
-		//return nil
+	if !recorder.Buffered() && !bypassed && !streamed {
+		// The response was too large to be buffered and has been streamed without being validated
+		replacer.Set(ReplacerOpenAPIValidatorResponseBuffer, bufferOverflow)
+		v.observeBuffering(operation, bufferOverflow)
+		v.logger.Debug(fmt.Sprintf("response for %s too large to be validated (%d bytes)", operation, recorder.Size()))
+		// The breaker doesn't count the response, because it's not known whether it was valid
+		v.observeResponse(operation, rate, sampleOverflow, false)
+		return nil
+	}
+
+	// Validating a body reads it into memory, so the body of spilled responses above the limit isn't validated
+	spilledTooLarge := recorder.Spilled() && v.spillTooLarge(recorder.Size())
+
+	switch {
+	case streamed:
+		replacer.Set(ReplacerOpenAPIValidatorResponseBuffer, bufferStream)
+		v.observeBuffering(operation, bufferStream)
+	case !recorder.Buffered():
+		replacer.Set(ReplacerOpenAPIValidatorResponseBuffer, bufferBypass)
+		v.observeBuffering(operation, bufferBypass)
+	case spilledTooLarge:
+		replacer.Set(ReplacerOpenAPIValidatorResponseBuffer, bufferOverflow)
+		v.observeBuffering(operation, bufferOverflow)
+		v.logger.Debug(fmt.Sprintf("spilled response for %s too large to validate its body (%d bytes)", operation, recorder.Size()))
+	case recorder.Spilled():
+		replacer.Set(ReplacerOpenAPIValidatorResponseBuffer, bufferDisk)
+		v.observeBuffering(operation, bufferDisk)
+	default:
+		replacer.Set(ReplacerOpenAPIValidatorResponseBuffer, bufferMemory)
+		v.observeBuffering(operation, bufferMemory)
 	}
 
 	// TODO: can we validate additional/superfluous fields? And make that configurable? The validator configured now does not seem to do that.
-	oerr = v.validateResponse(recorder, r, requestValidationInput)
+	if spilledTooLarge {
+		// Only the status and headers are validated
+		oerr = v.validateResponse(r.Context(), recorder.Status(), recorder.Header(), http.NoBody, 0, requestValidationInput)
+	} else if recorder.Buffered() {
+		body, err := recorder.Body()
+		if err != nil {
+			return err
+		}
+		oerr = v.validateResponse(r.Context(), recorder.Status(), recorder.Header(), body, recorder.Size(), requestValidationInput)
+	} else {
+		// The status and headers of responses that bypassed buffering have been validated already
+		oerr = headerErr
+		if oerr == nil && tapped != nil {
+			oerr = tapped.result()
+		}
+	}
+	if v.breakers != nil {
+		v.breakers.record(operation, oerr != nil)
+	}
+	v.observeResponse(operation, rate, sampleValidated, oerr != nil)
 	if oerr != nil {
 		// TODO: we should generate an error response here based on some of the returned data? in what format? (configured or via accept headers?)
 		// TODO: we might also want to send this information in some other way, like setting a header, only logging, or in response format itself
-
-		v.logError(oerr)
-
-		replacer.Set(ReplacerOpenAPIValidatorErrorMessage, oerr.Error())
-		replacer.Set(ReplacerOpenAPIValidatorStatusCode, oerr.Code)
-
-		if v.shouldEnforce() {
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(oerr.Code)
+		if v.handleError(w, replacer, modes, oerr) {
 			return oerr
 		}
+	} else {
+		setOutcome(replacer, phaseResponse, outcomePassed)
 	}
 
 	// TODO: we've wrapped the handler chain and are at the end; if there are errors, we may want to override the response and its
@@ -230,6 +606,39 @@ func (v *Validator) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddy
 	return recorder.WriteResponse() // Actually writes the response (after having buffered the bytes) the easy way; returning underlying errors (if any)
 }
 
+// Cleanup stops the workers validating responses asynchronously
+func (v *Validator) Cleanup() error {
+	if v.async != nil {
+		v.async.stop()
+	}
+	return nil
+}
+
+// handleError logs and records a validation error. When the phase the error
+// occurred in is enforced, the error status is written and true is returned.
+func (v *Validator) handleError(w http.ResponseWriter, replacer *caddy.Replacer, modes enforcementModes, oerr *oapiError) bool {
+
+	v.logError(oerr)
+
+	// TODO: we should generate an error response here based on some of the returned data? in what format? (configured or via accept headers?)
+	replacer.Set(ReplacerOpenAPIValidatorErrorMessage, oerr.Error())
+	replacer.Set(ReplacerOpenAPIValidatorStatusCode, oerr.Code)
+
+	if !modes.blocks(oerr.phase) {
+		setOutcome(replacer, oerr.phase, outcomeReported)
+		return false
+	}
+
+	setOutcome(replacer, oerr.phase, outcomeBlocked)
+	for name, values := range oerr.header {
+		w.Header()[name] = values
+	}
+	w.Header().Set("Content-Type", "application/json") // TODO: set the proper type, based on Accept header?
+	w.WriteHeader(oerr.Code)                           // TODO: find out if this is required; it seems it is.
+
+	return true
+}
+
 func (v *Validator) prepareOpenAPISpecification() error {
 
 	// TODO: provide option to continue, even though the file does not exist? Like simply passing on to the next handler, without anything else?
@@ -242,6 +651,12 @@ func (v *Validator) prepareOpenAPISpecification() error {
 		return err
 	}
 
+	modes, err := v.resolveEnforcementModes()
+	if err != nil {
+		return err
+	}
+	v.modes = modes
+
 	specification = addAdditionalServers(specification, v.AdditionalServers)
 
 	if !v.shouldValidateServers() {
@@ -256,39 +671,87 @@ func (v *Validator) prepareOpenAPISpecification() error {
 	// TODO: disable server and security validation on non-top-level; i.e. specific routes?
 
 	v.specification = specification
+	v.apiKeySchemes = apiKeySecuritySchemes(specification)
+	v.eventSchemas, err = eventSchemasOf(specification)
+	if err != nil {
+		return err
+	}
+
+	if v.JWT != nil {
+		v.jwt = newJWTVerifier(v.JWT, v.logger)
+	}
+
+	if v.OpenIDConnect != nil {
+		v.oidc = newOIDCProviders(v.OpenIDConnect, v.logger)
+	}
+
+	v.introspectors = map[string]*introspector{}
+	for name, introspection := range v.Introspection {
+		v.introspectors[name] = newIntrospector(introspection)
+	}
+
+	if v.BasicAuth != nil {
+		v.basicAuth, err = newBasicAuthenticator(v.BasicAuth)
+		if err != nil {
+			return err
+		}
+	}
+
+	if v.APIKeys != nil {
+		v.apiKeys, err = newAPIKeyStore(v.APIKeys, v.storage, v.logger)
+		if err != nil {
+			return err
+		}
+	}
 
 	// TODO: validate the specification in Validate() too? Does that work with the changes above?
 
 	// TODO: pass in validation options to NewRouter()?
-	router, err := legacy.NewRouter(v.specification)
+	err = withoutMutualTLSSchemes(specification, func() error {
+		router, err := legacy.NewRouter(v.specification)
+		if err != nil {
+			return err
+		}
+		v.router = router
+
+		if len(specification.Servers) > 0 && (!v.modes.blocks(phaseServer) || v.Rollout != nil) {
+			// Servers are only reported, either always or for requests in the report-only rollout
+			// bucket, so routes are also looked up without taking servers into account
+			serverless := *specification
+			serverless.Servers = nil
+			v.serverlessRouter, err = legacy.NewRouter(&serverless)
+			if err != nil {
+				return err
+			}
+			v.serverBasePaths = serverBasePaths(specification.Servers)
+		}
+		return nil
+	})
 	if err != nil {
 		return err
 	}
-	v.router = router
 
 	v.options = &validatorOptions{
 		Options: openapi3filter.Options{
 			ExcludeRequestBody:    false,
 			ExcludeResponseBody:   false,
 			IncludeResponseStatus: true,
-			AuthenticationFunc:    v.createAuthenticationFunc(),
+			// Security requirements are validated separately from the request, using AuthenticationFunc below
+			AuthenticationFunc: openapi3filter.NoopAuthenticationFunc,
 		},
 		//ParamDecoder: ,
+		AuthenticationFunc: v.createAuthenticationFunc(),
 	}
 
 	return nil
 }
 
 func (v *Validator) shouldValidateServers() bool {
-	return v.ValidateServers == nil || *v.ValidateServers
+	return v.modes.validates(phaseServer)
 }
 
 func (v *Validator) shouldValidateSecurity() bool {
-	return v.ValidateSecurity == nil || *v.ValidateSecurity
-}
-
-func (v *Validator) shouldEnforce() bool {
-	return v.Enforce == nil || *v.Enforce
+	return v.modes.validates(phaseSecurity)
 }
 
 func (v *Validator) logError(err error) {
@@ -310,69 +773,99 @@ func (v *Validator) createAuthenticationFunc() func(c context.Context, input *op
 
 	return func(c context.Context, input *openapi3filter.AuthenticationInput) error {
 
-		// TODO: Can we perform validation of multiple security methods here, like multiple API keys?
-		// That wil only work if the openapi3filter library does it correctly right now. Otherwise
-		// that will need to be patched or we need a workaround for it.
-		// TODO: should we check scopes too?
+		// The function is called for each scheme of a security requirement; combining the
+		// results of the schemes and the requirements is done by validateSecurityRequirements.
 
 		scheme := input.SecurityScheme
 		request := input.RequestValidationInput.Request
 
+		if validator, ok := v.securityValidators[input.SecuritySchemeName]; ok {
+			identity, err := validator.ValidateSecurityScheme(&SecurityInput{
+				Name:        input.SecuritySchemeName,
+				Scheme:      scheme,
+				Scopes:      input.Scopes,
+				Request:     request,
+				MaxBodySize: v.requestBodyLimit(request, input.RequestValidationInput),
+			})
+			if err != nil {
+				return err
+			}
+			setIdentity(request, identity)
+			return nil
+		}
+
 		switch scheme.Type {
 		case "http":
 			switch scheme.Scheme {
 			case "basic":
-				if _, _, ok := request.BasicAuth(); !ok {
-					return fmt.Errorf("no HTTP basic authentication credentials provided")
+				if v.basicAuth == nil {
+					if _, _, ok := request.BasicAuth(); !ok {
+						return fmt.Errorf("no HTTP basic authentication credentials provided")
+					}
+					return nil
 				}
+				username, err := v.basicAuth.authenticate(request)
+				if err != nil {
+					return err
+				}
+				setIdentity(request, &Identity{ID: username})
 				return nil
 			case "bearer":
-				header := request.Header.Get("Authorization")
-				if !strings.HasPrefix(header, "Bearer ") {
+				token, ok := bearerToken(request)
+				if !ok {
 					return fmt.Errorf("no HTTP bearer authentication provided")
 				}
-				return nil
+				verifier, prefix, err := v.tokenVerifierFor(c, input.SecuritySchemeName, scheme)
+				if err != nil {
+					return err
+				}
+				if verifier == nil {
+					return nil
+				}
+				_, err = authorizeToken(c, request, verifier, prefix, token, input.Scopes)
+				return err
 			default:
 				// TODO: should we add a case for other HTTP schemes as defined by RFC 7235 and HTTP Authentication Scheme Registry?
 				// These should then probably be in the Authorization header too?
 				return fmt.Errorf("invalid http scheme %s for credentials", scheme.Scheme)
 			}
 		case "apiKey":
-			name := scheme.Name
-			switch scheme.In {
-			case "query":
-				key := request.URL.Query().Get(name)
-				if key == "" {
-					return fmt.Errorf("failed to retrieve API key from query parameter %s", name)
-				}
-				return nil
-			case "header":
-				canonicalName := http.CanonicalHeaderKey(name)
-				header := request.Header.Get(canonicalName)
-				if header == "" {
-					return fmt.Errorf("failed to retrieve API key from header %s (canonicalized to: %s)", name, canonicalName)
-				}
-				return nil
-			case "cookie":
-				// TODO: do we also need to check CSRF tokens?
-				_, err := request.Cookie(name)
-				if err != nil {
-					return fmt.Errorf("failed to retrieve cookie (%s): %s", name, err.Error())
-				}
+			key, err := apiKey(request, scheme)
+			if err != nil {
+				return err
+			}
+			if v.apiKeys == nil {
 				return nil
-			default:
-				return fmt.Errorf("invalid property %s for carrying an apiKey", scheme.In)
 			}
-		case "oauth2":
-			// TODO: is this checkable? If so, we should implement the check.
-			//return fmt.Errorf("oauth2 security scheme check for %q not implemented yet", input.SecuritySchemeName)
-			v.logger.Debug(fmt.Sprintf("oauth2 security scheme check for %q not implemented (yet)", input.SecuritySchemeName))
+			client, err := authorizeAPIKey(c, v.apiKeys, key, input.Scopes)
+			if err != nil {
+				return err
+			}
+			setIdentity(request, &Identity{ID: client.Client})
 			return nil
-		case "openIdConnect":
-			// TODO: is this checkable? If so, we should implement the check.
-			//return fmt.Errorf("openidconnect security scheme check for %q not implemented yet", input.SecuritySchemeName)
-			v.logger.Debug(fmt.Sprintf("openidconnect security scheme check for %q not implemented )(yet)", input.SecuritySchemeName))
+		case "mutualTLS":
+			cert, err := authorizeClientCertificate(request, v.MutualTLS[input.SecuritySchemeName])
+			if err != nil {
+				return err
+			}
+			setCertificate(request, cert)
+			setIdentity(request, certificateIdentity(cert))
 			return nil
+		case "oauth2", "openIdConnect":
+			verifier, prefix, err := v.tokenVerifierFor(c, input.SecuritySchemeName, scheme)
+			if err != nil {
+				return err
+			}
+			if verifier == nil {
+				v.logger.Debug(fmt.Sprintf("%s security scheme check for %q requires token verification to be configured", scheme.Type, input.SecuritySchemeName))
+				return nil
+			}
+			token, ok := bearerToken(request)
+			if !ok {
+				return fmt.Errorf("no bearer token provided for %s security scheme %q", scheme.Type, input.SecuritySchemeName)
+			}
+			_, err = authorizeToken(c, request, verifier, prefix, token, input.Scopes)
+			return err
 		default:
 			return fmt.Errorf("security scheme: %s for %q is unknown", scheme.Type, input.SecuritySchemeName)
 		}
@@ -383,6 +876,7 @@ var (
 	_ caddy.Module                = (*Validator)(nil)
 	_ caddy.Provisioner           = (*Validator)(nil)
 	_ caddy.Validator             = (*Validator)(nil)
+	_ caddy.CleanerUpper          = (*Validator)(nil)
 	_ caddyfile.Unmarshaler       = (*Validator)(nil)
 	_ caddyhttp.MiddlewareHandler = (*Validator)(nil)
 )
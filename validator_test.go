@@ -46,6 +46,7 @@ func createValidator(t *testing.T) (*Validator, error) {
 	// NOTE: we're performing the Provision() steps manually here, because there's a lot going on under the hood of Caddy
 	validator.logger = zaptest.NewLogger(t)
 	validator.bufferPool = bpool.NewBufferPool(64)
+	validatorMetrics.init.Do(initValidatorMetrics)
 	err := validator.prepareOpenAPISpecification()
 	if err != nil {
 		return nil, err
@@ -65,6 +66,26 @@ func replaceValidator(v *Validator) (*Validator, error) {
 		PathPrefixToBeTrimmed: v.PathPrefixToBeTrimmed,
 		AdditionalServers:     v.AdditionalServers,
 		Enforce:               v.Enforce,
+		Enforcement:           v.Enforcement,
+		Rollout:               v.Rollout,
+		Breaker:               v.Breaker,
+		ResponseSampling:      v.ResponseSampling,
+		AsyncResponses:        v.AsyncResponses,
+		ResponseBuffering:     v.ResponseBuffering,
+		RequestStreaming:      v.RequestStreaming,
+		MaxRequestBodySize:    v.MaxRequestBodySize,
+		MaxLineErrors:         v.MaxLineErrors,
+		MaxDecompressedSize:   v.MaxDecompressedSize,
+		AnswerOptions:         v.AnswerOptions,
+		CORS:                  v.CORS,
+		HeadAsGet:             v.HeadAsGet,
+		JWT:                   v.JWT,
+		OpenIDConnect:         v.OpenIDConnect,
+		Introspection:         v.Introspection,
+		BasicAuth:             v.BasicAuth,
+		APIKeys:               v.APIKeys,
+		MutualTLS:             v.MutualTLS,
+		SecurityRaw:           v.SecurityRaw,
 		Log:                   v.Log,
 		logger:                v.logger,
 		bufferPool:            v.bufferPool,
@@ -179,6 +200,165 @@ func TestValidate(t *testing.T) {
 	}
 }
 
+func TestValidateEnforcement(t *testing.T) {
+	v, err := createValidator(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v.Enforcement = &Enforcement{Response: "ignore"}
+	err = v.Validate()
+	if err == nil {
+		t.Error("validator should fail when an invalid enforce mode is configured")
+	}
+
+	v.Enforcement = &Enforcement{Route: EnforceModeOff}
+	err = v.Validate()
+	if err == nil {
+		t.Error("validator should fail when route validation is off, but requests or responses are validated")
+	}
+
+	v.Enforcement = &Enforcement{Route: EnforceModeReport, Response: EnforceModeOff}
+	err = v.Validate()
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func outcomeOf(r *http.Request, phase validationPhase) string {
+	replacer := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	value, _ := replacer.GetString(replacerOutcomeKey(phase))
+	return value
+}
+
+func TestEnforcementModes(t *testing.T) {
+	v, err := createValidator(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Block on request failures, but only report on response failures
+	v.Enforcement = &Enforcement{
+		Request:  EnforceModeBlock,
+		Response: EnforceModeReport,
+	}
+	n, err := replaceValidator(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := prepareRequest("GET", "http://localhost:9443/api/pets/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := httptest.NewRecorder()
+
+	err = n.ServeHTTP(recorder, req, &mockWrongAPI{})
+	if err != nil {
+		t.Error(err)
+	}
+
+	if status := recorder.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusOK)
+	}
+
+	expected := map[validationPhase]string{
+		phaseRoute:    "passed",
+		phaseServer:   "passed",
+		phaseSecurity: "passed",
+		phaseRequest:  "passed",
+		phaseResponse: "reported",
+	}
+	for phase, want := range expected {
+		if got := outcomeOf(req, phase); got != want {
+			t.Errorf("unexpected %s outcome: got %s want %s", phase, got, want)
+		}
+	}
+
+	// Only report unknown routes and turn off response validation
+	v.Enforcement = &Enforcement{
+		Route:    EnforceModeReport,
+		Response: EnforceModeOff,
+	}
+	n, err = replaceValidator(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err = prepareRequest("GET", "http://localhost:9443/api/petz/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorder = httptest.NewRecorder()
+
+	err = n.ServeHTTP(recorder, req, &mockWrongAPI{})
+	if err != nil {
+		t.Error(err)
+	}
+
+	if status := recorder.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusOK)
+	}
+
+	if got := outcomeOf(req, phaseRoute); got != "reported" {
+		t.Errorf("unexpected route outcome: got %s want reported", got)
+	}
+
+	if got := outcomeOf(req, phaseResponse); got != "skipped" {
+		t.Errorf("unexpected response outcome: got %s want skipped", got)
+	}
+}
+
+func TestServerReporting(t *testing.T) {
+	v, err := createValidator(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v.Enforcement = &Enforcement{Server: EnforceModeReport}
+	n, err := replaceValidator(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The host is unknown, but the route is still found and the request and response are validated
+	req, err := prepareRequest("GET", "http://some-unknown-host:9443/api/pets/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := httptest.NewRecorder()
+
+	err = n.ServeHTTP(recorder, req, &mockAPI{})
+	if err != nil {
+		t.Error(err)
+	}
+
+	if got := outcomeOf(req, phaseServer); got != "reported" {
+		t.Errorf("unexpected server outcome: got %s want reported", got)
+	}
+
+	if got := outcomeOf(req, phaseResponse); got != "passed" {
+		t.Errorf("unexpected response outcome: got %s want passed", got)
+	}
+
+	req, err = prepareRequest("GET", "http://some-unknown-host:9443/api/pets/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorder = httptest.NewRecorder()
+
+	err = n.ServeHTTP(recorder, req, &mockWrongAPI{})
+	if err == nil {
+		t.Error("expected an error while enforcing response validation")
+	}
+}
+
 func TestServerValidation(t *testing.T) {
 	v, err := createValidator(t)
 	if err != nil {